@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// actions of abuse rules
+const (
+	AbuseActionLog      = "log"
+	AbuseActionThrottle = "throttle"
+	AbuseActionBan      = "ban"
+)
+
+const (
+	DefaultAbuseWindow      = time.Minute
+	DefaultAbuseMinRequests = 20
+	DefaultAbuseFor         = 10 * time.Minute
+	// abuseBuckets is the number of buckets a window slides by
+	abuseBuckets = 10
+)
+
+var ErrNotThrottled = errors.New("client is not throttled")
+
+// AbuseRule is triggered by a client reaching every threshold it sets over the window.
+type AbuseRule struct {
+	Name string `json:"name"`
+	// Rate is requests per second
+	Rate float64 `json:"rate,omitempty"`
+	// MissRatio is the ratio of requests not answered from cache
+	MissRatio float64 `json:"missRatio,omitempty"`
+	// ErrorRatio is the ratio of requests answered with errors
+	ErrorRatio float64 `json:"errorRatio,omitempty"`
+	// DistinctParams is the number of distinct params of one method, of methods matching Methods
+	// if it's not empty
+	DistinctParams int      `json:"distinctParams,omitempty"`
+	Methods        []string `json:"methods,omitempty"`
+	// Action is log, throttle or ban, a triggered rule acts at most once per window and client
+	Action string `json:"action"`
+	// Throttle limits requests of clients throttled
+	Throttle *RateLimit `json:"throttle,omitempty"`
+	// For is how long clients are throttled or banned
+	For Duration `json:"for,omitempty"`
+}
+
+// AbuseConfig detects abusive clients by requests over a sliding Window, clients are keyed by API
+// key or token subject if authenticated, by IP otherwise.
+type AbuseConfig struct {
+	Window Duration `json:"window"`
+	// MinRequests is the number of requests in the window for ratios to be judged
+	MinRequests int          `json:"minRequests"`
+	Rules       []*AbuseRule `json:"rules"`
+}
+
+func (c *AbuseConfig) SetDefaults() {
+	if c.Window.Duration == 0 {
+		c.Window.Duration = DefaultAbuseWindow
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = DefaultAbuseMinRequests
+	}
+	for _, r := range c.Rules {
+		if r.Action == "" {
+			r.Action = AbuseActionLog
+		}
+		if r.Action != AbuseActionLog && r.For.Duration == 0 {
+			r.For.Duration = DefaultAbuseFor
+		}
+		if r.Throttle != nil {
+			r.Throttle.SetDefaults()
+		}
+	}
+}
+
+func (c *AbuseConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.Window.Duration < abuseBuckets*time.Millisecond {
+		errs.Add("abuse.window", "must be at least %s", abuseBuckets*time.Millisecond)
+	}
+	if c.MinRequests < 0 {
+		errs.Add("abuse.minRequests", "must not be negative")
+	}
+	if len(c.Rules) == 0 {
+		errs.Add("abuse.rules", "is empty")
+	}
+	names := map[string]bool{}
+	for i, r := range c.Rules {
+		p := fmt.Sprintf("abuse.rules[%d]", i)
+		if r.Name == "" {
+			errs.Add(p+".name", "is empty")
+		} else if names[r.Name] {
+			errs.Add(p+".name", "duplicated rule %s", r.Name)
+		}
+		names[r.Name] = true
+		if r.Rate <= 0 && r.MissRatio <= 0 && r.ErrorRatio <= 0 && r.DistinctParams <= 0 {
+			errs.Add(p, "one of rate, missRatio, errorRatio and distinctParams is required")
+		}
+		if r.Rate < 0 {
+			errs.Add(p+".rate", "must not be negative")
+		}
+		if r.MissRatio < 0 || r.MissRatio > 1 {
+			errs.Add(p+".missRatio", "must be between 0 and 1")
+		}
+		if r.ErrorRatio < 0 || r.ErrorRatio > 1 {
+			errs.Add(p+".errorRatio", "must be between 0 and 1")
+		}
+		if r.DistinctParams < 0 {
+			errs.Add(p+".distinctParams", "must not be negative")
+		}
+		checkMethodPatterns(p+".methods", r.Methods, &errs)
+		switch r.Action {
+		case AbuseActionLog, AbuseActionBan:
+		case AbuseActionThrottle:
+			if r.Throttle == nil {
+				errs.Add(p+".throttle", "is required to throttle")
+			} else {
+				r.Throttle.check(p+".throttle", &errs)
+			}
+		default:
+			errs.Add(p+".action", "must be log, throttle or ban")
+		}
+		if r.For.Duration < 0 {
+			errs.Add(p+".for", "must not be negative")
+		}
+	}
+	return errs
+}
+
+// abuseBucket counts requests of a client in a slot of the window.
+type abuseBucket struct {
+	slot     int64
+	requests int
+	misses   int
+	errors   int
+	// params are hashes of params by method
+	params map[string]map[uint64]bool
+}
+
+// abuseThrottle limits requests of a throttled client.
+type abuseThrottle struct {
+	rule   string
+	bucket *tokenBucket
+	until  time.Time
+}
+
+// abuseClient is the sliding window of a client, counts are the sums of the buckets.
+type abuseClient struct {
+	buckets  [abuseBuckets]abuseBucket
+	requests int
+	misses   int
+	errors   int
+	// params counts buckets having the params by method
+	params    map[string]map[uint64]int
+	triggered map[string]time.Time
+	throttle  *abuseThrottle
+}
+
+// slide expires the buckets out of the window at slot.
+func (c *abuseClient) slide(slot int64) *abuseBucket {
+	for i := range c.buckets {
+		b := &c.buckets[i]
+		if b.slot > slot-abuseBuckets {
+			continue
+		}
+		c.requests -= b.requests
+		c.misses -= b.misses
+		c.errors -= b.errors
+		for m, hashes := range b.params {
+			for h := range hashes {
+				if c.params[m][h]--; c.params[m][h] <= 0 {
+					delete(c.params[m], h)
+				}
+			}
+			if len(c.params[m]) == 0 {
+				delete(c.params, m)
+			}
+		}
+		*b = abuseBucket{}
+	}
+	b := &c.buckets[slot%abuseBuckets]
+	b.slot = slot
+	return b
+}
+
+// idle tells whether the window of c is empty at slot and it's not throttled.
+func (c *abuseClient) idle(slot int64, now time.Time) bool {
+	c.slide(slot)
+	return c.requests == 0 && (c.throttle == nil || !now.Before(c.throttle.until))
+}
+
+// AbuseObservation is requests of a client answered, with the hashes of their params.
+type AbuseObservation struct {
+	Methods []string
+	Params  []uint64
+	Misses  int
+	Errors  int
+}
+
+// ThrottledClient is a client throttled by an abuse rule.
+type ThrottledClient struct {
+	Key   string    `json:"key"`
+	Rule  string    `json:"rule"`
+	Until time.Time `json:"until"`
+}
+
+type abuseRule struct {
+	*AbuseRule
+	methods *methodAccess
+}
+
+// abuseDetector keeps sliding windows of clients and acts on rules triggered.
+type abuseDetector struct {
+	conf  *AbuseConfig
+	clock Clock
+	bans  *ipBans
+	rules []*abuseRule
+	// maxDistinct is the max number of distinct params kept per method and client
+	maxDistinct int
+	slotLength  time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*abuseClient
+}
+
+func newAbuseDetector(conf *AbuseConfig, clock Clock, bans *ipBans) *abuseDetector {
+	d := &abuseDetector{conf: conf, clock: clock, bans: bans, slotLength: conf.Window.Duration / abuseBuckets, clients: map[string]*abuseClient{}}
+	for _, r := range conf.Rules {
+		d.rules = append(d.rules, &abuseRule{AbuseRule: r, methods: newMethodAccess(r.Methods, nil, nil)})
+		if r.DistinctParams > d.maxDistinct {
+			d.maxDistinct = r.DistinctParams
+		}
+	}
+	go d.runSweeper(conf.Window.Duration)
+	return d
+}
+
+func (d *abuseDetector) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(d.slotLength)
+}
+
+// Allow tells whether a throttled client can send n requests, if not, it tells how long to wait.
+func (d *abuseDetector) Allow(client string, n int) (bool, time.Duration) {
+	now := d.clock.Now()
+	d.mu.Lock()
+	c := d.clients[client]
+	var t *abuseThrottle
+	if c != nil && c.throttle != nil && now.Before(c.throttle.until) {
+		t = c.throttle
+	}
+	d.mu.Unlock()
+	if t == nil {
+		return true, 0
+	}
+	ok, wait := t.bucket.take(now, float64(n))
+	if !ok && wait == 0 {
+		// throttled to 0 until the end
+		wait = t.until.Sub(now)
+	}
+	return ok, wait
+}
+
+// Observe counts requests of client from ip, and acts on the rules triggered.
+func (d *abuseDetector) Observe(client string, ip net.IP, o *AbuseObservation) {
+	now := d.clock.Now()
+	slot := d.slot(now)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[client]
+	if !ok {
+		c = &abuseClient{params: map[string]map[uint64]int{}, triggered: map[string]time.Time{}}
+		d.clients[client] = c
+	}
+	b := c.slide(slot)
+	b.requests += len(o.Methods)
+	b.misses += o.Misses
+	b.errors += o.Errors
+	c.requests += len(o.Methods)
+	c.misses += o.Misses
+	c.errors += o.Errors
+	for i := 0; i < len(o.Params) && i < len(o.Methods); i++ {
+		d.addParams(c, b, o.Methods[i], o.Params[i])
+	}
+	for _, r := range d.rules {
+		if t, ok := c.triggered[r.Name]; ok && now.Sub(t) < d.conf.Window.Duration {
+			continue
+		}
+		if reason := d.match(c, r, o.Methods); reason != "" {
+			c.triggered[r.Name] = now
+			d.act(client, ip, c, r, reason, now)
+		}
+	}
+}
+
+func (d *abuseDetector) addParams(c *abuseClient, b *abuseBucket, method string, hash uint64) {
+	if d.maxDistinct == 0 {
+		return
+	}
+	if b.params == nil {
+		b.params = map[string]map[uint64]bool{}
+	}
+	if b.params[method][hash] {
+		return
+	}
+	window := c.params[method]
+	if window == nil {
+		window = map[uint64]int{}
+		c.params[method] = window
+	}
+	// params beyond thresholds are of no use
+	if _, ok := window[hash]; !ok && len(window) > d.maxDistinct {
+		return
+	}
+	if b.params[method] == nil {
+		b.params[method] = map[uint64]bool{}
+	}
+	b.params[method][hash] = true
+	window[hash]++
+}
+
+// match returns why r is triggered by c, empty if it's not. Only the methods just requested are
+// checked for distinct params.
+func (d *abuseDetector) match(c *abuseClient, r *abuseRule, methods []string) string {
+	var reasons []string
+	if r.Rate > 0 {
+		rate := float64(c.requests) / d.conf.Window.Seconds()
+		if rate < r.Rate {
+			return ""
+		}
+		reasons = append(reasons, fmt.Sprintf("rate %.1f/s", rate))
+	}
+	if r.MissRatio > 0 || r.ErrorRatio > 0 {
+		if c.requests == 0 || c.requests < d.conf.MinRequests {
+			return ""
+		}
+	}
+	if r.MissRatio > 0 {
+		ratio := float64(c.misses) / float64(c.requests)
+		if ratio < r.MissRatio {
+			return ""
+		}
+		reasons = append(reasons, fmt.Sprintf("miss ratio %.2f", ratio))
+	}
+	if r.ErrorRatio > 0 {
+		ratio := float64(c.errors) / float64(c.requests)
+		if ratio < r.ErrorRatio {
+			return ""
+		}
+		reasons = append(reasons, fmt.Sprintf("error ratio %.2f", ratio))
+	}
+	if r.DistinctParams > 0 {
+		found := ""
+		for _, m := range methods {
+			if r.methods.Allowed(m) && len(c.params[m]) >= r.DistinctParams {
+				found = fmt.Sprintf("%d distinct params of %s", len(c.params[m]), m)
+				break
+			}
+		}
+		if found == "" {
+			return ""
+		}
+		reasons = append(reasons, found)
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// act takes the action of r triggered by client, d.mu must be held.
+func (d *abuseDetector) act(client string, ip net.IP, c *abuseClient, r *abuseRule, reason string, now time.Time) {
+	AbuseDetected.WithLabelValues(r.Name, r.Action).Inc()
+	entry := log.WithFields(log.Fields{"client": client, "ip": ip.String(), "rule": r.Name, "action": r.Action, "reason": reason})
+	switch r.Action {
+	case AbuseActionThrottle:
+		bucket := newTokenBucket(r.Throttle.Rate, r.Throttle.Burst)
+		bucket.last = now
+		c.throttle = &abuseThrottle{rule: r.Name, bucket: bucket, until: now.Add(r.For.Duration)}
+	case AbuseActionBan:
+		if _, err := d.bans.Ban(ip.String(), r.For.Duration, "abuse rule "+r.Name); err != nil {
+			entry.WithError(err).Error("failed to ban abusive client")
+			return
+		}
+	}
+	entry.Warn("abusive client detected")
+}
+
+// Throttled lists clients throttled sorted by key.
+func (d *abuseDetector) Throttled() []*ThrottledClient {
+	now := d.clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var clients []*ThrottledClient
+	for k, c := range d.clients {
+		if c.throttle != nil && now.Before(c.throttle.until) {
+			clients = append(clients, &ThrottledClient{Key: k, Rule: c.throttle.rule, Until: c.throttle.until})
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Key < clients[j].Key })
+	return clients
+}
+
+// Unthrottle lifts the throttle of client.
+func (d *abuseDetector) Unthrottle(client string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.clients[client]
+	if c == nil || c.throttle == nil || !d.clock.Now().Before(c.throttle.until) {
+		return ErrNotThrottled
+	}
+	c.throttle = nil
+	return nil
+}
+
+func (d *abuseDetector) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.sweep(d.clock.Now())
+	}
+}
+
+// sweep forgets clients idle for a window and not throttled.
+func (d *abuseDetector) sweep(now time.Time) {
+	slot := d.slot(now)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, c := range d.clients {
+		if c.idle(slot, now) {
+			delete(d.clients, k)
+		}
+	}
+}
+
+// hashParams returns hashes of params of a request or a batch.
+func hashParams(body []byte) []uint64 {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+	hash := func(params jsoniter.Any) uint64 {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(params.ToString()))
+		return h.Sum64()
+	}
+	switch body[0] {
+	case '{':
+		return []uint64{hash(jsoniter.Get(body, "params"))}
+	case '[':
+		reqs := jsoniter.Get(body)
+		hashes := make([]uint64, reqs.Size())
+		for i := range hashes {
+			hashes[i] = hash(reqs.Get(i, "params"))
+		}
+		return hashes
+	}
+	return nil
+}
+
+// countRpcErrors counts errors of the response, errors of compressed batch responses are not counted.
+func countRpcErrors(ctx *fasthttp.RequestCtx, batch bool) int {
+	if !batch {
+		if getCtxRpcErr(ctx) != nil || ctx.Response.StatusCode() >= 400 {
+			return 1
+		}
+		return 0
+	}
+	if len(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding)) > 0 {
+		return 0
+	}
+	resps := jsoniter.Get(ctx.Response.Body())
+	errs := 0
+	for i := 0; i < resps.Size(); i++ {
+		if resps.Get(i, "error").LastError() == nil {
+			errs++
+		}
+	}
+	return errs
+}
+
+// abuseHandler throttles clients throttled by abuse rules with LimitExceeded and HTTP 429, and
+// observes requests answered.
+func (p *Proxy) abuseHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if p.abuse == nil || !ctx.IsPost() || p.routeOf(ctx) == nil {
+			h(ctx)
+			return
+		}
+		methods, id := peekRpcRequests(ctx.Request.Body())
+		if len(methods) == 0 {
+			h(ctx)
+			return
+		}
+		client := clientKey(ctx)
+		if ok, wait := p.abuse.Allow(client, len(methods)); !ok {
+			for _, m := range methods {
+				RateLimited.WithLabelValues("abuse", m).Inc()
+			}
+			ctx.SetUserValue("isRpcReq", true)
+			setCtxRpcMethods(ctx, methods)
+			writeRpcErrResp(ctx, jsonrpc.ErrWithData(jsonrpc.ErrRpcLimitExceeded, "client is throttled"), id)
+			ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return
+		}
+		var params []uint64
+		if p.abuse.maxDistinct > 0 {
+			params = hashParams(ctx.Request.Body())
+		}
+		h(ctx)
+		o := &AbuseObservation{Methods: methods, Params: params, Errors: countRpcErrors(ctx, isBatchBody(ctx.Request.Body()))}
+		for _, s := range getCtxCacheStatuses(ctx) {
+			if s == CacheStatusMiss || s == CacheStatusBypass || s == CacheStatusStale {
+				o.Misses++
+			}
+		}
+		p.abuse.Observe(client, clientIP(ctx), o)
+	}
+}
+
+func isBatchBody(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) > 0 && body[0] == '['
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/fasthttp/router"
+	jsoniter "github.com/json-iterator/go"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAbuseDetector(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &AbuseConfig{
+		Window:      Duration{Duration: 10 * time.Second},
+		MinRequests: 4,
+		Rules: []*AbuseRule{
+			{Name: "fast", Rate: 0.5},
+			{Name: "scraper", DistinctParams: 3, Methods: []string{"GetTx*"}, Action: AbuseActionBan},
+			{Name: "errors", ErrorRatio: 0.5, MissRatio: 0.5, Action: AbuseActionThrottle, Throttle: &RateLimit{Rate: 1}},
+		},
+	}
+	conf.SetDefaults()
+	assert.Empty(conf.Check())
+	assert.Equal(DefaultAbuseFor, conf.Rules[1].For.Duration)
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	bans := newIPBans(clock)
+	d := newAbuseDetector(conf, clock, bans)
+	ip := net.ParseIP("1.1.1.1")
+
+	// distinct params of other methods are not counted
+	d.Observe("a", ip, &AbuseObservation{Methods: []string{"GetBalance", "GetBalance", "GetBalance"}, Params: []uint64{1, 2, 3}})
+	assert.Nil(bans.Banned(ip))
+	d.Observe("a", ip, &AbuseObservation{Methods: []string{"GetTx", "GetTx"}, Params: []uint64{1, 2}})
+	assert.Nil(bans.Banned(ip))
+	d.Observe("a", ip, &AbuseObservation{Methods: []string{"GetTx"}, Params: []uint64{2}})
+	assert.Nil(bans.Banned(ip))
+	d.Observe("a", ip, &AbuseObservation{Methods: []string{"GetTx"}, Params: []uint64{3}})
+	if ban := bans.Banned(ip); assert.NotNil(ban) {
+		assert.Equal("abuse rule scraper", ban.Reason)
+		assert.Equal(clock.Now().Add(DefaultAbuseFor), ban.Until)
+	}
+	assert.Len(d.clients["a"].params["GetTx"], 3)
+	assert.NotEmpty(d.clients["a"].triggered["fast"])
+
+	// the window slides
+	assert.NoError(bans.Unban("1.1.1.1"))
+	clock.Add(5 * time.Second)
+	d.Observe("a", ip, &AbuseObservation{Methods: []string{"GetTx"}, Params: []uint64{4}})
+	assert.Len(d.clients["a"].params["GetTx"], 4)
+	clock.Add(5 * time.Second)
+	d.clients["a"].slide(d.slot(clock.Now()))
+	assert.Equal(1, d.clients["a"].requests)
+	assert.Len(d.clients["a"].params["GetTx"], 1)
+	assert.Nil(bans.Banned(ip))
+
+	// ratios are judged from min requests
+	ok, _ := d.Allow("b", 1)
+	assert.True(ok)
+	d.Observe("b", ip, &AbuseObservation{Methods: []string{"Echo", "Echo", "Echo"}, Misses: 3, Errors: 3})
+	assert.Empty(d.Throttled())
+	d.Observe("b", ip, &AbuseObservation{Methods: []string{"Echo"}, Misses: 1, Errors: 0})
+	assert.Equal([]*ThrottledClient{{Key: "b", Rule: "errors", Until: clock.Now().Add(DefaultAbuseFor)}}, d.Throttled())
+	ok, _ = d.Allow("b", 1)
+	assert.True(ok)
+	ok, wait := d.Allow("b", 1)
+	assert.False(ok)
+	assert.Equal(time.Second, wait)
+	assert.NoError(d.Unthrottle("b"))
+	assert.Equal(ErrNotThrottled, d.Unthrottle("b"))
+	ok, _ = d.Allow("b", 1)
+	assert.True(ok)
+
+	d.sweep(clock.Now().Add(time.Minute))
+	assert.Empty(d.clients)
+
+	conf = &AbuseConfig{Rules: []*AbuseRule{{Name: "a"}, {Name: "a", Rate: 1, Action: AbuseActionThrottle}, {Name: "b", MissRatio: 2, Action: "kill"}}}
+	conf.SetDefaults()
+	assert.Len(conf.Check(), 5)
+}
+
+func TestAbuseHandler(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newNegativeUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		Abuse: &AbuseConfig{Rules: []*AbuseRule{
+			{Name: "scraper", DistinctParams: 3, Action: AbuseActionBan},
+			{Name: "errors", ErrorRatio: 0.5, Action: AbuseActionThrottle, Throttle: &RateLimit{Rate: 0}},
+		}, MinRequests: 2},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	r := router.New()
+	p.RegisterHandler(r)
+	NewManage(config, p).registerHandler(r)
+	h := p.abuseHandler(p.ipFilterHandler(r.Handler))
+	do := func(method, uri, remote, body string) *fasthttp.RequestCtx {
+		ctx := newTestCtx(method, uri, remote)
+		ctx.Request.SetBodyString(body)
+		h(ctx)
+		return ctx
+	}
+	for _, params := range []string{`["a"]`, `["a"]`, `["b"]`} {
+		assert.Equal(200, do("POST", "/", "1.1.1.1", `{"jsonrpc":"2.0","id":1,"method":"GetTx","params":`+params+`}`).Response.StatusCode())
+	}
+	assert.Nil(p.bans.Banned(net.ParseIP("1.1.1.1")))
+	do("POST", "/", "1.1.1.1", `[{"jsonrpc":"2.0","id":1,"method":"GetTx","params":["c"]}]`)
+	ctx := do("POST", "/", "1.1.1.1", `{"jsonrpc":"2.0","id":1,"method":"GetTx","params":["d"]}`)
+	assert.Equal(fasthttp.StatusForbidden, ctx.Response.StatusCode())
+	ctx = do("GET", "/manage/bans", "127.0.0.1", "")
+	var bans manageBans
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &bans))
+	if assert.Len(bans.Bans, 1) {
+		assert.Equal("1.1.1.1/32", bans.Bans[0].Prefix)
+	}
+
+	// errors
+	batch := `[{"jsonrpc":"2.0","id":1,"method":"Unknown","params":[]},{"jsonrpc":"2.0","id":2,"method":"Echo","params":[]}]`
+	assert.Equal(200, do("POST", "/", "2.2.2.2", batch).Response.StatusCode())
+	// the burst of the throttle is taken by a larger batch
+	assert.Equal(200, do("POST", "/", "2.2.2.2", batch).Response.StatusCode())
+	ctx = do("POST", "/", "2.2.2.2", batch)
+	assert.Equal(fasthttp.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal("600", string(ctx.Response.Header.Peek(fasthttp.HeaderRetryAfter)))
+	ctx = do("GET", "/manage/abuse/throttled", "127.0.0.1", "")
+	var throttled manageThrottled
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &throttled))
+	if assert.Len(throttled.Clients, 1) {
+		assert.Equal("2.2.2.2", throttled.Clients[0].Key)
+	}
+	assert.Equal(200, do("DELETE", "/manage/abuse/throttled?key=2.2.2.2", "127.0.0.1", "").Response.StatusCode())
+	assert.Equal(fasthttp.StatusNotFound, do("DELETE", "/manage/abuse/throttled?key=2.2.2.2", "127.0.0.1", "").Response.StatusCode())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	"github.com/valyala/fasthttp"
+	"path"
+	"strings"
+)
+
+// reservedMethodPrefix prefixes methods reserved for rpc-internal methods by the JSON-RPC 2.0 spec.
+const reservedMethodPrefix = "rpc."
+
+var errMethodNotAllowed = jsonrpc.ErrWithData(jsonrpc.ErrRpcMethodNotFound, "method is not allowed")
+
+// MethodError is a JSON-RPC error answered by the proxy.
+type MethodError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data,omitempty"`
+}
+
+// MethodAccess allows methods matching Allow, or every method if it's empty, except those
+// matching Deny. Patterns are globs like `debug_*`, reserved `rpc.*` methods are always denied.
+type MethodAccess struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Error answers denied methods instead of MethodNotFound
+	Error *MethodError `json:"error,omitempty"`
+}
+
+func (c *MethodAccess) check(path string, errs *ConfigErrors) {
+	checkMethodPatterns(path+".allow", c.Allow, errs)
+	checkMethodPatterns(path+".deny", c.Deny, errs)
+	if c.Error != nil && c.Error.Message == "" {
+		errs.Add(path+".error.message", "is empty")
+	}
+}
+
+func checkMethodPatterns(path string, patterns []string, errs *ConfigErrors) {
+	for i, p := range patterns {
+		if _, err := matchMethod(p, ""); err != nil || p == "" {
+			errs.Add(fmt.Sprintf("%s[%d]", path, i), "invalid pattern %q", p)
+		} else if strings.HasPrefix(p, reservedMethodPrefix) {
+			errs.Add(fmt.Sprintf("%s[%d]", path, i), "reserved %s* methods are always denied", reservedMethodPrefix)
+		}
+	}
+}
+
+// RouteConfig serves RPC requests at Path besides path, with its own method and IP access, and
+// CORS policy if it's set.
+type RouteConfig struct {
+	Path         string        `json:"path"`
+	MethodAccess *MethodAccess `json:"methodAccess,omitempty"`
+	IPAccess     *IPAccess     `json:"ipAccess,omitempty"`
+	Cors         *CorsConfig   `json:"cors,omitempty"`
+}
+
+func matchMethod(pattern, method string) (bool, error) {
+	if strings.HasPrefix(method, reservedMethodPrefix) && !strings.HasPrefix(pattern, reservedMethodPrefix) {
+		return false, nil
+	}
+	return path.Match(pattern, method)
+}
+
+func matchAnyMethod(patterns []string, method string) bool {
+	for _, p := range patterns {
+		if ok, _ := matchMethod(p, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// methodAccess is a compiled MethodAccess, nil allows every method.
+type methodAccess struct {
+	// allow is nil if every method is allowed
+	allow []string
+	deny  []string
+	err   *jsonrpc.RpcError
+}
+
+// newMethodAccess returns the access of allow and deny, nil if there is no restriction.
+func newMethodAccess(allow, deny []string, e *MethodError) *methodAccess {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	a := &methodAccess{deny: deny, err: errMethodNotAllowed}
+	if len(allow) > 0 {
+		a.allow = allow
+	}
+	if e != nil {
+		a.err = jsonrpc.NewRpcError("MethodDenied", e.Code, e.Message)
+		if e.Data != "" {
+			a.err = jsonrpc.ErrWithData(a.err, e.Data)
+		}
+	}
+	return a
+}
+
+func newRouteAccess(conf *MethodAccess) *methodAccess {
+	if conf == nil {
+		return nil
+	}
+	return newMethodAccess(conf.Allow, conf.Deny, conf.Error)
+}
+
+// Allowed tells whether method is allowed.
+func (a *methodAccess) Allowed(method string) bool {
+	if a == nil {
+		return true
+	}
+	if (a.allow != nil || strings.HasPrefix(method, reservedMethodPrefix)) && !matchAnyMethod(a.allow, method) {
+		return false
+	}
+	return !matchAnyMethod(a.deny, method)
+}
+
+// route is a path serving RPC requests.
+type route struct {
+	path   string
+	access *methodAccess
+	ips    *ipAccess
+	cors   *corsPolicy
+}
+
+// routeOf returns the route of the request path, nil if it's not an RPC path.
+func (p *Proxy) routeOf(ctx *fasthttp.RequestCtx) *route {
+	if r := p.routes[string(ctx.Path())]; r != nil || p.apiKeys == nil {
+		return r
+	}
+	// the key is not yet removed from the path before authHandler
+	if key, path := p.apiKeys.pathKey(ctx.Path(), p.config.Path); key != "" {
+		return p.routes[path]
+	}
+	return nil
+}
+
+// deniedError returns the error answering method if it's reserved, or denied on route or to client.
+func deniedError(r *route, client *authClient, method string) *jsonrpc.RpcError {
+	if strings.HasPrefix(method, reservedMethodPrefix) {
+		MethodDenied.WithLabelValues("reserved").Inc()
+		return errMethodNotAllowed
+	}
+	if r != nil && !r.access.Allowed(method) {
+		MethodDenied.WithLabelValues("route").Inc()
+		return r.access.err
+	}
+	if !client.Allowed(method) {
+		MethodDenied.WithLabelValues("client").Inc()
+		return errMethodNotAllowed
+	}
+	return nil
+}
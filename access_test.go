@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/fasthttp/router"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMethodAccess(t *testing.T) {
+	assert := assertion.New(t)
+	var a *methodAccess
+	assert.True(a.Allowed("rpc.discover"))
+	assert.Nil(newMethodAccess(nil, nil, nil))
+
+	a = newMethodAccess(nil, []string{"debug_*", "admin_?etPeers"}, nil)
+	for m, allowed := range map[string]bool{
+		"eth_call":       true,
+		"debug_trace":    false,
+		"admin_getPeers": false,
+		"admin_setPeers": false,
+		"admin_peers":    true,
+		"rpc.discover":   false,
+	} {
+		assert.Equal(allowed, a.Allowed(m), m)
+	}
+	assert.Equal(errMethodNotAllowed, a.err)
+
+	a = newMethodAccess([]string{"Get*", "rpc.discover"}, []string{"GetSecret"}, &MethodError{Code: -32000, Message: "blocked", Data: "ask admin"})
+	for m, allowed := range map[string]bool{
+		"GetBalance":   true,
+		"GetSecret":    false,
+		"SetBalance":   false,
+		"rpc.discover": true,
+		"rpc.other":    false,
+	} {
+		assert.Equal(allowed, a.Allowed(m), m)
+	}
+	assert.Equal(`{"code":-32000,"message":"blocked","data":"ask admin"}`, func() string {
+		b, _ := jsoniter.Marshal(a.err)
+		return string(b)
+	}())
+	// * never matches reserved methods
+	assert.False(newMethodAccess([]string{"*"}, nil, nil).Allowed("rpc.discover"))
+
+	var errs ConfigErrors
+	(&MethodAccess{Allow: []string{"[a-", "rpc.discover"}, Deny: []string{""}, Error: &MethodError{Code: 1}}).check("methodAccess", &errs)
+	assert.Len(errs, 4)
+}
+
+func TestReservedMethods(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newNegativeUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+
+	ctx := doProxyRequest(p, `{"jsonrpc":"2.0","id":1,"method":"rpc.discover","params":[]}`)
+	assert.Equal(fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	assert.Contains(string(ctx.Response.Body()), `"code":-32601`)
+	ctx = doProxyRequest(p, `[{"jsonrpc":"2.0","id":1,"method":"rpc.discover","params":[]},{"jsonrpc":"2.0","id":2,"method":"GetBalance","params":["a"]}]`)
+	var resps []jsonrpc.RpcResponse
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &resps))
+	if assert.Len(resps, 2) {
+		assert.EqualValues(-32601, resps[0].Error.Code)
+		assert.Equal([]interface{}{"GetBalance"}, resps[1].Result)
+	}
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+}
+
+func TestRoutes(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:       "127.0.0.1:8080",
+		Upstreams:    []string{newNegativeUpstream(t, &calls)},
+		Cache:        &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		MethodAccess: &MethodAccess{Deny: []string{"Debug*"}, Error: &MethodError{Code: -32601, Message: "Method not found", Data: "blocked"}},
+		Routes:       []*RouteConfig{{Path: "/internal"}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	r := router.New()
+	p.RegisterHandler(r)
+	do := func(path, body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI(path)
+		ctx.Request.SetBodyString(body)
+		r.Handler(ctx)
+		return ctx
+	}
+	ctx := do("/", `{"jsonrpc":"2.0","id":1,"method":"DebugTrace","params":[]}`)
+	assert.Equal(fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	assert.Equal(`{"id":1,"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found","data":"blocked"}}`, string(ctx.Response.Body()))
+	ctx = do("/", `{"jsonrpc":"2.0","id":1,"method":"rpc.discover","params":[]}`)
+	assert.Equal(fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	assert.EqualValues(0, atomic.LoadInt64(&calls))
+
+	// only blocked requests of a batch fail
+	ctx = do("/", `[{"jsonrpc":"2.0","id":1,"method":"DebugTrace","params":[]},{"jsonrpc":"2.0","id":2,"method":"GetBalance","params":["a"]}]`)
+	assert.Equal(200, ctx.Response.StatusCode())
+	var resps []jsonrpc.RpcResponse
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &resps))
+	if assert.Len(resps, 2) {
+		assert.EqualValues(-32601, resps[0].Error.Code)
+		assert.Equal([]interface{}{"GetBalance"}, resps[1].Result)
+	}
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+
+	// other routes have their own access
+	ctx = do("/internal", `{"jsonrpc":"2.0","id":1,"method":"DebugTrace","params":[]}`)
+	assert.Equal(`{"jsonrpc":"2.0","id":1,"result":["DebugTrace"]}`, string(ctx.Response.Body()))
+	assert.Equal(fasthttp.StatusNotFound, do("/other", `{}`).Response.StatusCode())
+
+	config.Routes = append(config.Routes, &RouteConfig{Path: "/"}, &RouteConfig{Path: "internal"})
+	assert.Len(config.Check(), 2)
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultApiKeyQuery      = "apikey"
+	DefaultApiKeyPathPrefix = "/v1/"
+	DefaultKeysReload       = 10 * time.Second
+)
+
+// ClientPolicy is the method access and the rate limits of authenticated clients.
+type ClientPolicy struct {
+	// Label names the clients in metrics and logs
+	Label string `json:"label,omitempty"`
+	// Methods are patterns of the methods allowed, all methods are allowed if it's empty
+	Methods []string `json:"methods,omitempty"`
+	// DenyMethods are patterns of the methods denied even if they are allowed
+	DenyMethods []string `json:"denyMethods,omitempty"`
+	// RateLimit and MethodRateLimits override those of rateLimit
+	RateLimit        *RateLimit         `json:"rateLimit,omitempty"`
+	MethodRateLimits []*MethodRateLimit `json:"methodRateLimits,omitempty"`
+	// UpstreamGroup is the name of the upstream group serving the clients, upstreams by default
+	UpstreamGroup string `json:"upstreamGroup,omitempty"`
+
+	access *methodAccess
+	limits *clientLimits
+}
+
+func (c *ClientPolicy) SetDefaults() {
+	if c.RateLimit != nil {
+		c.RateLimit.SetDefaults()
+	}
+	for _, m := range c.MethodRateLimits {
+		m.SetDefaults()
+	}
+}
+
+func (c *ClientPolicy) check(path string, groups []*UpstreamGroupConfig, errs *ConfigErrors) {
+	checkMethodPatterns(path+".methods", c.Methods, errs)
+	checkMethodPatterns(path+".denyMethods", c.DenyMethods, errs)
+	if c.RateLimit != nil {
+		c.RateLimit.check(path+".rateLimit", errs)
+	}
+	checkMethodRateLimits(path+".methodRateLimits", c.MethodRateLimits, errs)
+	if c.UpstreamGroup != "" && findUpstreamGroup(groups, c.UpstreamGroup) == nil {
+		errs.Add(path+".upstreamGroup", "unknown upstream group %s", c.UpstreamGroup)
+	}
+}
+
+// ApiKey is a key of clients and its policy, the key is redacted as the label if it's empty.
+type ApiKey struct {
+	Key string `json:"key"`
+	ClientPolicy
+}
+
+func (k *ApiKey) SetDefaults() {
+	if k.Label == "" {
+		k.Label = redactKey(k.Key)
+	}
+	k.ClientPolicy.SetDefaults()
+}
+
+// UpstreamGroupConfig is a group of upstreams serving some API keys.
+type UpstreamGroupConfig struct {
+	Name      string   `json:"name"`
+	Upstreams []string `json:"upstreams"`
+}
+
+// AuthConfig accepts API keys in Header, in Query, or as the path segment after PathPrefix, and
+// bearer tokens if JWT is set.
+type AuthConfig struct {
+	// Required rejects requests without key, otherwise they are served as anonymous
+	Required   bool      `json:"required"`
+	Header     string    `json:"header"`
+	Query      string    `json:"query"`
+	PathPrefix string    `json:"pathPrefix"`
+	Keys       []*ApiKey `json:"keys,omitempty"`
+	// File is a YAML list of keys besides Keys, it's reloaded every Reload if changed
+	File   string     `json:"file,omitempty"`
+	Reload Duration   `json:"reload,omitempty"`
+	JWT    *JWTConfig `json:"jwt,omitempty"`
+}
+
+func (c *AuthConfig) SetDefaults() {
+	if c.Header == "" {
+		c.Header = DefaultApiKeyHeader
+	}
+	if c.Query == "" {
+		c.Query = DefaultApiKeyQuery
+	}
+	if c.PathPrefix == "" {
+		c.PathPrefix = DefaultApiKeyPathPrefix
+	}
+	if c.File != "" && c.Reload.Duration == 0 {
+		c.Reload.Duration = DefaultKeysReload
+	}
+	for _, k := range c.Keys {
+		k.SetDefaults()
+	}
+	if c.JWT != nil {
+		c.JWT.SetDefaults()
+	}
+}
+
+func (c *AuthConfig) Check(groups []*UpstreamGroupConfig) ConfigErrors {
+	var errs ConfigErrors
+	if !strings.HasPrefix(c.PathPrefix, "/") || !strings.HasSuffix(c.PathPrefix, "/") {
+		errs.Add("auth.pathPrefix", "must start and end with '/'")
+	}
+	if c.Reload.Duration < 0 {
+		errs.Add("auth.reload", "must not be negative")
+	}
+	errs = append(errs, checkApiKeys("auth.keys", c.Keys, groups)...)
+	if c.JWT != nil {
+		c.JWT.check("auth.jwt", groups, &errs)
+	}
+	return errs
+}
+
+func checkApiKeys(path string, keys []*ApiKey, groups []*UpstreamGroupConfig) ConfigErrors {
+	var errs ConfigErrors
+	seen := map[string]bool{}
+	for i, k := range keys {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		if k.Key == "" {
+			errs.Add(p+".key", "is empty")
+		} else if seen[k.Key] {
+			errs.Add(p+".key", "duplicated key %s", redactKey(k.Key))
+		}
+		seen[k.Key] = true
+		k.ClientPolicy.check(p, groups, &errs)
+	}
+	return errs
+}
+
+func findUpstreamGroup(groups []*UpstreamGroupConfig, name string) *UpstreamGroupConfig {
+	for _, g := range groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// apiKeyID is the id of the client of key, it's stable and doesn't reveal the key in logs, manage
+// responses and metrics.
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:8])
+}
+
+// redactKey keeps the first 4 characters of key for logs.
+func redactKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:4] + "****"
+}
+
+// apiKeys holds the keys of config and the keys file, keys of the file are replaced on reload.
+type apiKeys struct {
+	conf   *AuthConfig
+	groups []*UpstreamGroupConfig
+	rate   *RateLimitConfig
+	// keys is a map[string]*ApiKey
+	keys    atomic.Value
+	modTime time.Time
+}
+
+func newApiKeys(conf *AuthConfig, groups []*UpstreamGroupConfig, rate *RateLimitConfig) (*apiKeys, error) {
+	a := &apiKeys{conf: conf, groups: groups, rate: rate}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	if conf.File != "" && conf.Reload.Duration > 0 {
+		go a.runReloader(conf.Reload.Duration)
+	}
+	return a, nil
+}
+
+// load loads keys of config and of the file with secret references resolved, keys are not changed
+// on errors.
+func (a *apiKeys) load() error {
+	keys := append([]*ApiKey{}, a.conf.Keys...)
+	if a.conf.File != "" {
+		stat, err := os.Stat(a.conf.File)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(a.conf.File)
+		if err != nil {
+			return err
+		}
+		var fileKeys []*ApiKey
+		if err := yaml.UnmarshalStrict(content, &fileKeys); err != nil {
+			return err
+		}
+		// secrets are resolved on every reload as they may have changed
+		if errs := resolveSecretsIn(reflect.ValueOf(fileKeys), "file"); len(errs) > 0 {
+			return errs
+		}
+		for _, k := range fileKeys {
+			k.SetDefaults()
+		}
+		keys = append(keys, fileKeys...)
+		a.modTime = stat.ModTime()
+	}
+	if errs := checkApiKeys("keys", keys, a.groups); len(errs) > 0 {
+		return errs
+	}
+	m := make(map[string]*ApiKey, len(keys))
+	for _, k := range keys {
+		// keys of config are shared by reloads, they are copied so that keys in use are not changed
+		key := *k
+		key.init(a.rate)
+		m[k.Key] = &key
+	}
+	a.keys.Store(m)
+	return nil
+}
+
+// init prepares the allowed methods and the rate limits of c by the rate limit config.
+func (c *ClientPolicy) init(rate *RateLimitConfig) {
+	c.access = newMethodAccess(c.Methods, c.DenyMethods, nil)
+	limit := c.RateLimit
+	if limit == nil {
+		limit = &rate.RateLimit
+	}
+	c.limits = &clientLimits{limit: limit, methods: methodLimits(rate.Methods, methodLimits(c.MethodRateLimits, map[string]*RateLimit{}))}
+}
+
+// Allowed tells whether clients of c can call method.
+func (c *ClientPolicy) Allowed(method string) bool {
+	return c == nil || c.access.Allowed(method)
+}
+
+func (a *apiKeys) Get(key string) *ApiKey {
+	return a.keys.Load().(map[string]*ApiKey)[key]
+}
+
+func (a *apiKeys) runReloader(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		stat, err := os.Stat(a.conf.File)
+		if err != nil {
+			log.WithError(err).Warn("error while checking API keys file")
+			continue
+		}
+		if stat.ModTime().Equal(a.modTime) {
+			continue
+		}
+		if err := a.load(); err != nil {
+			log.WithError(err).Errorf("error while reloading API keys from %s, keep the old keys", a.conf.File)
+			continue
+		}
+		log.Infof("reloaded API keys from %s", a.conf.File)
+	}
+}
+
+// pathKey returns the key in path after the path prefix, and the path of the route it's sent to,
+// which is rpcPath for `<prefix><key>` or `/<route>` for `<prefix><key>/<route>`. The key is empty
+// if path has none.
+func (a *apiKeys) pathKey(path []byte, rpcPath string) (key, route string) {
+	if !bytes.HasPrefix(path, []byte(a.conf.PathPrefix)) {
+		return "", ""
+	}
+	k := path[len(a.conf.PathPrefix):]
+	i := bytes.IndexByte(k, '/')
+	switch {
+	case i < 0 && len(k) > 0:
+		return string(k), rpcPath
+	case i > 0 && i < len(k)-1:
+		return string(k[:i]), string(k[i:])
+	}
+	return "", ""
+}
+
+// keyOf returns the key of the request, and the request URI without it.
+func (a *apiKeys) keyOf(ctx *fasthttp.RequestCtx, rpcPath string) (key string, uri []byte) {
+	u := ctx.URI()
+	if k, route := a.pathKey(u.Path(), rpcPath); k != "" {
+		key = k
+		u.SetPath(route)
+	}
+	if k := u.QueryArgs().Peek(a.conf.Query); len(k) > 0 {
+		if key == "" {
+			key = string(k)
+		}
+		u.QueryArgs().Del(a.conf.Query)
+		// the query string is kept as it is if no args are left
+		u.SetQueryStringBytes(u.QueryArgs().QueryString())
+	}
+	if k := ctx.Request.Header.Peek(a.conf.Header); key == "" && len(k) > 0 {
+		key = string(k)
+	}
+	return key, u.RequestURI()
+}
+
+// authClient is the authenticated client of a request.
+type authClient struct {
+	// id keys the client for rate limits, quotas and abuse detection, it must not be a secret
+	id     string
+	label  string
+	policy *ClientPolicy
+	// access further restricts the methods of policy
+	access *methodAccess
+}
+
+// Allowed tells whether the client can call method, anonymous clients can call any method.
+func (c *authClient) Allowed(method string) bool {
+	return c == nil || (c.policy.Allowed(method) && c.access.Allowed(method))
+}
+
+func (c *authClient) limits() *clientLimits {
+	if c == nil || c.policy == nil {
+		return nil
+	}
+	return c.policy.limits
+}
+
+// getCtxClient returns the authenticated client of the request, nil if it's anonymous.
+func getCtxClient(ctx *fasthttp.RequestCtx) *authClient {
+	if c, ok := ctx.UserValue("client").(*authClient); ok {
+		return c
+	}
+	return nil
+}
+
+// bearerToken returns the bearer token of the Authorization header, empty if there is none.
+func bearerToken(ctx *fasthttp.RequestCtx) string {
+	auth := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)
+	if len(auth) > 7 && strings.EqualFold(string(auth[:7]), "bearer ") {
+		return strings.TrimSpace(string(auth[7:]))
+	}
+	return ""
+}
+
+// authHandler authenticates RPC requests by bearer tokens or by API keys, the credentials are
+// removed from the request URI and headers so that they're neither logged nor sent to upstreams.
+func (p *Proxy) authHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if p.apiKeys == nil || !ctx.IsPost() {
+			h(ctx)
+			return
+		}
+		path := ctx.Path()
+		if p.routeOf(ctx) == nil && !bytes.HasPrefix(path, []byte(p.config.Auth.PathPrefix)) {
+			h(ctx)
+			return
+		}
+		key, uri := p.apiKeys.keyOf(ctx, p.config.Path)
+		ctx.Request.SetRequestURIBytes(uri)
+		ctx.Request.Header.Del(p.config.Auth.Header)
+		var e *jsonrpc.RpcError
+		var client *authClient
+		token := bearerToken(ctx)
+		if token != "" && p.tokens != nil {
+			ctx.Request.Header.Del(fasthttp.HeaderAuthorization)
+		}
+		switch {
+		case token != "" && p.tokens != nil:
+			var err error
+			if client, err = p.tokens.Authenticate(token); err != nil {
+				e = jsonrpc.ErrWithData(jsonrpc.ErrRpcUnauthorized, "invalid token: "+err.Error())
+				AuthRejected.WithLabelValues("token").Inc()
+				ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			}
+		case key != "":
+			if apiKey := p.apiKeys.Get(key); apiKey != nil {
+				client = &authClient{id: apiKeyID(apiKey.Key), label: apiKey.Label, policy: &apiKey.ClientPolicy}
+			} else {
+				e = jsonrpc.ErrWithData(jsonrpc.ErrRpcUnauthorized, "unknown API key")
+				AuthRejected.WithLabelValues("unknown").Inc()
+			}
+		case p.config.Auth.Required:
+			msg := "API key is required"
+			if p.tokens != nil {
+				msg = "API key or bearer token is required"
+			}
+			e = jsonrpc.ErrWithData(jsonrpc.ErrRpcUnauthorized, msg)
+			AuthRejected.WithLabelValues("missing").Inc()
+		}
+		if e != nil {
+			methods, id := peekRpcRequests(ctx.Request.Body())
+			ctx.SetUserValue("isRpcReq", true)
+			setCtxRpcMethods(ctx, methods)
+			writeRpcErrResp(ctx, e, id)
+			return
+		}
+		if client != nil {
+			ctx.SetUserValue("client", client)
+		}
+		h(ctx)
+		if client != nil {
+			for _, m := range getCtxRpcMethods(ctx) {
+				ApiKeyRequests.WithLabelValues(client.label, m).Inc()
+			}
+		}
+	}
+}
+
+// groupOf returns the upstream group serving the request, empty for the default upstreams.
+func (p *Proxy) groupOf(ctx *fasthttp.RequestCtx) string {
+	if c := getCtxClient(ctx); c != nil && c.policy != nil && p.groups[c.policy.UpstreamGroup] != nil {
+		return c.policy.UpstreamGroup
+	}
+	return ""
+}
+
+// upstreams returns the upstreams of group, the default ones if group is empty.
+func (p *Proxy) upstreams(group string) *UpstreamManager {
+	if um := p.groups[group]; um != nil {
+		return um
+	}
+	return p.um
+}
+
+// upstreamOf returns the upstreams serving the request.
+func (p *Proxy) upstreamOf(ctx *fasthttp.RequestCtx) *UpstreamManager {
+	return p.upstreams(p.groupOf(ctx))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestApiKeyOf(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &AuthConfig{}
+	conf.SetDefaults()
+	a := &apiKeys{conf: conf}
+	for _, c := range []struct{ uri, header, key, rest string }{
+		{"/v1/k1", "", "k1", "/"},
+		{"/v1/k1?apikey=k2&a=b", "", "k1", "/?a=b"},
+		{"/?apikey=k2", "k3", "k2", "/"},
+		{"/v1/k1/archive", "k3", "k1", "/archive"},
+		{"/v1/k1/", "k3", "k3", "/v1/k1/"},
+		{"/manage/status?a=b", "k3", "k3", "/manage/status?a=b"},
+		{"/", "", "", "/"},
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(c.uri)
+		if c.header != "" {
+			ctx.Request.Header.Set(DefaultApiKeyHeader, c.header)
+		}
+		key, rest := a.keyOf(ctx, "/")
+		assert.Equal(c.key, key, c.uri)
+		assert.Equal(c.rest, string(rest), c.uri)
+	}
+	assert.Equal("abcd****", redactKey("abcdefgh"))
+	assert.Equal("****", redactKey("abc"))
+}
+
+func TestAuthHandler(t *testing.T) {
+	assert := assertion.New(t)
+	var calls, groupCalls int64
+	group := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt64(&groupCalls, 1)
+		ctx.SetBodyString(`{"jsonrpc":"2.0","id":1,"result":["group"]}`)
+	})
+	config := &Config{
+		Listen:         "127.0.0.1:8080",
+		Upstreams:      []string{newNegativeUpstream(t, &calls)},
+		Cache:          &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs:   []*CacheConfig{{Methods: []string{"GetBalance"}, For: Duration{Duration: time.Minute}}},
+		UpstreamGroups: []*UpstreamGroupConfig{{Name: "archive", Upstreams: []string{group}}},
+		Routes:         []*RouteConfig{{Path: "/private", MethodAccess: &MethodAccess{Deny: []string{"GetBalance"}}}},
+		Auth: &AuthConfig{Required: true, Keys: []*ApiKey{
+			{Key: "k1", ClientPolicy: ClientPolicy{Label: "dapp", Methods: []string{"GetBalance"}, RateLimit: &RateLimit{Rate: 1, Burst: 2}}},
+			{Key: "k2", ClientPolicy: ClientPolicy{UpstreamGroup: "archive"}},
+		}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+	h := p.authHandler(p.rateLimitHandler(p.requestHandler))
+	do := func(uri, body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.SetBodyString(body)
+		h(ctx)
+		return ctx
+	}
+	req := `{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}`
+
+	ctx := do("/", req)
+	assert.Equal(fasthttp.StatusUnauthorized, ctx.Response.StatusCode())
+	assert.Equal(`{"id":1,"jsonrpc":"2.0","error":{"code":-32001,"message":"Unauthorized","data":"API key is required"}}`, string(ctx.Response.Body()))
+	ctx = do("/v1/none", req)
+	assert.Equal(fasthttp.StatusUnauthorized, ctx.Response.StatusCode())
+	assert.Equal("/", string(ctx.RequestURI()))
+	assert.EqualValues(0, atomic.LoadInt64(&calls))
+
+	// allowed methods
+	ctx = do("/v1/k1", `[{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]},{"jsonrpc":"2.0","id":2,"method":"Echo","params":[]}]`)
+	assert.Equal(200, ctx.Response.StatusCode())
+	var resps []jsonrpc.RpcResponse
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &resps))
+	if assert.Len(resps, 2) {
+		assert.Equal([]interface{}{"GetBalance"}, resps[0].Result)
+		assert.EqualValues(jsonrpc.ErrRpcMethodNotFound.Code, resps[1].Error.Code)
+	}
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+	assert.Equal("dapp", getCtxClient(ctx).label)
+	// the key is not revealed by the id
+	assert.Regexp("^key:[0-9a-f]{16}$", getCtxClient(ctx).id)
+	assert.Equal(apiKeyID("k1"), getCtxClient(ctx).id)
+	// rate limits of the key
+	ctx = do("/?apikey=k1", req)
+	assert.Equal(fasthttp.StatusTooManyRequests, ctx.Response.StatusCode())
+
+	// upstream group, results are cached apart from the default upstreams
+	ctx = do("/v1/k2", req)
+	assert.Equal(`{"jsonrpc":"2.0","id":1,"result":["group"]}`, string(ctx.Response.Body()))
+	ctx = do("/v1/k2", req)
+	assert.Equal(`{"jsonrpc":"2.0","id":1,"result":["group"]}`, string(ctx.Response.Body()))
+	assert.EqualValues(1, atomic.LoadInt64(&groupCalls))
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+	// keys in the path reach other routes
+	ctx = do("/v1/k2/private", req)
+	assert.Equal("/private", string(ctx.Path()))
+	assert.Contains(string(ctx.Response.Body()), `"code":-32601`)
+	assert.EqualValues(1, atomic.LoadInt64(&groupCalls))
+	keys, err := p.CacheManager.Keys("GetBalance(", 0)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{`GetBalance(["a"])`, `GetBalance(["a"])@archive`}, keys)
+}
+
+func TestAuthStripsCredentials(t *testing.T) {
+	assert := assertion.New(t)
+	var mu sync.Mutex
+	var forwarded []string
+	upstream := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		mu.Lock()
+		defer mu.Unlock()
+		forwarded = append(forwarded, string(ctx.Request.Header.Peek(DefaultApiKeyHeader))+
+			string(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization))+string(ctx.QueryArgs().Peek("apikey")))
+		ctx.SetBodyString(`{"jsonrpc":"2.0","id":1,"result":"ok"}`)
+	})
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{upstream},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		Auth: &AuthConfig{Required: true, Keys: []*ApiKey{{Key: "k1"}}, JWT: &JWTConfig{
+			Secrets: []string{"secret"},
+		}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+	h := p.authHandler(p.requestHandler)
+	token := signJWT(t, JWTAlgHS256, "", []byte("secret"), `{"sub":"alice","exp":4102444800}`)
+	for i, header := range [][]string{
+		{DefaultApiKeyHeader, "k1"},
+		{fasthttp.HeaderAuthorization, "Bearer " + token},
+		{DefaultApiKeyHeader, "k1", fasthttp.HeaderAuthorization, "Bearer " + token},
+		{},
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/?apikey=k1")
+		for j := 0; j+1 < len(header); j += 2 {
+			ctx.Request.Header.Set(header[j], header[j+1])
+		}
+		ctx.Request.SetBodyString(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["%d"]}`, i))
+		h(ctx)
+		assert.Equal(200, ctx.Response.StatusCode(), i)
+	}
+	assert.Equal([]string{"", "", "", ""}, forwarded)
+}
+
+func TestApiKeysReload(t *testing.T) {
+	assert := assertion.New(t)
+	file := filepath.Join(t.TempDir(), "keys.yaml")
+	assert.NoError(ioutil.WriteFile(file, []byte("- key: k1\n"), 0644))
+	conf := &AuthConfig{Keys: []*ApiKey{{Key: "k0"}}, File: file, Reload: Duration{Duration: 10 * time.Millisecond}}
+	conf.SetDefaults()
+	rate := &RateLimitConfig{}
+	rate.SetDefaults()
+	a, err := newApiKeys(conf, nil, rate)
+	assert.NoError(err)
+	assert.NotNil(a.Get("k0"))
+	assert.Equal("****", a.Get("k1").Label)
+	assert.Nil(a.Get("k2"))
+
+	reload := func(content string, at time.Time) {
+		assert.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+		assert.NoError(os.Chtimes(file, at, at))
+		time.Sleep(50 * time.Millisecond)
+	}
+	reload("- key: k2\n  methods: [GetBalance]\n", time.Now().Add(time.Minute))
+	assert.NotNil(a.Get("k0"))
+	assert.Nil(a.Get("k1"))
+	assert.True(a.Get("k2").Allowed("GetBalance"))
+	assert.False(a.Get("k2").Allowed("Echo"))
+	// invalid keys are not loaded
+	reload("- key: k3\n- key: k3\n", time.Now().Add(2*time.Minute))
+	assert.NotNil(a.Get("k2"))
+	assert.Nil(a.Get("k3"))
+	// secret references are resolved on every reload
+	setenv(t, "TEST_API_KEY", "k4")
+	reload("- key: ${env:TEST_API_KEY}\n", time.Now().Add(3*time.Minute))
+	assert.NotNil(a.Get("k4"))
+	assert.Equal("****", a.Get("k4").Label)
+	unset := filepath.Join(t.TempDir(), "keys.yaml")
+	assert.NoError(ioutil.WriteFile(unset, []byte("- key: k5\n- key: ${env:TEST_API_KEY_UNSET}\n"), 0644))
+	_, err = newApiKeys(&AuthConfig{File: unset}, nil, rate)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "file[1].key")
+	}
+
+	_, err = newApiKeys(&AuthConfig{File: filepath.Join(t.TempDir(), "none.yaml")}, nil, rate)
+	assert.Error(err)
+}
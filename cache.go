@@ -5,76 +5,234 @@ import (
 	"errors"
 	"github.com/allegro/bigcache"
 	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type ProxyCache interface {
 	Set(key string, val []byte, ttl time.Duration) error
 	Get(key string) []byte
+	// GetWithTTL returns the entry and its remaining TTL
+	GetWithTTL(key string) ([]byte, time.Duration)
+	// Peek is GetWithTTL without side effects, such as promoting the entry or counting a hit
+	Peek(key string) ([]byte, time.Duration)
+	Delete(key string) error
+	// Keys returns at most limit keys having prefix, limit <= 0 means no limit
+	Keys(prefix string, limit int) ([]string, error)
 	Clear() error
 }
 
+// BigCacheTTL is a ProxyCache on top of bigcache, the value of an entry is stored as
+// [8 bytes expire time][2 bytes key length][key][value]. The key is kept in the value
+// since the keys returned by the iterator of bigcache are not safe to use.
 type BigCacheTTL struct {
+	// bytes of entries in the queues of bigcache, counters are accessed atomically
+	// so keep them 64-bit aligned
+	bytes     int64
+	evictions int64
+	expired   int64
+	// hits and misses of peeks, which are counted by bigcache
+	peekHits   int64
+	peekMisses int64
 	*bigcache.BigCache
+	methods methodBytes
 }
 
+const (
+	bigCacheTTLHeaderSize = 8 + 2
+	// size of the headers of an entry in bigcache
+	bigCacheHeaderSize = 18
+	// life window of tiers with unlimited maxTTL, bigcache evicts the oldest entry on each set
+	// once it's older than the life window, so 0 would keep only the entries of the last second
+	unlimitedLifeWindow = 100 * 365 * 24 * time.Hour
+)
+
 func NewBigCacheTTL(maxTTL, cleanWindow time.Duration, maxSizeMb int) *BigCacheTTL {
-	c, err := bigcache.NewBigCache(bigcache.Config{
-		Shards:             calcShards(maxSizeMb),
-		LifeWindow:         maxTTL,
+	return NewBigCacheTTLWithShards(maxTTL, cleanWindow, maxSizeMb, calcShards(maxSizeMb, 0))
+}
+
+func NewBigCacheTTLWithShards(maxTTL, cleanWindow time.Duration, maxSizeMb, shards int) *BigCacheTTL {
+	const initialEntrySize = 500
+	// bigcache allocates MaxEntriesInWindow*MaxEntrySize bytes up front, which must not exceed the size of tier
+	entries := 1000 * 10 * 60
+	if maxSizeMb > 0 && maxSizeMb*1024*1024/initialEntrySize < entries {
+		entries = maxSizeMb * 1024 * 1024 / initialEntrySize
+	}
+	lifeWindow := maxTTL
+	if lifeWindow <= 0 {
+		lifeWindow = unlimitedLifeWindow
+	}
+	c := &BigCacheTTL{}
+	bc, err := bigcache.NewBigCache(bigcache.Config{
+		Shards:             shards,
+		LifeWindow:         lifeWindow,
 		CleanWindow:        cleanWindow,
-		MaxEntriesInWindow: 1000 * 10 * 60,
-		MaxEntrySize:       500,
+		MaxEntriesInWindow: entries,
+		// only used to calculate the initial size of shards, the real limit is cache.maxEntrySize
+		MaxEntrySize:       initialEntrySize,
 		Verbose:            true,
 		Hasher:             fnv64a{},
 		HardMaxCacheSize:   maxSizeMb,
 		Logger:             log.StandardLogger(),
+		OnRemoveWithReason: c.onRemove,
 	})
 	if err != nil {
 		panic(err)
 	}
-	return &BigCacheTTL{c}
+	c.BigCache = bc
+	return c
+}
+
+// onRemove is called when an entry is popped from the queue, or deleted. The key is read from
+// the value since the one given by bigcache is not safe to keep.
+func (c *BigCacheTTL) onRemove(_ string, v []byte, reason bigcache.RemoveReason) {
+	// deleted entries stay in the queue until they are popped
+	if reason == bigcache.Deleted || len(v) < bigCacheTTLHeaderSize {
+		return
+	}
+	n := int(binary.LittleEndian.Uint16(v[8:]))
+	if len(v) < bigCacheTTLHeaderSize+n {
+		return
+	}
+	size := int64(bigCacheHeaderSize + n + len(v))
+	atomic.AddInt64(&c.bytes, -size)
+	c.methods.add(string(v[bigCacheTTLHeaderSize:bigCacheTTLHeaderSize+n]), -size)
+	if reason == bigcache.NoSpace {
+		atomic.AddInt64(&c.evictions, 1)
+	}
 }
 
 func (c *BigCacheTTL) Set(key string, val []byte, ttl time.Duration) error {
-	v := make([]byte, 8+len(val))
-	binary.LittleEndian.PutUint64(v[:], uint64(time.Now().Add(ttl).UnixNano()))
-	copy(v[8:], val)
-	return c.BigCache.Set(key, v)
+	v := make([]byte, bigCacheTTLHeaderSize+len(key)+len(val))
+	binary.LittleEndian.PutUint64(v, uint64(time.Now().Add(ttl).UnixNano()))
+	binary.LittleEndian.PutUint16(v[8:], uint16(len(key)))
+	copy(v[bigCacheTTLHeaderSize:], key)
+	copy(v[bigCacheTTLHeaderSize+len(key):], val)
+	if err := c.BigCache.Set(key, v); err != nil {
+		return err
+	}
+	size := int64(bigCacheHeaderSize + len(key) + len(v))
+	atomic.AddInt64(&c.bytes, size)
+	c.methods.add(key, size)
+	return nil
 }
 
 func (c *BigCacheTTL) Get(key string) []byte {
+	val, _ := c.GetWithTTL(key)
+	return val
+}
+
+func (c *BigCacheTTL) GetWithTTL(key string) ([]byte, time.Duration) {
 	val, err := c.BigCache.Get(key)
 	if err != nil {
 		if !errors.Is(err, bigcache.ErrEntryNotFound) {
 			log.WithError(err).WithField("key", key).Debug("error while getting cache")
 		}
-		return nil
+		return nil, 0
 	}
-	if len(val) < 8 {
-		return nil
+	if len(val) < bigCacheTTLHeaderSize+len(key) {
+		return nil, 0
 	}
-	evict := time.Unix(0, int64(binary.LittleEndian.Uint64(val)))
-	if !time.Now().Before(evict) {
+	ttl := time.Until(time.Unix(0, int64(binary.LittleEndian.Uint64(val))))
+	if ttl <= 0 {
+		atomic.AddInt64(&c.expired, 1)
 		err := c.BigCache.Delete(key)
 		if err != nil {
 			log.WithError(err).WithField("key", key).Debug("delete cache error")
 		}
+		return nil, 0
+	}
+	return val[bigCacheTTLHeaderSize+len(key):], ttl
+}
+
+// Peek returns the entry and its remaining TTL, expired entries are left to the cleaner.
+func (c *BigCacheTTL) Peek(key string) ([]byte, time.Duration) {
+	val, err := c.BigCache.Get(key)
+	if err != nil {
+		atomic.AddInt64(&c.peekMisses, 1)
+		return nil, 0
+	}
+	atomic.AddInt64(&c.peekHits, 1)
+	if len(val) < bigCacheTTLHeaderSize+len(key) {
+		return nil, 0
+	}
+	ttl := time.Until(time.Unix(0, int64(binary.LittleEndian.Uint64(val))))
+	if ttl <= 0 {
+		return nil, 0
+	}
+	return val[bigCacheTTLHeaderSize+len(key):], ttl
+}
+
+func (c *BigCacheTTL) Delete(key string) error {
+	err := c.BigCache.Delete(key)
+	if errors.Is(err, bigcache.ErrEntryNotFound) {
 		return nil
 	}
-	return val[8:]
+	return err
+}
+
+func (c *BigCacheTTL) Keys(prefix string, limit int) ([]string, error) {
+	var keys []string
+	now := uint64(time.Now().UnixNano())
+	it := c.BigCache.Iterator()
+	for it.SetNext() && (limit <= 0 || len(keys) < limit) {
+		e, err := it.Value()
+		if err != nil {
+			// the entry is evicted while iterating
+			continue
+		}
+		v := e.Value()
+		if len(v) < bigCacheTTLHeaderSize || binary.LittleEndian.Uint64(v) <= now {
+			continue
+		}
+		n := int(binary.LittleEndian.Uint16(v[8:]))
+		if len(v) < bigCacheTTLHeaderSize+n {
+			continue
+		}
+		if key := string(v[bigCacheTTLHeaderSize : bigCacheTTLHeaderSize+n]); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
 }
 
 func (c *BigCacheTTL) Clear() error {
-	return c.BigCache.Reset()
+	err := c.BigCache.Reset()
+	atomic.StoreInt64(&c.bytes, 0)
+	c.methods.reset()
+	return err
 }
 
-func (c *BigCacheTTL) Iterator() {}
+// CacheStats returns stats of the cache, entries found expired are counted as misses.
+func (c *BigCacheTTL) CacheStats() CacheStats {
+	s := c.BigCache.Stats()
+	expired := atomic.LoadInt64(&c.expired)
+	return CacheStats{
+		Entries:    int64(c.BigCache.Len()),
+		Bytes:      atomic.LoadInt64(&c.bytes),
+		Hits:       s.Hits - expired - atomic.LoadInt64(&c.peekHits),
+		Misses:     s.Misses + expired - atomic.LoadInt64(&c.peekMisses),
+		Collisions: s.Collisions,
+		Evictions:  atomic.LoadInt64(&c.evictions),
+		Expired:    expired,
+		Methods:    c.methods.snapshot(),
+	}
+}
 
-func calcShards(maxMb int) int {
+// calcShards returns the power of two number of shards for a cache of maxMb,
+// every shard is large enough for an entry of maxEntrySize.
+func calcShards(maxMb, maxEntrySize int) int {
 	n := maxMb * 1024 / 256
 	if n > 1024 {
-		return 1024
+		n = 1024
+	}
+	shards := 1
+	for shards*2 <= n {
+		shards *= 2
+	}
+	for shards > 1 && maxMb*1024*1024/shards < maxEntrySize+bigCacheEntryOverhead {
+		shards /= 2
 	}
-	return n
+	return shards
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	jsoniter "github.com/json-iterator/go"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reasons of results not admitted to cache
+const (
+	notAdmittedEmpty     = "empty"
+	notAdmittedSize      = "size"
+	notAdmittedCondition = "condition"
+)
+
+// CacheCondition matches a result having the value at Path equal to Equals, or not null if Equals
+// is not given. A matched result is not cached if Skip, or cached for For if given.
+type CacheCondition struct {
+	// Path is separated by dots, array elements are selected by index, e.g. `receipt.success`, `0.hash`
+	Path   string      `json:"path"`
+	Equals interface{} `json:"equals,omitempty"`
+	Skip   bool        `json:"skip,omitempty"`
+	For    Duration    `json:"for,omitempty"`
+}
+
+// jsonPath splits path into keys accepted by jsoniter.Get.
+func jsonPath(path string) []interface{} {
+	var keys []interface{}
+	for _, k := range strings.Split(path, ".") {
+		if i, err := strconv.Atoi(k); err == nil {
+			keys = append(keys, i)
+		} else {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (c *CacheCondition) Match(result []byte) bool {
+	v := jsoniter.Get(result, jsonPath(c.Path)...)
+	if v.LastError() != nil || v.ValueType() == jsoniter.InvalidValue {
+		return false
+	}
+	if c.Equals == nil {
+		return v.ValueType() != jsoniter.NilValue
+	}
+	return reflect.DeepEqual(v.GetInterface(), c.Equals)
+}
+
+// isEmptyResult tells whether result is null, or an empty string, array or object.
+func isEmptyResult(result []byte) bool {
+	switch string(bytes.Join(bytes.Fields(result), nil)) {
+	case "", "null", `""`, "[]", "{}":
+		return true
+	}
+	return false
+}
+
+// Admit tells whether result should be cached and for how long, ttl is the TTL if no condition
+// matches. reason is given if it's not admitted.
+func (cc *CacheConfig) Admit(result []byte, ttl time.Duration) (_ time.Duration, reason string) {
+	if cc.SkipEmpty && isEmptyResult(result) {
+		return 0, notAdmittedEmpty
+	}
+	if cc.MaxResultSize > 0 && len(result) > cc.MaxResultSize {
+		return 0, notAdmittedSize
+	}
+	for _, c := range cc.Conditions {
+		if !c.Match(result) {
+			continue
+		}
+		if c.Skip {
+			return 0, notAdmittedCondition
+		}
+		if c.For.Duration > 0 {
+			return c.For.Duration, ""
+		}
+		break
+	}
+	return ttl, ""
+}
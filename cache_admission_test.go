@@ -0,0 +1,72 @@
+package main
+
+import (
+	assertion "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCacheConfigAdmit(t *testing.T) {
+	assert := assertion.New(t)
+	conf, err := parseConfig([]byte(`
+listen: 0.0.0.0:8080
+upstreams: [http://localhost:4201]
+cacheConfigs:
+- methods: [GetTransaction]
+  for: 5s
+  skipEmpty: true
+  maxResultSize: 100
+  conditions:
+  - path: receipt.success
+    equals: true
+    for: 1h
+  - path: receipt.epoch_num
+    equals: 0
+    skip: true
+  - path: pending
+    skip: true
+`))
+	assert.NoError(err)
+	assert.Empty(conf.Check())
+	cc := conf.Search("GetTransaction")
+
+	cases := []struct {
+		result string
+		ttl    time.Duration
+		reason string
+	}{
+		{`null`, 0, notAdmittedEmpty},
+		{` [ ] `, 0, notAdmittedEmpty},
+		{`""`, 0, notAdmittedEmpty},
+		{`{"data":"` + string(make([]byte, 100)) + `"}`, 0, notAdmittedSize},
+		{`{"receipt":{"success":true}}`, time.Hour, ""},
+		{`{"receipt":{"success":false}}`, 5 * time.Second, ""},
+		{`{"receipt":{"success":false,"epoch_num":0}}`, 0, notAdmittedCondition},
+		{`{"receipt":{"epoch_num":1}}`, 5 * time.Second, ""},
+		{`{"pending":{}}`, 0, notAdmittedCondition},
+		{`{"pending":null}`, 5 * time.Second, ""},
+		{`[1]`, 5 * time.Second, ""},
+	}
+	for _, c := range cases {
+		ttl, reason := cc.Admit([]byte(c.result), cc.For.Duration)
+		assert.Equal(c.reason, reason, c.result)
+		assert.Equal(c.ttl, ttl, c.result)
+	}
+
+	cc.Conditions[0].Path = ""
+	cc.Conditions[1].For.Duration = time.Second
+	var paths []string
+	for _, e := range conf.Check() {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal([]string{"cacheConfigs[0].conditions[0].path", "cacheConfigs[0].conditions[1].for"}, paths)
+}
+
+func TestJsonPath(t *testing.T) {
+	assert := assertion.New(t)
+	assert.Equal([]interface{}{"a", 0, "b"}, jsonPath("a.0.b"))
+	c := &CacheCondition{Path: "0.hash", Equals: "0x1"}
+	assert.True(c.Match([]byte(`[{"hash":"0x1"}]`)))
+	assert.False(c.Match([]byte(`[{"hash":"0x2"}]`)))
+	assert.False(c.Match([]byte(`{"hash":"0x1"}`)))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"github.com/valyala/fasthttp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cache status of a request in X-Cache
+const (
+	// CacheStatusHit is answered locally
+	CacheStatusHit = "HIT"
+	// CacheStatusMiss is not cached, or not cacheable
+	CacheStatusMiss = "MISS"
+	// CacheStatusStale is cached but fetched again as it's older than max-age of the client, or
+	// recomputed before expiry
+	CacheStatusStale = "STALE"
+	// CacheStatusBypass is fetched as the client asked by no-cache
+	CacheStatusBypass = "BYPASS"
+	// cacheStatusNone is of invalid requests in a batch, only listed in X-Cache-Items
+	cacheStatusNone = "-"
+)
+
+const (
+	HeaderXCache      = "X-Cache"
+	HeaderXCacheItems = "X-Cache-Items"
+)
+
+// clientCacheControl is the Cache-Control of a client request.
+type clientCacheControl struct {
+	noCache bool
+	// maxAge is the max age of cached results accepted by the client, negative if not given
+	maxAge time.Duration
+}
+
+func parseCacheControl(h []byte) clientCacheControl {
+	cc := clientCacheControl{maxAge: -1}
+	for _, d := range bytes.Split(h, []byte{','}) {
+		d = bytes.ToLower(bytes.TrimSpace(d))
+		switch {
+		case bytes.Equal(d, []byte("no-cache")):
+			cc.noCache = true
+		case bytes.HasPrefix(d, []byte("max-age=")):
+			if s, err := strconv.ParseUint(string(bytes.Trim(d[8:], `"`)), 10, 32); err == nil {
+				cc.maxAge = time.Duration(s) * time.Second
+			}
+		}
+	}
+	return cc
+}
+
+// cacheControl returns the Cache-Control of the client request, it's ignored if ignoreCacheControl.
+func (p *Proxy) cacheControl(ctx *fasthttp.RequestCtx) clientCacheControl {
+	if p.config.IgnoreCacheControl {
+		return clientCacheControl{maxAge: -1}
+	}
+	return parseCacheControl(ctx.Request.Header.Peek(fasthttp.HeaderCacheControl))
+}
+
+// fresh tells whether item is young enough for the client at now, items of unknown age are not.
+func (c clientCacheControl) fresh(item *CachedItem, now time.Time) bool {
+	if c.maxAge < 0 {
+		return true
+	}
+	age, ok := item.Age(now)
+	return ok && age <= c.maxAge
+}
+
+// Age is how long the item has been cached at now, ok is false if it's unknown.
+func (i *CachedItem) Age(now time.Time) (_ time.Duration, ok bool) {
+	if i.StoredAt <= 0 {
+		return 0, false
+	}
+	age := time.Duration(now.UnixNano()/int64(time.Millisecond)-i.StoredAt) * time.Millisecond
+	if age < 0 {
+		age = 0
+	}
+	return age, true
+}
+
+// batchCacheStatus is HIT if every request is answered locally, or the status of the requests
+// forwarded, BYPASS first, then MISS. It's empty if no request is valid.
+func batchCacheStatus(statuses []string) string {
+	status := ""
+	for _, s := range statuses {
+		switch {
+		case s == CacheStatusBypass:
+			return s
+		case s == CacheStatusMiss:
+			status = s
+		case s == CacheStatusStale && status != CacheStatusMiss:
+			status = s
+		case s == CacheStatusHit && status == "":
+			status = s
+		}
+	}
+	return status
+}
+
+// writeCacheStatus sets X-Cache and, for results from cache, Age of the oldest one. The status of
+// every request in a batch is listed in X-Cache-Items if items.
+func writeCacheStatus(r *fasthttp.Response, statuses []string, age time.Duration, batch, items bool) {
+	status := batchCacheStatus(statuses)
+	if status == "" {
+		return
+	}
+	r.Header.Set(HeaderXCache, status)
+	if status == CacheStatusHit {
+		r.Header.Set(fasthttp.HeaderAge, strconv.FormatInt(int64(age/time.Second), 10))
+	}
+	if batch && items {
+		r.Header.Set(HeaderXCacheItems, strings.Join(statuses, ","))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	assertion "github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	assert := assertion.New(t)
+	assert.Equal(clientCacheControl{maxAge: -1}, parseCacheControl(nil))
+	assert.Equal(clientCacheControl{noCache: true, maxAge: -1}, parseCacheControl([]byte("No-Cache")))
+	assert.Equal(clientCacheControl{maxAge: 10 * time.Second}, parseCacheControl([]byte("public, max-age=10")))
+	assert.Equal(clientCacheControl{noCache: true, maxAge: 0}, parseCacheControl([]byte(`no-cache,max-age="0"`)))
+	assert.Equal(clientCacheControl{maxAge: -1}, parseCacheControl([]byte("max-age=-1")))
+}
+
+func TestProxyCacheControl(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:           "127.0.0.1:8080",
+		Upstreams:        []string{newNegativeUpstream(t, &calls)},
+		Cache:            &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs:     []*CacheConfig{{Methods: []string{"GetBalance"}, For: Duration{Duration: time.Minute}}},
+		CacheStatusItems: true,
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	p.clock = clock
+	p.initOnce.Do(p.init)
+	req := `{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}`
+
+	ctx := doProxyRequest(p, req)
+	assert.Equal(CacheStatusMiss, string(ctx.Response.Header.Peek(HeaderXCache)))
+	assert.Empty(ctx.Response.Header.Peek("Age"))
+	clock.Add(20 * time.Second)
+	ctx = doProxyRequest(p, req)
+	assert.Equal(CacheStatusHit, string(ctx.Response.Header.Peek(HeaderXCache)))
+	assert.Equal("20", string(ctx.Response.Header.Peek("Age")))
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+
+	// younger than max-age
+	ctx = doProxyRequest(p, req, "Cache-Control", "max-age=30")
+	assert.Equal(CacheStatusHit, string(ctx.Response.Header.Peek(HeaderXCache)))
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+	// older than max-age, the fresh result is cached
+	ctx = doProxyRequest(p, req, "Cache-Control", "max-age=10")
+	assert.Equal(CacheStatusStale, string(ctx.Response.Header.Peek(HeaderXCache)))
+	assert.EqualValues(2, atomic.LoadInt64(&calls))
+	ctx = doProxyRequest(p, req)
+	assert.Equal("0", string(ctx.Response.Header.Peek("Age")))
+
+	ctx = doProxyRequest(p, req, "Cache-Control", "no-cache")
+	assert.Equal(CacheStatusBypass, string(ctx.Response.Header.Peek(HeaderXCache)))
+	assert.Equal(`{"jsonrpc":"2.0","id":1,"result":["GetBalance"]}`, string(ctx.Response.Body()))
+	assert.EqualValues(3, atomic.LoadInt64(&calls))
+
+	clock.Add(5 * time.Second)
+	ctx = doProxyRequest(p, `[{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]},{"jsonrpc":"2.0","id":2,"method":"Echo","params":[]},{"jsonrpc":"2.0","id":3}]`)
+	assert.Equal(CacheStatusMiss, string(ctx.Response.Header.Peek(HeaderXCache)))
+	assert.Equal("HIT,MISS,-", string(ctx.Response.Header.Peek(HeaderXCacheItems)))
+	assert.Empty(ctx.Response.Header.Peek("Age"))
+	ctx = doProxyRequest(p, `[{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}]`)
+	assert.Equal(CacheStatusHit, string(ctx.Response.Header.Peek(HeaderXCache)))
+	assert.Equal("5", string(ctx.Response.Header.Peek("Age")))
+
+	p.config.IgnoreCacheControl = true
+	ctx = doProxyRequest(p, req, "Cache-Control", "no-cache")
+	assert.Equal(CacheStatusHit, string(ctx.Response.Header.Peek(HeaderXCache)))
+	assert.EqualValues(4, atomic.LoadInt64(&calls))
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var diskCacheBucket = []byte("entries")
+
+const (
+	diskWriteQueueSize = 4096
+	// diskWriteBatchSize is the max number of writes committed in one transaction
+	diskWriteBatchSize = 256
+)
+
+// diskWrite is a queued write, or a flush if done is set.
+type diskWrite struct {
+	key  []byte
+	val  []byte
+	done chan struct{}
+}
+
+// DiskCache is a ProxyCache persisted in a bbolt file, so that long lived entries survive restarts.
+// Writes are queued and committed in batches off the request path. Expired entries are removed on
+// read and by the cleaner running every cleanWindow, which also evicts the entries expiring soonest
+// when the size of entries exceeds the limit, and compacts the file when most of it is free.
+type DiskCache struct {
+	// mu guards db from being swapped by compaction
+	mu      sync.RWMutex
+	db      *bbolt.DB
+	open    func(path string) (*bbolt.DB, error)
+	path    string
+	maxSize int64
+	writes  chan diskWrite
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func NewDiskCache(path string, maxSizeMb int, cleanWindow time.Duration) (*DiskCache, error) {
+	db, err := openDiskCacheDB(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		db:      db,
+		open:    openDiskCacheDB,
+		path:    path,
+		maxSize: int64(maxSizeMb) * 1024 * 1024,
+		writes:  make(chan diskWrite, diskWriteQueueSize),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.runWriter()
+	if cleanWindow > 0 {
+		go c.runCleaner(cleanWindow)
+	}
+	return c, nil
+}
+
+func openDiskCacheDB(path string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(diskCacheBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Set queues the entry to be written in the next batch, entries are dropped when the queue is full.
+func (c *DiskCache) Set(key string, val []byte, ttl time.Duration) error {
+	v := make([]byte, 8+len(val))
+	binary.LittleEndian.PutUint64(v, uint64(time.Now().Add(ttl).UnixNano()))
+	copy(v[8:], val)
+	select {
+	case c.writes <- diskWrite{key: []byte(key), val: v}:
+	default:
+		log.WithField("key", key).Debug("disk cache write queue is full, drop entry")
+	}
+	return nil
+}
+
+// flush waits for the writes queued before it to be committed.
+func (c *DiskCache) flush() {
+	done := make(chan struct{})
+	select {
+	case c.writes <- diskWrite{done: done}:
+	case <-c.stopped:
+		return
+	}
+	select {
+	case <-done:
+	case <-c.stopped:
+	}
+}
+
+// runWriter commits queued writes, the writes queued at the moment are committed in one
+// transaction.
+func (c *DiskCache) runWriter() {
+	defer close(c.stopped)
+	batch := make([]diskWrite, 0, diskWriteBatchSize)
+	for {
+		select {
+		case <-c.stop:
+			batch = batch[:0]
+			for {
+				select {
+				case w := <-c.writes:
+					batch = append(batch, w)
+				default:
+					c.write(batch)
+					return
+				}
+			}
+		case w := <-c.writes:
+			batch = append(batch[:0], w)
+		collect:
+			for len(batch) < diskWriteBatchSize {
+				select {
+				case w := <-c.writes:
+					batch = append(batch, w)
+				default:
+					break collect
+				}
+			}
+			c.write(batch)
+		}
+	}
+}
+
+func (c *DiskCache) write(batch []diskWrite) {
+	c.mu.RLock()
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(diskCacheBucket)
+		for _, w := range batch {
+			if w.done != nil {
+				continue
+			}
+			if err := b.Put(w.key, w.val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	c.mu.RUnlock()
+	if err != nil {
+		log.WithError(err).Warnf("error while writing %d entries to disk cache", len(batch))
+	}
+	for _, w := range batch {
+		if w.done != nil {
+			close(w.done)
+		}
+	}
+}
+
+func (c *DiskCache) Get(key string) []byte {
+	val, _ := c.GetWithTTL(key)
+	return val
+}
+
+// GetWithTTL returns the entry and its remaining TTL.
+func (c *DiskCache) GetWithTTL(key string) (val []byte, ttl time.Duration) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(diskCacheBucket).Get([]byte(key))
+		if len(v) < 8 {
+			return nil
+		}
+		ttl = time.Until(time.Unix(0, int64(binary.LittleEndian.Uint64(v))))
+		if ttl <= 0 {
+			return nil
+		}
+		// v is only valid in the transaction
+		val = make([]byte, len(v)-8)
+		copy(val, v[8:])
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("key", key).Debug("error while getting disk cache")
+	}
+	return
+}
+
+// Peek is GetWithTTL, reads have no side effects.
+func (c *DiskCache) Peek(key string) ([]byte, time.Duration) {
+	return c.GetWithTTL(key)
+}
+
+func (c *DiskCache) Delete(key string) error {
+	// queued writes must not bring the entry back
+	c.flush()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(diskCacheBucket).Delete([]byte(key))
+	})
+}
+
+func (c *DiskCache) Keys(prefix string, limit int) ([]string, error) {
+	var keys []string
+	now := uint64(time.Now().UnixNano())
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		cur := tx.Bucket(diskCacheBucket).Cursor()
+		p := []byte(prefix)
+		for k, v := cur.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = cur.Next() {
+			if limit > 0 && len(keys) >= limit {
+				break
+			}
+			if len(v) >= 8 && binary.LittleEndian.Uint64(v) > now {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (c *DiskCache) Clear() error {
+	c.flush()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(diskCacheBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(diskCacheBucket)
+		return err
+	})
+}
+
+// Close commits queued writes and closes the file.
+func (c *DiskCache) Close() error {
+	close(c.stop)
+	<-c.stopped
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db.Close()
+}
+
+func (c *DiskCache) runCleaner(cleanWindow time.Duration) {
+	ticker := time.NewTicker(cleanWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.clean(); err != nil {
+				log.WithError(err).Error("error while cleaning disk cache")
+			}
+		}
+	}
+}
+
+type diskCacheEntry struct {
+	key    []byte
+	expire int64
+	size   int64
+}
+
+// clean removes expired entries, evicts the entries expiring soonest until the size of entries
+// is under limit, then compacts the file if less than half of it is used.
+func (c *DiskCache) clean() error {
+	var fileSize, used int64
+	c.mu.RLock()
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(diskCacheBucket)
+		now := time.Now().UnixNano()
+		var entries []diskCacheEntry
+		err := b.ForEach(func(k, v []byte) error {
+			e := diskCacheEntry{key: append([]byte(nil), k...), size: int64(len(k) + len(v))}
+			if len(v) >= 8 {
+				e.expire = int64(binary.LittleEndian.Uint64(v))
+			}
+			if e.expire <= now {
+				return nil
+			}
+			entries = append(entries, e)
+			used += e.size
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		live := map[string]bool{}
+		if c.maxSize > 0 && used > c.maxSize {
+			sort.Slice(entries, func(i, j int) bool { return entries[i].expire < entries[j].expire })
+			// leave some room for new entries
+			for len(entries) > 0 && used > c.maxSize*9/10 {
+				used -= entries[0].size
+				entries = entries[1:]
+			}
+		}
+		for _, e := range entries {
+			live[string(e.key)] = true
+		}
+		var dead [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			if !live[string(k)] {
+				dead = append(dead, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range dead {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		if len(dead) > 0 {
+			log.Debugf("removed %d entries from disk cache", len(dead))
+		}
+		fileSize = tx.Size()
+		return nil
+	})
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if fileSize > 2*used && fileSize > 16*1024*1024 {
+		return c.compact()
+	}
+	return nil
+}
+
+// compact copies live entries into a new file and replaces the current one with it, since bbolt
+// never shrinks its file. The current file is kept open until the new one is opened, so the cache
+// keeps serving from it if anything fails.
+func (c *DiskCache) compact() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tmp := c.path + ".compact"
+	_ = os.Remove(tmp)
+	dst, err := c.open(tmp)
+	if err != nil {
+		return err
+	}
+	err = c.db.View(func(src *bbolt.Tx) error {
+		return dst.Update(func(tx *bbolt.Tx) error {
+			b := tx.Bucket(diskCacheBucket)
+			// keys are visited in order, fill pages completely
+			b.FillPercent = 1
+			return src.Bucket(diskCacheBucket).ForEach(func(k, v []byte) error {
+				return b.Put(k, v)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	// the current file stays readable through its handle after it's replaced
+	if err := os.Rename(tmp, c.path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	db, err := c.open(c.path)
+	if err != nil {
+		log.WithError(err).Errorf("unable to open compacted disk cache %s, serving from the replaced file until the next compaction", c.path)
+		return err
+	}
+	if err := c.db.Close(); err != nil {
+		log.WithError(err).Warn("error while closing replaced disk cache")
+	}
+	c.db = db
+	log.Debugf("compacted disk cache %s", c.path)
+	return nil
+}
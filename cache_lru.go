@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/list"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lruEntryOverhead is the estimated memory used by the bookkeeping of an entry
+const lruEntryOverhead = 96
+
+var ErrEntryTooLarge = errors.New("entry is bigger than max shard size")
+
+// LRUCache is a ProxyCache with native TTL of every entry. Entries are evicted from the
+// least recently used when the total size of entries exceeds the limit, expired entries
+// are removed on read and by the cleaner running every cleanWindow.
+type LRUCache struct {
+	// counters are accessed atomically, keep them 64-bit aligned
+	hits      int64
+	misses    int64
+	evictions int64
+	expired   int64
+
+	shards  []*lruShard
+	mask    uint64
+	hasher  fnv64a
+	stop    chan struct{}
+	methods *methodBytes
+}
+
+type lruEntry struct {
+	key    string
+	val    []byte
+	expire int64
+}
+
+func (e *lruEntry) size() int {
+	return len(e.key) + len(e.val) + lruEntryOverhead
+}
+
+type lruShard struct {
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	ll      *list.List
+	size    int
+	maxSize int
+	methods *methodBytes
+}
+
+// NewLRUCache creates a LRUCache holding at most maxSizeMb of entries, shards must be a power of two.
+func NewLRUCache(maxSizeMb, shards int, cleanWindow time.Duration) *LRUCache {
+	if shards <= 0 || shards&(shards-1) != 0 {
+		panic("shards of LRUCache must be a power of two")
+	}
+	c := &LRUCache{
+		shards:  make([]*lruShard, shards),
+		mask:    uint64(shards - 1),
+		stop:    make(chan struct{}),
+		methods: &methodBytes{},
+	}
+	for i := range c.shards {
+		c.shards[i] = &lruShard{
+			items:   map[string]*list.Element{},
+			ll:      list.New(),
+			maxSize: maxSizeMb * 1024 * 1024 / shards,
+			methods: c.methods,
+		}
+	}
+	if cleanWindow > 0 {
+		go c.runCleaner(cleanWindow)
+	}
+	return c
+}
+
+func (c *LRUCache) getShard(key string) *lruShard {
+	return c.shards[c.hasher.Sum64(key)&c.mask]
+}
+
+func (c *LRUCache) Set(key string, val []byte, ttl time.Duration) error {
+	e := &lruEntry{key: key, val: make([]byte, len(val)), expire: time.Now().Add(ttl).UnixNano()}
+	copy(e.val, val)
+	s := c.getShard(key)
+	if e.size() > s.maxSize {
+		return ErrEntryTooLarge
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+	s.items[key] = s.ll.PushFront(e)
+	s.size += e.size()
+	s.methods.add(key, int64(e.size()))
+	for s.size > s.maxSize {
+		s.removeElement(s.ll.Back())
+		atomic.AddInt64(&c.evictions, 1)
+	}
+	return nil
+}
+
+func (c *LRUCache) Get(key string) []byte {
+	val, _ := c.GetWithTTL(key)
+	return val
+}
+
+func (c *LRUCache) GetWithTTL(key string) ([]byte, time.Duration) {
+	s := c.getShard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, 0
+	}
+	e := el.Value.(*lruEntry)
+	ttl := time.Duration(e.expire - time.Now().UnixNano())
+	if ttl <= 0 {
+		s.removeElement(el)
+		atomic.AddInt64(&c.misses, 1)
+		atomic.AddInt64(&c.expired, 1)
+		return nil, 0
+	}
+	atomic.AddInt64(&c.hits, 1)
+	s.ll.MoveToFront(el)
+	val := make([]byte, len(e.val))
+	copy(val, e.val)
+	return val, ttl
+}
+
+// Peek returns the entry and its remaining TTL without promoting it or counting it.
+func (c *LRUCache) Peek(key string) ([]byte, time.Duration) {
+	s := c.getShard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, 0
+	}
+	e := el.Value.(*lruEntry)
+	ttl := time.Duration(e.expire - time.Now().UnixNano())
+	if ttl <= 0 {
+		return nil, 0
+	}
+	val := make([]byte, len(e.val))
+	copy(val, e.val)
+	return val, ttl
+}
+
+func (c *LRUCache) Delete(key string) error {
+	s := c.getShard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+	return nil
+}
+
+func (c *LRUCache) Keys(prefix string, limit int) ([]string, error) {
+	var keys []string
+	now := time.Now().UnixNano()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, el := range s.items {
+			if limit > 0 && len(keys) >= limit {
+				break
+			}
+			if el.Value.(*lruEntry).expire > now && strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return keys, nil
+}
+
+func (c *LRUCache) Clear() error {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = map[string]*list.Element{}
+		s.ll.Init()
+		s.size = 0
+		s.mu.Unlock()
+	}
+	c.methods.reset()
+	return nil
+}
+
+// CacheStats returns stats of the cache, entries removed by the cleaner are counted as expired.
+func (c *LRUCache) CacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Evictions: atomic.LoadInt64(&c.evictions),
+		Expired:   atomic.LoadInt64(&c.expired),
+		Methods:   c.methods.snapshot(),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Entries += int64(len(s.items))
+		stats.Bytes += int64(s.size)
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// Close stops the cleaner.
+func (c *LRUCache) Close() error {
+	close(c.stop)
+	return nil
+}
+
+func (c *LRUCache) runCleaner(cleanWindow time.Duration) {
+	ticker := time.NewTicker(cleanWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case t := <-ticker.C:
+			for _, s := range c.shards {
+				atomic.AddInt64(&c.expired, int64(s.removeExpired(t.UnixNano())))
+			}
+		}
+	}
+}
+
+func (s *lruShard) removeElement(el *list.Element) {
+	e := s.ll.Remove(el).(*lruEntry)
+	delete(s.items, e.key)
+	s.size -= e.size()
+	s.methods.add(e.key, -int64(e.size()))
+}
+
+// removeExpired removes expired entries and returns the number of them.
+func (s *lruShard) removeExpired(now int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for el := s.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if now >= el.Value.(*lruEntry).expire {
+			s.removeElement(el)
+			n++
+		}
+		el = prev
+	}
+	return n
+}
@@ -1,57 +1,178 @@
 package main
 
 import (
+	"encoding/binary"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
 	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
 	"github.com/savsgio/gotils"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/multierr"
+	"math"
+	"sort"
 	"time"
 )
 
+type cacheTier struct {
+	name   string
+	maxTTL time.Duration
+	cache  ProxyCache
+}
+
 type CacheManager struct {
-	cache1m    ProxyCache
-	cache1h    ProxyCache
-	cacheSolid ProxyCache
+	// tiers are sorted by maxTTL, the unlimited one is the last, followed by the immutable tier if any
+	tiers        []*cacheTier
+	immutable    *cacheTier
+	maxEntrySize int
+	// shared is the cache shared by replicas, local tiers are used in front of it when twoLevel
+	// is set or it's unavailable
+	shared   *RedisCache
+	twoLevel bool
+	// persistent keeps entries with TTL of at least persistMinTTL on disk
+	persistent    *DiskCache
+	persistMinTTL time.Duration
 }
 
-func NewCacheManager() *CacheManager {
-	return &CacheManager{
-		cache1m:    NewBigCacheTTL(time.Minute, 50*time.Second, 1024),
-		cache1h:    NewBigCacheTTL(time.Hour, time.Minute, 512),
-		cacheSolid: NewBigCacheTTL(0, 0, 512),
+func NewCacheManager(conf *CacheManagerConfig) *CacheManager {
+	c := &CacheManager{maxEntrySize: conf.MaxEntrySize}
+	if conf.Redis != nil {
+		c.shared = NewRedisCache(conf.Redis)
+		c.twoLevel = conf.Redis.TwoLevel
+	}
+	if conf.Disk != nil {
+		d, err := NewDiskCache(conf.Disk.Path, conf.Disk.MaxSizeMb, conf.Disk.CleanWindow.Duration)
+		if err != nil {
+			log.WithError(err).Errorf("unable to open disk cache %s, entries won't be persisted", conf.Disk.Path)
+		} else {
+			c.persistent = d
+			c.persistMinTTL = conf.Disk.MinTTL.Duration
+		}
+	}
+	if conf.Engine == CacheEngineLRU {
+		// entries have their own TTL, one tier is enough
+		c.tiers = []*cacheTier{{
+			name:  CacheEngineLRU,
+			cache: NewLRUCache(conf.MemoryLimitMb, conf.Shards, conf.CleanWindow.Duration),
+		}}
+	} else {
+		for _, t := range conf.Tiers {
+			c.tiers = append(c.tiers, &cacheTier{
+				name:   t.Name,
+				maxTTL: t.MaxTTL.Duration,
+				cache:  NewBigCacheTTLWithShards(t.MaxTTL.Duration, t.CleanWindow.Duration, t.SizeMb, t.Shards),
+			})
+		}
+		sort.SliceStable(c.tiers, func(i, j int) bool {
+			a, b := c.tiers[i].maxTTL, c.tiers[j].maxTTL
+			return a != 0 && (b == 0 || a < b)
+		})
 	}
+	if conf.ImmutableSizeMb > 0 {
+		// entries never expire, the least recently used are evicted for space
+		c.immutable = &cacheTier{
+			name:  "immutable",
+			cache: NewLRUCache(conf.ImmutableSizeMb, calcShards(conf.ImmutableSizeMb, conf.MaxEntrySize), 0),
+		}
+		c.tiers = append(c.tiers, c.immutable)
+	}
+	return c
 }
 
 func (c *CacheManager) Set(key string, val []byte, ttl time.Duration) error {
 	if ttl <= 0 {
 		return nil
 	}
-	return c.getCacheForTTL(ttl).Set(key, val, ttl)
+	tier := c.getTierForTTL(ttl)
+	if c.maxEntrySize > 0 && len(key)+len(val) > c.maxEntrySize {
+		CacheOversized.WithLabelValues(tier.name).Inc()
+		log.WithField("key", key).WithField("size", len(key)+len(val)).Debug("entry exceeds cache.maxEntrySize, skip caching")
+		return nil
+	}
+	var err error
+	if c.persistent != nil && ttl >= c.persistMinTTL {
+		err = c.persistent.Set(key, val, ttl)
+	}
+	if c.shared != nil && c.shared.Available() {
+		err = multierr.Append(err, c.shared.Set(key, val, ttl))
+		if !c.twoLevel {
+			return err
+		}
+	}
+	return multierr.Append(err, tier.cache.Set(key, val, ttl))
 }
 
-func (c *CacheManager) getCacheForTTL(ttl time.Duration) ProxyCache {
-	switch {
-	case ttl < time.Minute:
-		return c.cache1m
-	case ttl < time.Hour:
-		return c.cache1h
-	default:
-		return c.cacheSolid
+// getTierForTTL returns the first tier whose maxTTL is longer than ttl, or the last one if there is none.
+func (c *CacheManager) getTierForTTL(ttl time.Duration) *cacheTier {
+	tiers := c.tiers
+	if c.immutable != nil {
+		if ttl >= ImmutableTTL {
+			return c.immutable
+		}
+		tiers = tiers[:len(tiers)-1]
+	}
+	for _, t := range tiers {
+		if t.maxTTL == 0 || ttl < t.maxTTL {
+			return t
+		}
 	}
+	return tiers[len(tiers)-1]
 }
 
 func (c *CacheManager) Get(key string, suggestTTL time.Duration) []byte {
-	if val := c.getCacheForTTL(suggestTTL).Get(key); val != nil {
-		return val
-	} else if val := c.cacheSolid.Get(key); val != nil {
-		return val
-	} else if val := c.cache1h.Get(key); val != nil {
-		return val
-	} else if val := c.cache1m.Get(key); val != nil {
+	val := c.getCached(key, suggestTTL)
+	if val == nil && c.persistent != nil {
+		var ttl time.Duration
+		if val, ttl = c.persistent.GetWithTTL(key); val != nil {
+			if c.shared != nil && c.shared.Available() {
+				_ = c.shared.Set(key, val, ttl)
+			}
+			c.setLocal(key, val, ttl)
+		}
+	}
+	return val
+}
+
+// getCached gets entry from local tiers and the shared cache
+func (c *CacheManager) getCached(key string, suggestTTL time.Duration) []byte {
+	if c.shared == nil || !c.shared.Available() {
+		return c.getLocal(key, suggestTTL)
+	}
+	if c.twoLevel {
+		if val := c.getLocal(key, suggestTTL); val != nil {
+			return val
+		}
+	}
+	val, ttl := c.shared.GetWithTTL(key)
+	if val != nil && c.twoLevel {
+		c.setLocal(key, val, ttl)
+	}
+	return val
+}
+
+// setLocal puts an entry found in other caches to local tiers
+func (c *CacheManager) setLocal(key string, val []byte, ttl time.Duration) {
+	if c.shared != nil && c.shared.Available() && !c.twoLevel {
+		return
+	}
+	if err := c.getTierForTTL(ttl).cache.Set(key, val, ttl); err != nil {
+		log.WithError(err).WithField("key", key).Debug("error while setting local cache")
+	}
+}
+
+func (c *CacheManager) getLocal(key string, suggestTTL time.Duration) []byte {
+	suggested := c.getTierForTTL(suggestTTL)
+	if val := suggested.cache.Get(key); val != nil {
 		return val
 	}
+	// the TTL of a method may be changed, look for the entry from longer lived tiers
+	for i := len(c.tiers) - 1; i >= 0; i-- {
+		if t := c.tiers[i]; t != suggested {
+			if val := t.cache.Get(key); val != nil {
+				return val
+			}
+		}
+	}
 	return nil
 }
 
@@ -61,7 +182,7 @@ func (c *CacheManager) GetItem(key string, suggestTTL time.Duration) *CachedItem
 		return nil
 	}
 	item := AcquireCachedItem()
-	err := jsoniter.Unmarshal(val, item)
+	err := item.Unmarshal(val)
 	if err != nil {
 		log.WithError(err).Error("failed to unmarshal cached item")
 		ReleaseCachedItem(item)
@@ -71,11 +192,158 @@ func (c *CacheManager) GetItem(key string, suggestTTL time.Duration) *CachedItem
 }
 
 func (c *CacheManager) Clear() error {
-	return multierr.Combine(
-		c.cache1m.Clear(),
-		c.cache1h.Clear(),
-		c.cacheSolid.Clear(),
-	)
+	var err error
+	for _, t := range c.tiers {
+		err = multierr.Append(err, t.cache.Clear())
+	}
+	if c.shared != nil {
+		err = multierr.Append(err, c.shared.Clear())
+	}
+	if c.persistent != nil {
+		err = multierr.Append(err, c.persistent.Clear())
+	}
+	return err
+}
+
+// CacheEntry is an entry found in one of the caches, Value is the marshaled CachedItem.
+type CacheEntry struct {
+	Tier string   `json:"tier"`
+	TTL  Duration `json:"ttl"`
+	Size int      `json:"size"`
+	// Encoding is the compression of the entry, Value is decompressed
+	Encoding string              `json:"encoding,omitempty"`
+	Value    jsoniter.RawMessage `json:"value"`
+}
+
+var ErrUnknownCacheTier = errors.New("unknown cache tier")
+
+// caches returns every cache with its tier name, the shared cache is named "redis" and the
+// persistent one "disk".
+func (c *CacheManager) caches() []*cacheTier {
+	caches := append([]*cacheTier{}, c.tiers...)
+	if c.shared != nil {
+		caches = append(caches, &cacheTier{name: "redis", cache: c.shared})
+	}
+	if c.persistent != nil {
+		caches = append(caches, &cacheTier{name: "disk", cache: c.persistent})
+	}
+	return caches
+}
+
+func (c *CacheManager) TierNames() []string {
+	var names []string
+	for _, t := range c.caches() {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+// Lookup returns the entries of key in every cache without promoting them or counting them in
+// the stats.
+func (c *CacheManager) Lookup(key string) []*CacheEntry {
+	var entries []*CacheEntry
+	for _, t := range c.caches() {
+		if val, ttl := t.cache.Peek(key); val != nil {
+			e := &CacheEntry{Tier: t.name, TTL: Duration{ttl}, Size: len(val), Value: val}
+			if val[0] == compressedItemMagic {
+				e.Value = nil
+				item := &CachedItem{}
+				if err := item.Unmarshal(val); err == nil {
+					e.Encoding = item.Encoding
+					if item.Decompress() == nil {
+						e.Value = item.Marshal()
+					}
+				}
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Keys returns the sorted keys having prefix in every cache, at most limit keys are returned.
+func (c *CacheManager) Keys(prefix string, limit int) ([]string, error) {
+	var err error
+	seen := map[string]bool{}
+	for _, t := range c.caches() {
+		keys, e := t.cache.Keys(prefix, limit)
+		err = multierr.Append(err, errors.Wrapf(e, "tier %s", t.name))
+		for _, k := range keys {
+			seen[k] = true
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, err
+}
+
+// Delete removes key from every cache.
+func (c *CacheManager) Delete(key string) error {
+	var err error
+	for _, t := range c.caches() {
+		err = multierr.Append(err, errors.Wrapf(t.cache.Delete(key), "tier %s", t.name))
+	}
+	return err
+}
+
+// DeleteByPrefix removes the keys having prefix from every cache and returns the number of deleted keys.
+func (c *CacheManager) DeleteByPrefix(prefix string) (int, error) {
+	var err error
+	deleted := map[string]bool{}
+	for _, t := range c.caches() {
+		keys, e := t.cache.Keys(prefix, 0)
+		if e != nil {
+			err = multierr.Append(err, errors.Wrapf(e, "tier %s", t.name))
+			continue
+		}
+		for _, k := range keys {
+			if e := t.cache.Delete(k); e != nil {
+				err = multierr.Append(err, errors.Wrapf(e, "tier %s", t.name))
+				continue
+			}
+			deleted[k] = true
+		}
+	}
+	return len(deleted), err
+}
+
+// ClearTier clears one of the caches by the name returned by TierNames.
+func (c *CacheManager) ClearTier(name string) error {
+	for _, t := range c.caches() {
+		if t.name == name {
+			return t.cache.Clear()
+		}
+	}
+	return errors.Wrap(ErrUnknownCacheTier, name)
+}
+
+// CacheTierStats are the stats of a local cache tier.
+type CacheTierStats struct {
+	Name     string   `json:"name"`
+	MaxTTL   Duration `json:"maxTTL"`
+	HitRatio float64  `json:"hitRatio"`
+	CacheStats
+}
+
+// Stats returns stats of the local tiers.
+func (c *CacheManager) Stats() []*CacheTierStats {
+	var stats []*CacheTierStats
+	for _, t := range c.tiers {
+		sc, ok := t.cache.(StatsCache)
+		if !ok {
+			continue
+		}
+		s := &CacheTierStats{Name: t.name, MaxTTL: Duration{t.maxTTL}, CacheStats: sc.CacheStats()}
+		s.HitRatio = s.CacheStats.HitRatio()
+		stats = append(stats, s)
+	}
+	return stats
 }
 
 type CachedHttpResp struct {
@@ -89,25 +357,130 @@ type CachedItem struct {
 	RpcError     *jsonrpc.RpcError   `json:"e,omitempty"`
 	Result       jsoniter.RawMessage `json:"r,omitempty"`
 	HttpResponse *CachedHttpResp     `json:"h,omitempty"`
+	// StoredAt and TTL are in milliseconds, they tell the age of a cached result
+	StoredAt int64 `json:"t,omitempty"`
+	TTL      int64 `json:"l,omitempty"`
+	// Delta is how long it took to fetch the result in milliseconds
+	Delta int64 `json:"d,omitempty"`
+	// Compressed is the Result compressed in Encoding, such items are marshaled as
+	// [compressedItemMagic][compression id][uvarint StoredAt][uvarint TTL][uvarint Delta]
+	// [compressed result] instead of JSON.
+	Encoding   string `json:"-"`
+	Compressed []byte `json:"-"`
 }
 
+// compressedItemMagic is the first byte of compressed items, JSON never starts with it
+const compressedItemMagic = 0
+
 func (i *CachedItem) Marshal() []byte {
+	if i.Compressed != nil {
+		d := make([]byte, 2+3*binary.MaxVarintLen64, 2+3*binary.MaxVarintLen64+len(i.Compressed))
+		d[0], d[1] = compressedItemMagic, compressionID(i.Encoding)
+		n := 2
+		for _, v := range []int64{i.StoredAt, i.TTL, i.Delta} {
+			n += binary.PutUvarint(d[n:], uint64(v))
+		}
+		return append(d[:n], i.Compressed...)
+	}
 	d, _ := jsoniter.Marshal(i)
 	return d
 }
 
+func (i *CachedItem) Unmarshal(data []byte) error {
+	if len(data) > 0 && data[0] == compressedItemMagic {
+		if len(data) < 2 || compressionOfID(data[1]) == "" {
+			return errors.New("invalid compressed item")
+		}
+		n := 2
+		for _, v := range []*int64{&i.StoredAt, &i.TTL, &i.Delta} {
+			u, m := binary.Uvarint(data[n:])
+			if m <= 0 {
+				return errors.New("invalid compressed item")
+			}
+			*v, n = int64(u), n+m
+		}
+		i.Encoding = compressionOfID(data[1])
+		i.Compressed = data[n:]
+		return nil
+	}
+	return jsoniter.Unmarshal(data, i)
+}
+
+// Compress compresses Result in encoding if it's at least minSize bytes and gets smaller.
+func (i *CachedItem) Compress(encoding string, minSize int) error {
+	if len(i.Result) < minSize || len(i.Result) == 0 {
+		return nil
+	}
+	c, err := compressData(encoding, i.Result)
+	if err != nil {
+		return err
+	}
+	if len(c) < len(i.Result) {
+		i.Encoding, i.Compressed, i.Result = encoding, c, nil
+	}
+	return nil
+}
+
+// Decompress restores Result from Compressed.
+func (i *CachedItem) Decompress() error {
+	if i.Compressed == nil {
+		return nil
+	}
+	r, err := decompressData(i.Encoding, i.Compressed)
+	if err != nil {
+		return err
+	}
+	i.Result, i.Encoding, i.Compressed = r, "", nil
+	return nil
+}
+
+// SetLifetime records the item fetched in delta is stored at now for ttl.
+func (i *CachedItem) SetLifetime(now time.Time, ttl, delta time.Duration) {
+	i.StoredAt = now.UnixNano() / int64(time.Millisecond)
+	i.TTL = int64(ttl / time.Millisecond)
+	i.Delta = int64(delta / time.Millisecond)
+}
+
+// AgeRatio is how much of its TTL the item has lived at now, 0 if the lifetime is unknown.
+func (i *CachedItem) AgeRatio(now time.Time) float64 {
+	if i.TTL <= 0 || i.StoredAt <= 0 {
+		return 0
+	}
+	return float64(now.UnixNano()/int64(time.Millisecond)-i.StoredAt) / float64(i.TTL)
+}
+
+// ShouldRecompute tells whether to fetch the result again before it expires, by XFetch
+// (Vattani et al., Optimal Probabilistic Cache Stampede Prevention), r is uniformly random in (0, 1].
+// The earlier before expiry and the faster to fetch, the less likely it is.
+func (i *CachedItem) ShouldRecompute(now time.Time, beta, r float64) bool {
+	if i.TTL <= 0 || i.StoredAt <= 0 || beta <= 0 || r <= 0 {
+		return false
+	}
+	ms := float64(now.UnixNano() / int64(time.Millisecond))
+	return ms-float64(i.Delta)*beta*math.Log(r) >= float64(i.StoredAt+i.TTL)
+}
+
+func (i *CachedItem) IsCompressed() bool {
+	return i.Compressed != nil
+}
+
 func (i *CachedItem) IsEmpty() bool {
-	return i.RpcError == nil && i.HttpResponse == nil && len(i.Result) == 0
+	return i.RpcError == nil && i.HttpResponse == nil && len(i.Result) == 0 && i.Compressed == nil
 }
 
 func (i *CachedItem) Reset() {
 	i.RpcError = nil
 	i.HttpResponse = nil
 	i.Result = nil
+	i.StoredAt = 0
+	i.TTL = 0
+	i.Delta = 0
+	i.Encoding = ""
+	i.Compressed = nil
 }
 
 func (i *CachedItem) IsRpc() bool {
-	return i.RpcError != nil || i.Result != nil
+	return i.RpcError != nil || i.Result != nil || i.Compressed != nil
 }
 
 func (i *CachedItem) IsRpcError() bool {
@@ -130,7 +503,7 @@ func (i *CachedItem) WriteHttpResponse(r *fasthttp.Response) {
 }
 
 func (i *CachedItem) IsRpcResult() bool {
-	return i.Result != nil
+	return i.Result != nil || i.Compressed != nil
 }
 
 func (i *CachedItem) GetRpcResponse(id interface{}) *jsonrpc.RpcResponse {
@@ -154,4 +527,27 @@ func (i *CachedItem) WriteToRpcResponse(r *jsonrpc.RpcResponse, id interface{})
 	}
 }
 
+// WriteCompressedRpcResponse writes the response of id as a body in Encoding, the compressed
+// result is sent as it is between the uncompressed head and tail of the response.
+func (i *CachedItem) WriteCompressedRpcResponse(r *fasthttp.Response, id interface{}) error {
+	head := []byte(`{"jsonrpc":"` + jsonrpc.JSONRPC2 + `",`)
+	if id != nil {
+		idData, err := jsoniter.Marshal(id)
+		if err != nil {
+			return err
+		}
+		head = append(append(append(head, `"id":`...), idData...), ',')
+	}
+	head = append(head, `"result":`...)
+	body, err := wrapCompressed(i.Encoding, head, i.Compressed, []byte("}"))
+	if err != nil {
+		return err
+	}
+	r.SetStatusCode(fasthttp.StatusOK)
+	r.Header.Set(fasthttp.HeaderContentEncoding, i.Encoding)
+	r.Header.SetContentType("application/json; charset=utf-8")
+	r.SetBody(body)
+	return nil
+}
+
 type CachedItems []CachedItem
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type redisWrite struct {
+	key string
+	val []byte
+	ttl time.Duration
+}
+
+// RedisCache is a ProxyCache shared by proxy replicas. Writes are queued and sent in pipelines,
+// when redis is unreachable it's marked as down for a while and all operations are skipped.
+type RedisCache struct {
+	client        *redis.Client
+	prefix        string
+	timeout       time.Duration
+	retryInterval time.Duration
+	writes        chan redisWrite
+	window        time.Duration
+	limit         int
+	// unix nano until which redis is considered unreachable
+	downUntil int64
+	stop      chan struct{}
+}
+
+func NewRedisCache(conf *RedisCacheConfig) *RedisCache {
+	c := &RedisCache{
+		client: redis.NewClient(&redis.Options{
+			Addr:         conf.Addr,
+			Username:     conf.Username,
+			Password:     conf.Password,
+			DB:           conf.DB,
+			DialTimeout:  conf.DialTimeout.Duration,
+			ReadTimeout:  conf.Timeout.Duration,
+			WriteTimeout: conf.Timeout.Duration,
+			PoolSize:     conf.PoolSize,
+			// a slow cache is worse than a miss
+			MaxRetries: -1,
+		}),
+		prefix:        conf.KeyPrefix,
+		timeout:       conf.Timeout.Duration,
+		retryInterval: conf.RetryInterval.Duration,
+		writes:        make(chan redisWrite, conf.PipelineLimit*16),
+		window:        conf.PipelineWindow.Duration,
+		limit:         conf.PipelineLimit,
+		stop:          make(chan struct{}),
+	}
+	go c.runPipeline()
+	return c
+}
+
+// Available tells whether redis is considered reachable.
+func (c *RedisCache) Available() bool {
+	return time.Now().UnixNano() >= atomic.LoadInt64(&c.downUntil)
+}
+
+func (c *RedisCache) markDown(err error) {
+	if c.Available() {
+		log.WithError(err).Warnf("redis cache is unreachable, fallback to local cache for %s", c.retryInterval)
+	}
+	atomic.StoreInt64(&c.downUntil, time.Now().Add(c.retryInterval).UnixNano())
+}
+
+// Set queues the entry to be written in the next pipeline, entries are dropped when the queue is full.
+func (c *RedisCache) Set(key string, val []byte, ttl time.Duration) error {
+	if !c.Available() {
+		return nil
+	}
+	v := make([]byte, len(val))
+	copy(v, val)
+	select {
+	case c.writes <- redisWrite{key: c.prefix + key, val: v, ttl: ttl}:
+	default:
+		log.WithField("key", key).Debug("redis write queue is full, drop entry")
+	}
+	return nil
+}
+
+func (c *RedisCache) Get(key string) []byte {
+	val, _ := c.GetWithTTL(key)
+	return val
+}
+
+// GetWithTTL returns the entry and its remaining TTL.
+func (c *RedisCache) GetWithTTL(key string) ([]byte, time.Duration) {
+	if !c.Available() {
+		return nil, 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var get *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, c.prefix+key)
+		ttl = pipe.PTTL(ctx, c.prefix+key)
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			c.markDown(err)
+		}
+		return nil, 0
+	}
+	val, err := get.Bytes()
+	if err != nil || ttl.Val() <= 0 {
+		return nil, 0
+	}
+	return val, ttl.Val()
+}
+
+// Peek is GetWithTTL, reads have no side effects.
+func (c *RedisCache) Peek(key string) ([]byte, time.Duration) {
+	return c.GetWithTTL(key)
+}
+
+func (c *RedisCache) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+func (c *RedisCache) Keys(prefix string, limit int) ([]string, error) {
+	ctx := context.Background()
+	var keys []string
+	iter := c.client.Scan(ctx, 0, redisEscapePattern(c.prefix+prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) && (limit <= 0 || len(keys) < limit) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), c.prefix))
+	}
+	return keys, iter.Err()
+}
+
+// redisEscapePattern escapes the special characters of glob-style patterns of redis
+func redisEscapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Clear deletes the entries with key prefix of this cache.
+func (c *RedisCache) Clear() error {
+	ctx := context.Background()
+	iter := c.client.Scan(ctx, 0, redisEscapePattern(c.prefix)+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) >= 1000 {
+			if err := c.client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return c.client.Del(ctx, keys...).Err()
+	}
+	return nil
+}
+
+// Close flushes queued writes and closes the connections.
+func (c *RedisCache) Close() error {
+	close(c.stop)
+	return c.client.Close()
+}
+
+// runPipeline sends the queued writes once pipelineLimit writes are queued or pipelineWindow passed.
+func (c *RedisCache) runPipeline() {
+	batch := make([]redisWrite, 0, c.limit)
+	timer := time.NewTimer(c.window)
+	defer timer.Stop()
+	flush := func() {
+		if len(batch) > 0 {
+			c.write(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case <-c.stop:
+			for {
+				select {
+				case w := <-c.writes:
+					batch = append(batch, w)
+				default:
+					flush()
+					return
+				}
+			}
+		case w := <-c.writes:
+			if len(batch) == 0 {
+				timer.Reset(c.window)
+			}
+			batch = append(batch, w)
+			if len(batch) >= c.limit {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+func (c *RedisCache) write(batch []redisWrite) {
+	if !c.Available() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, w := range batch {
+			pipe.Set(ctx, w.key, w.val, w.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		c.markDown(err)
+	}
+}
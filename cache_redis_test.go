@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	assertion "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestRedisConfig(t *testing.T, twoLevel bool) (*miniredis.Miniredis, *CacheManagerConfig) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	conf := &CacheManagerConfig{
+		Engine:        CacheEngineLRU,
+		MemoryLimitMb: 16,
+		Redis:         &RedisCacheConfig{Addr: mr.Addr(), TwoLevel: twoLevel, RetryInterval: Duration{time.Hour}},
+	}
+	conf.SetDefaults()
+	return mr, conf
+}
+
+func TestRedisCache(t *testing.T) {
+	assert := assertion.New(t)
+	mr, conf := newTestRedisConfig(t, false)
+	c := NewRedisCache(conf.Redis)
+	defer c.Close()
+	assert.Nil(c.Get("a"))
+	assert.NoError(c.Set("a", []byte("val"), time.Minute))
+	assert.Eventually(func() bool { return mr.Exists("jrp:a") }, time.Second, time.Millisecond)
+	val, ttl := c.GetWithTTL("a")
+	assert.Equal([]byte("val"), val)
+	assert.Equal(time.Minute, ttl)
+
+	mr.FastForward(time.Minute)
+	assert.Nil(c.Get("a"))
+
+	mr.Set("other", "x")
+	assert.NoError(c.Set("b", []byte("val"), time.Minute))
+	assert.Eventually(func() bool { return mr.Exists("jrp:b") }, time.Second, time.Millisecond)
+	keys, err := c.Keys("", 0)
+	assert.NoError(err)
+	assert.Equal([]string{"b"}, keys)
+	assert.NoError(c.Delete("b"))
+	assert.False(mr.Exists("jrp:b"))
+	assert.NoError(c.Set("b", []byte("val"), time.Minute))
+	assert.Eventually(func() bool { return mr.Exists("jrp:b") }, time.Second, time.Millisecond)
+	assert.NoError(c.Clear())
+	assert.False(mr.Exists("jrp:b"))
+	assert.True(mr.Exists("other"))
+	assert.True(c.Available())
+
+	mr.Close()
+	assert.Nil(c.Get("b"))
+	assert.False(c.Available())
+}
+
+func TestCacheManagerRedis(t *testing.T) {
+	assert := assertion.New(t)
+	mr, conf := newTestRedisConfig(t, false)
+	c := NewCacheManager(conf)
+	assert.NoError(c.Set("k", []byte("v"), time.Minute))
+	assert.Eventually(func() bool { return mr.Exists("jrp:k") }, time.Second, time.Millisecond)
+	assert.Nil(c.getLocal("k", time.Minute))
+	assert.Equal([]byte("v"), c.Get("k", time.Minute))
+
+	// fallback to local cache
+	mr.Close()
+	assert.Nil(c.Get("k", time.Minute))
+	assert.NoError(c.Set("k", []byte("local"), time.Minute))
+	assert.Equal([]byte("local"), c.Get("k", time.Minute))
+}
+
+func TestCacheManagerRedisTwoLevel(t *testing.T) {
+	assert := assertion.New(t)
+	mr, conf := newTestRedisConfig(t, true)
+	c := NewCacheManager(conf)
+	assert.NoError(mr.Set("jrp:k", "v"))
+	mr.SetTTL("jrp:k", time.Minute)
+	assert.Equal([]byte("v"), c.Get("k", time.Minute))
+	mr.Del("jrp:k")
+	// served by the local cache in front of redis
+	assert.Equal([]byte("v"), c.Get("k", time.Minute))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats are the stats of a local cache tier.
+type CacheStats struct {
+	Entries int64 `json:"entries"`
+	// Bytes is the memory used by entries, including removed entries not reclaimed yet
+	Bytes      int64 `json:"bytes"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Collisions int64 `json:"collisions"`
+	// Evictions is the number of entries removed for lack of space
+	Evictions int64 `json:"evictions"`
+	// Expired is the number of entries found expired and removed
+	Expired int64          `json:"expired"`
+	Methods []*MethodBytes `json:"methods,omitempty"`
+}
+
+func (s *CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// StatsCache is a ProxyCache reporting its stats.
+type StatsCache interface {
+	CacheStats() CacheStats
+}
+
+type MethodBytes struct {
+	Method string `json:"method"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// methodBytes tracks the bytes of entries by the method of their key.
+type methodBytes struct {
+	m sync.Map
+}
+
+// methodOfKey returns the method of a cache key in the form of `method(params)`.
+func methodOfKey(key string) string {
+	if i := strings.IndexByte(key, '('); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+func (b *methodBytes) add(key string, delta int64) {
+	m := methodOfKey(key)
+	v, ok := b.m.Load(m)
+	if !ok {
+		v, _ = b.m.LoadOrStore(m, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), delta)
+}
+
+func (b *methodBytes) reset() {
+	b.m.Range(func(k, v interface{}) bool {
+		b.m.Delete(k)
+		return true
+	})
+}
+
+// snapshot returns the methods having entries, the largest first.
+func (b *methodBytes) snapshot() []*MethodBytes {
+	var methods []*MethodBytes
+	b.m.Range(func(k, v interface{}) bool {
+		if n := atomic.LoadInt64(v.(*int64)); n > 0 {
+			methods = append(methods, &MethodBytes{Method: k.(string), Bytes: n})
+		}
+		return true
+	})
+	sort.Slice(methods, func(i, j int) bool {
+		if methods[i].Bytes != methods[j].Bytes {
+			return methods[i].Bytes > methods[j].Bytes
+		}
+		return methods[i].Method < methods[j].Method
+	})
+	return methods
+}
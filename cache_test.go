@@ -1,7 +1,11 @@
 package main
 
 import (
+	"github.com/pkg/errors"
 	assertion "github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+	"math"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -23,9 +27,17 @@ func TestBigCacheTTL(t *testing.T) {
 	time.Sleep(2 * time.Millisecond)
 	v, e := c.BigCache.Get("1")
 	assert.NoError(e)
-	assert.Equal([]byte("val"), v[8:])
+	assert.Equal([]byte("val"), v[bigCacheTTLHeaderSize+len("1"):])
 	assert.Nil(c.Get("1"))
 	t.Log(c.Stats())
+
+	// entries of an unlimited tier are not evicted by age
+	c = NewBigCacheTTLWithShards(0, 0, 256, 1)
+	assert.NoError(c.Set("2", []byte("val"), time.Hour))
+	time.Sleep(1100 * time.Millisecond)
+	assert.NoError(c.Set("3", []byte("val"), time.Hour))
+	assert.Equal([]byte("val"), c.Get("2"))
+	assert.Equal([]byte("val"), c.Get("3"))
 }
 
 func BenchmarkBigCacheTTL(b *testing.B) {
@@ -35,3 +47,355 @@ func BenchmarkBigCacheTTL(b *testing.B) {
 		_ = c.Get(strconv.Itoa(i - 1))
 	}
 }
+
+func TestCalcShards(t *testing.T) {
+	assert := assertion.New(t)
+	assert.Equal(1024, calcShards(1024, 0))
+	assert.Equal(256, calcShards(100, 0))
+	assert.Equal(1, calcShards(0, 0))
+	assert.Equal(512, calcShards(512, DefaultCacheMaxEntrySize))
+}
+
+func TestCacheManagerTiers(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &CacheManagerConfig{MemoryLimitMb: 64, MaxEntrySize: 1024, Tiers: []*CacheTierConfig{
+		{Name: "solid"},
+		{Name: "1h", MaxTTL: Duration{time.Hour}},
+		{Name: "1m", MaxTTL: Duration{time.Minute}, Weight: 2},
+	}}
+	conf.SetDefaults()
+	assert.Empty(conf.Check())
+	assert.Equal(32, conf.Tiers[2].SizeMb)
+	assert.Equal(16, conf.Tiers[0].SizeMb)
+	assert.Equal(50*time.Second, conf.Tiers[2].CleanWindow.Duration)
+
+	c := NewCacheManager(conf)
+	assert.Equal("1m", c.getTierForTTL(time.Second).name)
+	assert.Equal("1h", c.getTierForTTL(time.Minute).name)
+	assert.Equal("solid", c.getTierForTTL(24*time.Hour).name)
+
+	assert.NoError(c.Set("k", []byte("v"), time.Hour))
+	assert.Equal([]byte("v"), c.Get("k", time.Second))
+	assert.NoError(c.Set("big", make([]byte, 2048), time.Second))
+	assert.Nil(c.Get("big", time.Second))
+	assert.NoError(c.Clear())
+	assert.Nil(c.Get("k", time.Hour))
+
+	conf = &CacheManagerConfig{MemoryLimitMb: 8, MaxEntrySize: 1024 * 1024, Tiers: []*CacheTierConfig{
+		{Name: "a", SizeMb: 16, Shards: 1024},
+		{Name: "b", SizeMb: 4, Shards: 3},
+	}}
+	conf.SetDefaults()
+	assert.Len(conf.Check(), 4)
+
+	// tiers get at least 1MB and a shard, the total over memoryLimitMb is reported
+	conf = &CacheManagerConfig{MemoryLimitMb: 2, MaxEntrySize: 1024, Tiers: []*CacheTierConfig{
+		{Name: "a", MaxTTL: Duration{time.Minute}}, {Name: "b", MaxTTL: Duration{time.Hour}}, {Name: "c"},
+	}}
+	conf.SetDefaults()
+	for _, tier := range conf.Tiers {
+		assert.Equal(1, tier.SizeMb)
+		assert.Equal(4, tier.Shards)
+	}
+	errs := conf.Check()
+	if assert.Len(errs, 1) {
+		assert.Contains(errs.Error(), "total size 3MB exceeds cache.memoryLimitMb 2MB")
+	}
+
+	conf = &CacheManagerConfig{MemoryLimitMb: 2, Tiers: []*CacheTierConfig{{Name: "a", SizeMb: 2, MaxTTL: Duration{time.Minute}}, {Name: "b"}}}
+	conf.SetDefaults()
+	errs = conf.Check()
+	if assert.Len(errs, 1) {
+		assert.Contains(errs.Error(), "nothing is left of cache.memoryLimitMb 2MB")
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	assert := assertion.New(t)
+	c := NewLRUCache(1, 1, 0)
+	defer c.Close()
+	assert.Nil(c.Get("a"))
+	assert.NoError(c.Set("1", []byte("val"), time.Millisecond))
+	assert.NoError(c.Set("2", []byte("val"), time.Hour))
+	assert.Equal([]byte("val"), c.Get("1"))
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(c.Get("1"))
+	assert.Equal([]byte("val"), c.Get("2"))
+
+	assert.Equal(ErrEntryTooLarge, c.Set("big", make([]byte, 1024*1024), time.Hour))
+	// "2" is the least recently used and evicted for space
+	val := make([]byte, 400*1024)
+	assert.NoError(c.Set("3", val, time.Hour))
+	assert.NoError(c.Set("4", val, time.Hour))
+	assert.NotNil(c.Get("3"))
+	assert.NoError(c.Set("5", val, time.Hour))
+	assert.Nil(c.Get("2"))
+	assert.Nil(c.Get("4"))
+	assert.NotNil(c.Get("3"))
+	assert.NotNil(c.Get("5"))
+
+	assert.NoError(c.Clear())
+	assert.Nil(c.Get("3"))
+	assert.Equal(0, c.shards[0].size)
+
+	assert.NoError(c.Set("6", val, time.Minute))
+	c.shards[0].removeExpired(time.Now().Add(time.Hour).UnixNano())
+	assert.Equal(0, c.shards[0].ll.Len())
+	assert.Equal(0, c.shards[0].size)
+}
+
+func TestLRUCacheManager(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16}
+	conf.SetDefaults()
+	assert.Empty(conf.Check())
+	c := NewCacheManager(conf)
+	assert.Len(c.tiers, 1)
+	assert.NoError(c.Set("k", []byte("v"), time.Hour))
+	assert.Equal([]byte("v"), c.Get("k", time.Second))
+}
+
+func benchmarkCacheManager(b *testing.B, conf *CacheManagerConfig) {
+	conf.SetDefaults()
+	c := NewCacheManager(conf)
+	val := make([]byte, 256)
+	ttls := []time.Duration{5 * time.Second, time.Hour, 24 * time.Hour}
+	const keys = 100000
+	for i := 0; i < keys; i++ {
+		_ = c.Set(`GetBalance(["`+strconv.Itoa(i)+`"])`, val, ttls[i%len(ttls)])
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			// one in five lookups misses
+			key := `GetBalance(["` + strconv.Itoa(i%(keys*5/4)) + `"])`
+			if c.Get(key, ttls[i%len(ttls)]) == nil {
+				_ = c.Set(key, val, ttls[i%len(ttls)])
+			}
+		}
+	})
+}
+
+func BenchmarkCacheManagerBigCache(b *testing.B) {
+	benchmarkCacheManager(b, &CacheManagerConfig{Engine: CacheEngineBigCache, MemoryLimitMb: 256})
+}
+
+func BenchmarkCacheManagerLRU(b *testing.B) {
+	benchmarkCacheManager(b, &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 256})
+}
+
+func TestDiskCache(t *testing.T) {
+	assert := assertion.New(t)
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := NewDiskCache(path, 1, 0)
+	assert.NoError(err)
+	assert.Nil(c.Get("a"))
+	assert.NoError(c.Set("1", []byte("val"), time.Millisecond))
+	assert.NoError(c.Set("2", []byte("val"), time.Hour))
+	// writes are committed off the request path
+	c.flush()
+	val, ttl := c.GetWithTTL("2")
+	assert.Equal([]byte("val"), val)
+	assert.True(ttl > time.Hour-time.Second)
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(c.Get("1"))
+	assert.NoError(c.Close())
+
+	// survives restart
+	c, err = NewDiskCache(path, 1, 0)
+	assert.NoError(err)
+	assert.Equal([]byte("val"), c.Get("2"))
+
+	// entries expiring soonest are evicted for space
+	big := make([]byte, 300*1024)
+	assert.NoError(c.Set("3", big, 2*time.Hour))
+	assert.NoError(c.Set("4", big, 3*time.Hour))
+	assert.NoError(c.Set("5", big, 4*time.Hour))
+	assert.NoError(c.Set("6", big, 5*time.Hour))
+	c.flush()
+	assert.NoError(c.clean())
+	assert.Nil(c.Get("2"))
+	assert.Nil(c.Get("3"))
+	assert.NotNil(c.Get("4"))
+	assert.NotNil(c.Get("5"))
+	assert.NotNil(c.Get("6"))
+
+	assert.NoError(c.compact())
+	assert.NotNil(c.Get("6"))
+	// the replaced file is served if the compacted one can't be opened
+	c.open = func(p string) (*bbolt.DB, error) {
+		if p == path {
+			return nil, errors.New("no space left")
+		}
+		return openDiskCacheDB(p)
+	}
+	assert.Error(c.compact())
+	assert.NotNil(c.Get("6"))
+	assert.NoError(c.Set("7", []byte("val"), time.Hour))
+	c.flush()
+	assert.Equal([]byte("val"), c.Get("7"))
+	// and entries written meanwhile are kept by the next compaction
+	c.open = openDiskCacheDB
+	assert.NoError(c.compact())
+	assert.Equal([]byte("val"), c.Get("7"))
+	assert.NoError(c.Clear())
+	assert.Nil(c.Get("6"))
+	// queued writes are committed on close
+	assert.NoError(c.Set("8", []byte("val"), time.Hour))
+	assert.NoError(c.Close())
+	c, err = NewDiskCache(path, 1, 0)
+	assert.NoError(err)
+	assert.Equal([]byte("val"), c.Get("8"))
+	assert.NoError(c.Close())
+}
+
+func TestCacheManagerDisk(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16, Disk: &DiskCacheConfig{Path: filepath.Join(t.TempDir(), "cache.db")}}
+	conf.SetDefaults()
+	c := NewCacheManager(conf)
+	assert.NoError(c.Set("short", []byte("v"), time.Second))
+	assert.NoError(c.Set("long", []byte("v"), time.Hour))
+	c.persistent.flush()
+	assert.Nil(c.persistent.Get("short"))
+	assert.NotNil(c.persistent.Get("long"))
+	assert.NoError(c.tiers[0].cache.Clear())
+	// restored from disk
+	assert.Equal([]byte("v"), c.Get("long", time.Hour))
+	assert.Equal([]byte("v"), c.tiers[0].cache.Get("long"))
+	assert.NoError(c.persistent.Close())
+}
+
+func TestCacheManagerInspect(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &CacheManagerConfig{MemoryLimitMb: 64, Disk: &DiskCacheConfig{Path: filepath.Join(t.TempDir(), "cache.db")}}
+	conf.SetDefaults()
+	c := NewCacheManager(conf)
+	defer c.persistent.Close()
+	assert.Equal([]string{"1m", "1h", "solid", "disk"}, c.TierNames())
+	assert.NoError(c.Set("GetBalance([\"a\"])", []byte("1"), time.Second))
+	assert.NoError(c.Set("GetBalance([\"b\"])", []byte("2"), 2*time.Hour))
+	assert.NoError(c.Set("GetTxBlock([\"1\"])", []byte("3"), time.Second))
+	c.persistent.flush()
+
+	entries := c.Lookup("GetBalance([\"b\"])")
+	assert.Len(entries, 2)
+	assert.Equal("solid", entries[0].Tier)
+	assert.Equal("disk", entries[1].Tier)
+	assert.InDelta(2*time.Hour, entries[0].TTL.Duration, float64(time.Second))
+
+	keys, err := c.Keys("GetBalance(", 0)
+	assert.NoError(err)
+	assert.Equal([]string{"GetBalance([\"a\"])", "GetBalance([\"b\"])"}, keys)
+	keys, err = c.Keys("", 1)
+	assert.NoError(err)
+	assert.Len(keys, 1)
+
+	n, err := c.DeleteByPrefix("GetBalance(")
+	assert.NoError(err)
+	assert.Equal(2, n)
+	assert.Empty(c.Lookup("GetBalance([\"b\"])"))
+
+	assert.NoError(c.Delete("GetTxBlock([\"1\"])"))
+	assert.Nil(c.Get("GetTxBlock([\"1\"])", time.Second))
+
+	assert.NoError(c.Set("k", []byte("v"), time.Second))
+	assert.True(errors.Is(c.ClearTier("none"), ErrUnknownCacheTier))
+	assert.NoError(c.ClearTier("1h"))
+	assert.NotNil(c.Get("k", time.Second))
+	assert.NoError(c.ClearTier("1m"))
+	assert.Nil(c.Get("k", time.Second))
+}
+
+func TestBigCacheTTLStats(t *testing.T) {
+	assert := assertion.New(t)
+	c := NewBigCacheTTLWithShards(0, 0, 1, 1)
+	assert.NoError(c.Set("GetBalance([\"a\"])", []byte("1"), time.Millisecond))
+	assert.NoError(c.Set("GetBalance([\"b\"])", []byte("2"), time.Hour))
+	assert.NoError(c.Set("GetTxBlock([\"1\"])", []byte("3"), time.Hour))
+	time.Sleep(2 * time.Millisecond)
+	// peeks are not counted
+	assert.Nil(c.Peek("GetBalance([\"a\"])"))
+	val, ttl := c.Peek("GetBalance([\"b\"])")
+	assert.Equal([]byte("2"), val)
+	assert.True(ttl > 0)
+	assert.Nil(c.Peek("none"))
+	assert.Nil(c.Get("GetBalance([\"a\"])"))
+	assert.NotNil(c.Get("GetBalance([\"b\"])"))
+	assert.Nil(c.Get("none"))
+	s := c.CacheStats()
+	assert.EqualValues(2, s.Entries)
+	assert.EqualValues(1, s.Hits)
+	assert.EqualValues(2, s.Misses)
+	assert.EqualValues(1, s.Expired)
+	entrySize := int64(bigCacheHeaderSize + 2*len("GetBalance([\"a\"])") + bigCacheTTLHeaderSize + 1)
+	// the expired entry is not popped yet
+	assert.Equal(3*entrySize, s.Bytes)
+	assert.Equal([]*MethodBytes{{"GetBalance", 2 * entrySize}, {"GetTxBlock", entrySize}}, s.Methods)
+
+	// fill the shard to evict old entries
+	for i := 0; i < 1024; i++ {
+		assert.NoError(c.Set(strconv.Itoa(i), make([]byte, 1024), time.Hour))
+	}
+	s = c.CacheStats()
+	assert.True(s.Evictions > 0)
+	assert.Equal("GetBalance", methodOfKey("GetBalance([])"))
+	for _, m := range s.Methods {
+		assert.NotEqual("GetBalance", m.Method)
+	}
+	assert.NoError(c.Clear())
+	s = c.CacheStats()
+	assert.EqualValues(0, s.Bytes)
+	assert.Empty(s.Methods)
+}
+
+func TestLRUCacheStats(t *testing.T) {
+	assert := assertion.New(t)
+	c := NewLRUCache(1, 1, 0)
+	assert.NoError(c.Set("GetBalance([\"a\"])", []byte("1"), time.Millisecond))
+	assert.NoError(c.Set("GetBalance([\"b\"])", []byte("2"), time.Hour))
+	time.Sleep(2 * time.Millisecond)
+	// peeks are neither promoted nor counted
+	assert.NoError(c.Set("GetBalance([\"c\"])", []byte("3"), time.Hour))
+	val, _ := c.Peek("GetBalance([\"b\"])")
+	assert.Equal([]byte("2"), val)
+	assert.Equal("GetBalance([\"c\"])", c.getShard("").ll.Front().Value.(*lruEntry).key)
+	assert.Nil(c.Peek("GetBalance([\"a\"])"))
+	assert.Nil(c.Peek("none"))
+	assert.NoError(c.Delete("GetBalance([\"c\"])"))
+	assert.Nil(c.Get("GetBalance([\"a\"])"))
+	assert.NotNil(c.Get("GetBalance([\"b\"])"))
+	s := c.CacheStats()
+	assert.EqualValues(1, s.Entries)
+	assert.EqualValues(1, s.Hits)
+	assert.EqualValues(1, s.Misses)
+	assert.EqualValues(1, s.Expired)
+	entrySize := int64(len("GetBalance([\"b\"])") + 1 + lruEntryOverhead)
+	assert.Equal(entrySize, s.Bytes)
+	assert.Equal([]*MethodBytes{{"GetBalance", entrySize}}, s.Methods)
+	for i := 0; i < 1024; i++ {
+		assert.NoError(c.Set(strconv.Itoa(i), make([]byte, 1024), time.Hour))
+	}
+	assert.True(c.CacheStats().Evictions > 0)
+}
+
+func TestCachedItemShouldRecompute(t *testing.T) {
+	assert := assertion.New(t)
+	now := time.Unix(1600000000, 0)
+	item := &CachedItem{Result: []byte(`1`)}
+	item.SetLifetime(now, 10*time.Second, time.Second)
+	assert.InDelta(0.5, item.AgeRatio(now.Add(5*time.Second)), 1e-9)
+	assert.False(item.ShouldRecompute(now.Add(5*time.Second), 1, 0.5))
+	// -ln(r) * delta = 6s
+	assert.True(item.ShouldRecompute(now.Add(5*time.Second), 1, math.Exp(-6)))
+	assert.False(item.ShouldRecompute(now.Add(5*time.Second), 0.5, math.Exp(-6)))
+	assert.True(item.ShouldRecompute(now.Add(10*time.Second), 1, 1))
+	assert.False(item.ShouldRecompute(now.Add(10*time.Second), 0, 1))
+
+	item.Compressed, item.Encoding, item.Result = []byte{1}, CompressionZstd, nil
+	decoded := &CachedItem{}
+	assert.NoError(decoded.Unmarshal(item.Marshal()))
+	assert.Equal(item, decoded)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ParamCanonicalizer returns the canonical form of a param, params of the same canonical form
+// share the cache entry. It returns the param as it is if it's not of the expected form.
+type ParamCanonicalizer func(param interface{}) interface{}
+
+// canonicalizers are the ParamCanonicalizers usable in CanonicalParam.As by name
+var canonicalizers = map[string]ParamCanonicalizer{
+	"hex":     canonicalHex,
+	"address": canonicalAddress,
+	"height":  canonicalHeight,
+}
+
+// RegisterCanonicalizer makes c usable in cache rules by name, it's not safe to be called after
+// the proxy starts.
+func RegisterCanonicalizer(name string, c ParamCanonicalizer) {
+	canonicalizers[name] = c
+}
+
+// CanonicalParam canonicalizes the param at index Param by the canonicalizer named As.
+type CanonicalParam struct {
+	Param int    `json:"param"`
+	As    string `json:"as"`
+}
+
+// canonicalHex lower cases hex strings and strips the 0x prefix.
+func canonicalHex(param interface{}) interface{} {
+	s, ok := param.(string)
+	if !ok {
+		return param
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+	if s == "" || strings.TrimLeft(s, "0123456789abcdefABCDEF") != "" {
+		return param
+	}
+	return strings.ToLower(s)
+}
+
+// canonicalAddress converts bech32 Zilliqa addresses (zil1...) to hex, then canonicalizes as hex.
+func canonicalAddress(param interface{}) interface{} {
+	if s, ok := param.(string); ok && len(s) > 4 && strings.EqualFold(s[:4], "zil1") {
+		if data, err := decodeBech32("zil", s); err == nil {
+			return hex.EncodeToString(data)
+		}
+		return param
+	}
+	return canonicalHex(param)
+}
+
+// canonicalHeight converts block heights in numbers, decimal or hex strings to decimal strings.
+func canonicalHeight(param interface{}) interface{} {
+	if h, ok := parseHeight(param); ok {
+		return strconv.FormatUint(h, 10)
+	}
+	return param
+}
+
+// canonicalParams returns params canonicalized by cc, trailing params equal to their defaults
+// are removed. params are not modified.
+func canonicalParams(cc *CacheConfig, params interface{}) interface{} {
+	ps, ok := params.([]interface{})
+	if !ok || (len(cc.Canonical) == 0 && len(cc.DefaultParams) == 0) {
+		return params
+	}
+	canonical := append([]interface{}{}, ps...)
+	for _, c := range cc.Canonical {
+		if c.Param >= 0 && c.Param < len(canonical) {
+			if f := canonicalizers[c.As]; f != nil {
+				canonical[c.Param] = f(canonical[c.Param])
+			}
+		}
+	}
+	for n := len(canonical); n > 0 && n <= len(cc.DefaultParams); n-- {
+		if !reflect.DeepEqual(canonical[n-1], cc.DefaultParams[n-1]) {
+			break
+		}
+		canonical = canonical[:n-1]
+	}
+	return canonical
+}
+
+// cacheKey returns the cache key of req served by the upstream group, with params canonicalized
+// by its cache rule, the request sent to upstream is not changed.
+func (p *Proxy) cacheKey(group string, req *jsonrpc.RpcRequest) (string, error) {
+	r := *req
+	if cc := p.config.Search(req.Method); cc != nil {
+		r.Params = canonicalParams(cc, req.Params)
+	}
+	key, err := r.ToCacheKey()
+	if err != nil {
+		return "", err
+	}
+	return groupKey(key, group), nil
+}
+
+// groupKey returns key of the upstream group, groups may serve different data so they are cached
+// apart. Keys of the default upstreams are kept as they are.
+func groupKey(key, group string) string {
+	if group == "" {
+		return key
+	}
+	return key + "@" + group
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// decodeBech32 decodes a BIP-173 bech32 string of the human readable part hrp into bytes.
+func decodeBech32(hrp, s string) ([]byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return nil, errors.New("mixed case bech32 string")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) || s[:pos] != hrp {
+		return nil, errors.New("invalid bech32 string")
+	}
+	values := make([]byte, 0, len(hrp)*2+1+len(s)-pos-1)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]>>5)
+	}
+	values = append(values, 0)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]&31)
+	}
+	data := make([]byte, 0, len(s)-pos-1)
+	for i := pos + 1; i < len(s); i++ {
+		d := strings.IndexByte(bech32Charset, s[i])
+		if d < 0 {
+			return nil, errors.New("invalid bech32 character")
+		}
+		data = append(data, byte(d))
+	}
+	if bech32Polymod(append(values, data...)) != 1 {
+		return nil, errors.New("invalid bech32 checksum")
+	}
+	// convert the 5-bit groups without the checksum to bytes
+	var out []byte
+	acc, bits := uint32(0), uint(0)
+	for _, v := range data[:len(data)-6] {
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		for bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || (acc<<(8-bits))&0xff != 0 {
+		return nil, errors.New("invalid bech32 padding")
+	}
+	return out, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"testing"
+	"time"
+)
+
+func TestCanonicalizers(t *testing.T) {
+	assert := assertion.New(t)
+	const addr = "9bfec715a6bd658fcb62b0f8cc9bfa2ade71434a"
+	for _, v := range []string{addr, "0x" + addr, "9BFEC715A6BD658FCB62B0F8CC9BFA2ADE71434A", "0x9bFEc715a6bD658fCb62B0f8cC9BFa2ade71434A",
+		"zil1n0lvw9dxh4jcljmzkruvexl69t08zs62ds9ats", "ZIL1N0LVW9DXH4JCLJMZKRUVEXL69T08ZS62DS9ATS"} {
+		assert.Equal(addr, canonicalAddress(v), v)
+	}
+	// invalid checksum, not hex and not string are left as they are
+	for _, v := range []interface{}{"zil1n0lvw9dxh4jcljmzkruvexl69t08zs62ds9atq", "zil1N0lvw9dxh4jcljmzkruvexl69t08zs62ds9ats", "0xzz", "", float64(1)} {
+		assert.Equal(v, canonicalAddress(v), v)
+	}
+	assert.Equal("abc", canonicalHex("0xABC"))
+	for _, v := range []interface{}{float64(255), "255", "0xff", "0xFF"} {
+		assert.Equal("255", canonicalHeight(v), v)
+	}
+	assert.Equal("latest", canonicalHeight("latest"))
+}
+
+func TestCanonicalCacheKey(t *testing.T) {
+	assert := assertion.New(t)
+	conf, err := parseConfig([]byte(`
+listen: 127.0.0.1:8080
+upstreams: [http://localhost:4201]
+cacheConfigs:
+- methods: [GetSmartContractSubState]
+  for: 5s
+  canonical: [{param: 0, as: address}]
+  defaultParams: [null, "", []]
+- methods: [GetTxBlock]
+  for: 5s
+  canonical: [{param: 0, as: height}]
+- methods: [GetBalance]
+  for: 5s
+  canonical: [{param: 0, as: base58}]
+`))
+	assert.NoError(err)
+	errs := conf.Check()
+	if assert.Len(errs, 1) {
+		assert.Equal("cacheConfigs[2].canonical[0].as", errs[0].Path)
+	}
+	RegisterCanonicalizer("base58", func(v interface{}) interface{} { return v })
+	defer delete(canonicalizers, "base58")
+	assert.Empty(conf.Check())
+	p := NewProxy(conf)
+
+	key := func(method string, params ...interface{}) string {
+		req := &jsonrpc.RpcRequest{Method: method, Params: append([]interface{}{}, params...)}
+		k, err := p.cacheKey("", req)
+		assert.NoError(err)
+		return k
+	}
+	expected := `GetSmartContractSubState(["9bfec715a6bd658fcb62b0f8cc9bfa2ade71434a"])`
+	assert.Equal(expected, key("GetSmartContractSubState", "zil1n0lvw9dxh4jcljmzkruvexl69t08zs62ds9ats"))
+	assert.Equal(expected, key("GetSmartContractSubState", "0x9BFEC715A6BD658FCB62B0F8CC9BFA2ADE71434A", "", []interface{}{}))
+	assert.Equal(`GetSmartContractSubState(["9bfec715a6bd658fcb62b0f8cc9bfa2ade71434a","balances"])`,
+		key("GetSmartContractSubState", "0x9BFEC715A6BD658FCB62B0F8CC9BFA2ADE71434A", "balances", []interface{}{}))
+	assert.Equal(`GetTxBlock(["10"])`, key("GetTxBlock", float64(10)))
+	assert.Equal(`GetTxBlock(["10"])`, key("GetTxBlock", "10"))
+	assert.Equal(`GetNetworkId([])`, key("GetNetworkId"))
+}
+
+func TestProxyCanonicalCacheKey(t *testing.T) {
+	assert := assertion.New(t)
+	var bodies []string
+	upstream := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		bodies = append(bodies, string(ctx.PostBody()))
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"jsonrpc":"2.0","id":1,"result":["100"]}`)
+	})
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{upstream},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs: []*CacheConfig{{
+			Methods:   []string{"GetBalance"},
+			For:       Duration{Duration: time.Minute},
+			Canonical: []*CanonicalParam{{Param: 0, As: "address"}},
+		}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+	bech32 := `{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["zil1n0lvw9dxh4jcljmzkruvexl69t08zs62ds9ats"]}`
+	doProxyRequest(p, bech32)
+	ctx := doProxyRequest(p, `{"jsonrpc":"2.0","id":2,"method":"GetBalance","params":["0x9BFEC715A6BD658FCB62B0F8CC9BFA2ADE71434A"]}`)
+	assert.Equal(`{"jsonrpc":"2.0","id":2,"result":["100"]}`, string(ctx.Response.Body()))
+	// upstream receives the original request
+	assert.Equal([]string{bech32}, bodies)
+}
@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// Clock tells the current time, it's replaced in tests to control expiration.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
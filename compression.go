@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"strconv"
+	"sync"
+)
+
+// encodings of compressed cache entries. gzip and zstd are also HTTP codings, a compressed result
+// is sent in them without being decompressed, by wrapping it between stored blocks of the rest of
+// the response in a single stream. snappy is only for storage.
+const (
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+	CompressionGzip   = "gzip"
+)
+
+// DefaultCompressMinSize is the size of the smallest result compressed when compression is enabled
+const DefaultCompressMinSize = 1024
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil)
+
+	gzipWriterPool = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	snappyWriterPool = sync.Pool{New: func() interface{} { return snappy.NewWriter(nil) }}
+)
+
+func isValidCompression(encoding string) bool {
+	switch encoding {
+	case CompressionSnappy, CompressionZstd, CompressionGzip:
+		return true
+	}
+	return false
+}
+
+// compressData compresses data into a standalone stream of encoding.
+func compressData(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(w)
+		w.Reset(&buf)
+		// flushed before closing so that the deflate data ends on a byte boundary to be wrapped
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		return finishStream(&buf, w, nil)
+	case CompressionSnappy:
+		var buf bytes.Buffer
+		w := snappyWriterPool.Get().(*snappy.Writer)
+		defer snappyWriterPool.Put(w)
+		w.Reset(&buf)
+		return finishStream(&buf, w, data)
+	}
+	return nil, fmt.Errorf("unknown compression %q", encoding)
+}
+
+func finishStream(buf *bytes.Buffer, w io.WriteCloser, data []byte) ([]byte, error) {
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressData decompresses all concatenated streams in data.
+func decompressData(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case CompressionSnappy:
+		return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(data)))
+	}
+	return nil, fmt.Errorf("unknown compression %q", encoding)
+}
+
+// compressionIDs are stored in the header of compressed cache entries
+var compressionIDs = []string{1: CompressionSnappy, 2: CompressionZstd, 3: CompressionGzip}
+
+func compressionID(encoding string) byte {
+	for id, e := range compressionIDs {
+		if e == encoding && e != "" {
+			return byte(id)
+		}
+	}
+	return 0
+}
+
+func compressionOfID(id byte) string {
+	if int(id) < len(compressionIDs) {
+		return compressionIDs[id]
+	}
+	return ""
+}
+
+func isHTTPCompression(encoding string) bool {
+	return encoding == CompressionZstd || encoding == CompressionGzip
+}
+
+// acceptsEncoding tells whether the Accept-Encoding header accepts coding, codings of q=0 are refused
+// and a coding listed by name overrides "*".
+func acceptsEncoding(header []byte, coding string) bool {
+	var named, wildcard, namedOK, wildcardOK bool
+	for _, part := range bytes.Split(header, []byte(",")) {
+		params := bytes.Split(part, []byte(";"))
+		ok := true
+		for _, param := range params[1:] {
+			param = bytes.TrimSpace(param)
+			if len(param) > 2 && (param[0] == 'q' || param[0] == 'Q') && param[1] == '=' {
+				q, err := strconv.ParseFloat(string(param[2:]), 64)
+				ok = err == nil && q > 0
+			}
+		}
+		switch name := bytes.TrimSpace(params[0]); {
+		case bytes.EqualFold(name, []byte(coding)):
+			named, namedOK = true, ok
+		case string(name) == "*":
+			wildcard, wildcardOK = true, ok
+		}
+	}
+	if named {
+		return namedOK
+	}
+	return wildcard && wildcardOK
+}
+
+// wrapCompressed puts the compressed data between head and tail in a single stream of encoding,
+// without decompressing data. data must be written by compressData.
+func wrapCompressed(encoding string, head, data, tail []byte) ([]byte, error) {
+	switch encoding {
+	case CompressionGzip:
+		return wrapGzip(head, data, tail)
+	case CompressionZstd:
+		return wrapZstd(head, data, tail)
+	}
+	return nil, fmt.Errorf("compression %q can't be wrapped", encoding)
+}
+
+// gzipFlushEnd ends the deflate data of compressData, the empty stored block of the flush
+// followed by an empty final block.
+var gzipFlushEnd = []byte{0x00, 0x00, 0xff, 0xff, 0x03, 0x00}
+
+func wrapGzip(head, data, tail []byte) ([]byte, error) {
+	// 10 bytes of header without optional fields, 8 bytes of trailer
+	n := len(data)
+	if n < 10+len(gzipFlushEnd)+8 || data[3] != 0 || !bytes.Equal(data[n-8-len(gzipFlushEnd):n-8], gzipFlushEnd) {
+		return nil, errors.New("gzip data not ending by a flush")
+	}
+	crc, size := binary.LittleEndian.Uint32(data[n-8:]), binary.LittleEndian.Uint32(data[n-4:])
+	body := make([]byte, 0, n+len(head)+len(tail)+64)
+	body = append(body, data[:10]...)
+	body = appendStoredBlocks(body, head, false)
+	body = append(body, data[10:n-10]...)
+	body = appendStoredBlocks(body, tail, true)
+	crc = crc32Combine(crc32.ChecksumIEEE(head), crc, int64(size))
+	crc = crc32Combine(crc, crc32.ChecksumIEEE(tail), int64(len(tail)))
+	body = append(body, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(body[len(body)-8:], crc)
+	binary.LittleEndian.PutUint32(body[len(body)-4:], uint32(len(head))+size+uint32(len(tail)))
+	return body, nil
+}
+
+// appendStoredBlocks appends data as uncompressed deflate blocks.
+func appendStoredBlocks(dst, data []byte, final bool) []byte {
+	for {
+		n := len(data)
+		if n > math.MaxUint16 {
+			n = math.MaxUint16
+		}
+		last := n == len(data)
+		if last && final {
+			dst = append(dst, 1)
+		} else {
+			dst = append(dst, 0)
+		}
+		dst = append(dst, byte(n), byte(n>>8), ^byte(n), ^byte(n>>8))
+		dst, data = append(dst, data[:n]...), data[n:]
+		if last {
+			return dst
+		}
+	}
+}
+
+// crc32Combine is the IEEE CRC-32 of the data of crc1 followed by len2 bytes of crc2, as crc32_combine of zlib.
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	// odd is the operator of one zero bit, even of two
+	var even, odd [32]uint32
+	odd[0] = crc32.IEEE
+	for n, row := 1, uint32(1); n < 32; n, row = n+1, row<<1 {
+		odd[n] = row
+	}
+	gf2MatrixSquare(&even, &odd)
+	gf2MatrixSquare(&odd, &even)
+	// applies len2 zero bytes to crc1
+	for {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&even, crc1)
+		}
+		if len2 >>= 1; len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&odd, crc1)
+		}
+		if len2 >>= 1; len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat *[32]uint32) {
+	for n := range mat {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// maxZstdBlockSize is the largest block of any window
+const maxZstdBlockSize = 128 << 10
+
+func wrapZstd(head, data, tail []byte) ([]byte, error) {
+	window, blocks, last, err := zstdBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+	// the new frame has neither content size nor checksum, its window is at least the one of data
+	exp := bits.Len64(window - 1)
+	if window <= 1<<10 {
+		exp = 10
+	}
+	if exp > 10+31 {
+		return nil, errors.New("zstd window too large")
+	}
+	blockSize := maxZstdBlockSize
+	if exp < 17 {
+		blockSize = 1 << exp
+	}
+	body := make([]byte, 0, len(data)+len(head)+len(tail)+64)
+	body = append(append(body, zstdMagic...), 0, byte(exp-10)<<3)
+	body = appendRawBlocks(body, head, blockSize, false)
+	body = append(body, blocks...)
+	if last >= 0 {
+		body[len(body)-len(blocks)+last] &^= 1
+	}
+	return appendRawBlocks(body, tail, blockSize, true), nil
+}
+
+// zstdBlocks returns the window, the blocks and the offset of the last block of the frame in data.
+func zstdBlocks(data []byte) (window uint64, blocks []byte, last int, err error) {
+	// zstd encodes nothing into no frame
+	if len(data) == 0 {
+		return 0, nil, -1, nil
+	}
+	if len(data) < 5 || !bytes.Equal(data[:4], zstdMagic) {
+		return 0, nil, 0, errors.New("not a zstd frame")
+	}
+	desc := data[4]
+	if desc&3 != 0 {
+		return 0, nil, 0, errors.New("zstd frame with dictionary")
+	}
+	singleSegment := desc&0x20 != 0
+	pos := 5
+	if !singleSegment {
+		if pos >= len(data) {
+			return 0, nil, 0, errors.New("truncated zstd frame")
+		}
+		exp := uint(10 + data[pos]>>3)
+		window = 1<<exp + 1<<exp/8*uint64(data[pos]&7)
+		pos++
+	}
+	fcsSize := []int{0, 2, 4, 8}[desc>>6]
+	if fcsSize == 0 && singleSegment {
+		fcsSize = 1
+	}
+	if pos+fcsSize > len(data) {
+		return 0, nil, 0, errors.New("truncated zstd frame")
+	}
+	if singleSegment {
+		// the window of a single segment is the content size
+		for i := fcsSize - 1; i >= 0; i-- {
+			window = window<<8 | uint64(data[pos+i])
+		}
+		if fcsSize == 2 {
+			window += 256
+		}
+	}
+	pos += fcsSize
+	start, lastBlock := pos, -1
+	for lastBlock < 0 {
+		if pos+3 > len(data) {
+			return 0, nil, 0, errors.New("truncated zstd frame")
+		}
+		h := uint32(data[pos]) | uint32(data[pos+1])<<8 | uint32(data[pos+2])<<16
+		size := int(h >> 3)
+		switch h >> 1 & 3 {
+		case 1: // RLE
+			size = 1
+		case 3:
+			return 0, nil, 0, errors.New("reserved zstd block type")
+		}
+		if h&1 != 0 {
+			lastBlock = pos
+		}
+		if pos += 3 + size; pos > len(data) {
+			return 0, nil, 0, errors.New("truncated zstd frame")
+		}
+	}
+	return window, data[start:pos], lastBlock - start, nil
+}
+
+// appendRawBlocks appends data as uncompressed zstd blocks of at most blockSize bytes.
+func appendRawBlocks(dst, data []byte, blockSize int, final bool) []byte {
+	for {
+		n := len(data)
+		if n > blockSize {
+			n = blockSize
+		}
+		last := n == len(data)
+		h := uint32(n) << 3
+		if last && final {
+			h |= 1
+		}
+		dst = append(dst, byte(h), byte(h>>8), byte(h>>16))
+		dst, data = append(dst, data[:n]...), data[n:]
+		if last {
+			return dst
+		}
+	}
+}
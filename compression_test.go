@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	assertion "github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	assert := assertion.New(t)
+	data := bytes.Repeat([]byte(`{"ID":"0x0123","amount":"100"},`), 100)
+	for _, enc := range []string{CompressionSnappy, CompressionZstd, CompressionGzip} {
+		c, err := compressData(enc, data)
+		assert.NoError(err, enc)
+		assert.Less(len(c), len(data), enc)
+		prefix, _ := compressData(enc, []byte("["))
+		suffix, _ := compressData(enc, []byte("]"))
+		// concatenated streams
+		d, err := decompressData(enc, append(append(prefix, c...), suffix...))
+		assert.NoError(err, enc)
+		assert.Equal("["+string(data)+"]", string(d), enc)
+		assert.Equal(enc, compressionOfID(compressionID(enc)))
+	}
+	_, err := compressData("br", data)
+	assert.Error(err)
+	assert.Equal("", compressionOfID(0))
+	assert.Equal("", compressionOfID(100))
+}
+
+func TestWrapCompressed(t *testing.T) {
+	assert := assertion.New(t)
+	large := bytes.Repeat([]byte(`{"ID":"0x0123","amount":"100"},`), 10000)
+	for _, enc := range []string{CompressionZstd, CompressionGzip} {
+		for _, data := range [][]byte{nil, []byte("1"), large[:3000], large} {
+			for _, head := range [][]byte{[]byte(`{"result":`), large[:200000]} {
+				c, err := compressData(enc, data)
+				assert.NoError(err, enc)
+				body, err := wrapCompressed(enc, head, c, []byte("}"))
+				assert.NoError(err, enc)
+				expected := string(head) + string(data) + "}"
+				if enc == CompressionGzip {
+					r, err := gzip.NewReader(bytes.NewReader(body))
+					assert.NoError(err)
+					r.Multistream(false)
+					d, err := ioutil.ReadAll(r)
+					assert.NoError(err)
+					assert.Equal(expected, string(d), len(data))
+					assert.Equal(io.EOF, r.Reset(bytes.NewReader(nil)))
+				} else {
+					d, err := zstdDecoder.DecodeAll(body, nil)
+					assert.NoError(err)
+					assert.Equal(expected, string(d), len(data))
+					assert.Equal(1, bytes.Count(body, zstdMagic))
+				}
+			}
+		}
+	}
+
+	// gzip data not flushed by compressData
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(large)
+	_ = w.Close()
+	_, err := wrapCompressed(CompressionGzip, nil, buf.Bytes(), nil)
+	assert.Error(err)
+	_, err = wrapCompressed(CompressionZstd, nil, []byte("not zstd"), nil)
+	assert.Error(err)
+	c, _ := compressData(CompressionSnappy, large)
+	_, err = wrapCompressed(CompressionSnappy, nil, c, nil)
+	assert.Error(err)
+}
+
+func TestCRC32Combine(t *testing.T) {
+	assert := assertion.New(t)
+	data := []byte("0123456789abcdef0123456789abcdef0123456789")
+	for i := 0; i <= len(data); i++ {
+		assert.Equal(crc32.ChecksumIEEE(data), crc32Combine(crc32.ChecksumIEEE(data[:i]), crc32.ChecksumIEEE(data[i:]), int64(len(data)-i)), i)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert := assertion.New(t)
+	for _, c := range []struct {
+		header   string
+		accepted bool
+	}{
+		{"", false},
+		{"zstd", true},
+		{"gzip, ZSTD", true},
+		{"gzip, zstdx", false},
+		{"gzip;q=1.0, zstd;q=0.5", true},
+		{"zstd;q=0", false},
+		{"zstd; q=0.000", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"zstd;q=0, *", false},
+		{"gzip, *;q=0", false},
+		{"zstd;q=0.1, *;q=0", true},
+	} {
+		assert.Equal(c.accepted, acceptsEncoding([]byte(c.header), CompressionZstd), c.header)
+	}
+}
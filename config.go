@@ -5,48 +5,495 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net"
 	"net/url"
+	"runtime"
 	"sigs.k8s.io/yaml"
 	"sort"
 	"strings"
+	"time"
 )
 
+// CurrentConfigVersion is the schema version written by `config migrate`,
+// files without a version field are treated as version 0.
+const CurrentConfigVersion = 1
+
+// DefaultManageListen keeps the manage server off the network unless it's configured
+const DefaultManageListen = "127.0.0.1:8088"
+
 type Config struct {
-	LogLevel               string           `json:"logLevel"`
-	LogForceColors         bool             `json:"logForceColors"`
-	Debug                  bool             `json:"debug"`
-	AccessLog              bool             `json:"accessLog"`
-	Manage                 *ManageConfig    `json:"manage"`
-	Statistic              *StatisticConfig `json:"statistic"`
-	Upstreams              []string         `json:"upstreams"`
-	K8sServiceDiscovery    *K8sSDConfig     `json:"k8sServiceDiscovery"`
-	Listen                 string           `json:"listen"`
-	Path                   string           `json:"path"`
-	KeepAlive              string           `json:"keepAlive"`
-	UpstreamRequestTimeout Duration         `json:"upstreamRequestTimeout"`
-	ReadTimeout            Duration         `json:"readTimeout"`
-	WriteTimeout           Duration         `json:"writeTimeout"`
-	IdleTimeout            Duration         `json:"idleTimeout"`
-	ErrFor                 Duration         `json:"errFor"`
-	CacheConfigs           []*CacheConfig   `json:"cacheConfigs"`
+	Version                int                 `json:"version,omitempty"`
+	LogLevel               string              `json:"logLevel"`
+	LogForceColors         bool                `json:"logForceColors"`
+	Debug                  bool                `json:"debug"`
+	AccessLog              bool                `json:"accessLog"`
+	Manage                 *ManageConfig       `json:"manage"`
+	Statistic              *StatisticConfig    `json:"statistic"`
+	Upstreams              []string            `json:"upstreams"`
+	K8sServiceDiscovery    *K8sSDConfig        `json:"k8sServiceDiscovery"`
+	Listen                 string              `json:"listen"`
+	Path                   string              `json:"path"`
+	UpstreamRequestTimeout Duration            `json:"upstreamRequestTimeout"`
+	ReadTimeout            Duration            `json:"readTimeout"`
+	WriteTimeout           Duration            `json:"writeTimeout"`
+	IdleTimeout            Duration            `json:"idleTimeout"`
+	ErrFor                 Duration            `json:"errFor"`
+	Cache                  *CacheManagerConfig `json:"cache"`
+	CacheConfigs           []*CacheConfig      `json:"cacheConfigs"`
+	Warmup                 *WarmupConfig       `json:"warmup,omitempty"`
+	// Tip tracks the height of the chain tip for immutable rules
+	Tip *TipConfig `json:"tip,omitempty"`
+	// RefreshRate is the max number of refresh-ahead requests sent to upstream per second
+	RefreshRate int `json:"refreshRate,omitempty"`
+	// NegativeCache answers errors learned from upstream locally
+	NegativeCache *NegativeCacheConfig `json:"negativeCache,omitempty"`
+	// IgnoreCacheControl ignores Cache-Control of clients, they can't bypass the cache or ask for
+	// results younger than the rule TTL
+	IgnoreCacheControl bool `json:"ignoreCacheControl,omitempty"`
+	// CacheStatusItems lists the cache status of every request of a batch in X-Cache-Items
+	CacheStatusItems bool `json:"cacheStatusItems,omitempty"`
+	// RateLimit limits requests of every client, by IP or API key
+	RateLimit *RateLimitConfig `json:"rateLimit,omitempty"`
+	// Quota limits compute units spent by every client, by IP or API key
+	Quota *QuotaConfig `json:"quota,omitempty"`
+	// Auth authenticates clients by API keys
+	Auth *AuthConfig `json:"auth,omitempty"`
+	// UpstreamGroups serve API keys of their group instead of Upstreams
+	UpstreamGroups []*UpstreamGroupConfig `json:"upstreamGroups,omitempty"`
+	// MethodAccess allows or denies methods on Path
+	MethodAccess *MethodAccess `json:"methodAccess,omitempty"`
+	// Routes serve RPC requests at other paths
+	Routes []*RouteConfig `json:"routes,omitempty"`
+	// TrustedProxies are IPs or CIDR ranges of proxies whose X-Forwarded-For and X-Real-IP are honored
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// IPAccess allows or denies clients on Path
+	IPAccess *IPAccess `json:"ipAccess,omitempty"`
+	// Abuse detects abusive clients and throttles or bans them
+	Abuse *AbuseConfig `json:"abuse,omitempty"`
+	// Cors is the CORS policy of Path and routes without their own, any origin is allowed if it's nil
+	Cors *CorsConfig `json:"cors,omitempty"`
 }
 
 type ManageConfig struct {
 	Listen      string `json:"listen"`
 	Path        string `json:"path"`
 	MetricsPath string `json:"metricsPath"`
+	// IPAccess allows or denies clients of the manage API, metrics, health and debug handlers
+	IPAccess *IPAccess `json:"ipAccess,omitempty"`
+	// Cors is the CORS policy of the manage server, no CORS headers are sent if it's nil
+	Cors *CorsConfig `json:"cors,omitempty"`
 }
 
 type CacheConfig struct {
 	Methods []string `json:"methods"`
 	For     Duration `json:"for"`
 	ErrFor  Duration `json:"errFor"`
+	// Compression is one of snappy, zstd and gzip, results smaller than CompressMinSize are not compressed.
+	// Only gzip and zstd results are sent compressed.
+	Compression     string `json:"compression,omitempty"`
+	CompressMinSize int    `json:"compressMinSize,omitempty"`
+	// Canonical canonicalizes params for cache keys, so that equivalent params share the cache entry
+	Canonical []*CanonicalParam `json:"canonical,omitempty"`
+	// DefaultParams are removed from the end of params for cache keys if equal
+	DefaultParams []interface{} `json:"defaultParams,omitempty"`
+	// SkipEmpty skips caching null, and empty string, array and object results
+	SkipEmpty bool `json:"skipEmpty,omitempty"`
+	// MaxResultSize skips caching results larger than it in bytes
+	MaxResultSize int `json:"maxResultSize,omitempty"`
+	// Conditions pick results not cached or cached for another TTL, the first matched one is applied
+	Conditions []*CacheCondition `json:"conditions,omitempty"`
+	// Immutable marks results never changing, they are cached in the immutable tier for ImmutableTTL
+	Immutable *ImmutableConfig `json:"immutable,omitempty"`
+	// Jitter shortens TTL of every result by a random fraction up to Jitter, so that results cached
+	// in a burst don't expire together
+	Jitter float64 `json:"jitter,omitempty"`
+	// XFetchBeta enables probabilistic early recomputation of results, the larger the earlier,
+	// 1 is a good default
+	XFetchBeta float64 `json:"xfetchBeta,omitempty"`
+	// RefreshAhead refreshes hot results before they expire
+	RefreshAhead *RefreshAheadConfig `json:"refreshAhead,omitempty"`
+}
+
+// RefreshAheadConfig refreshes a cached result once it's hit at least Hits times and lived After
+// (a fraction) of its TTL.
+type RefreshAheadConfig struct {
+	Hits  int     `json:"hits"`
+	After float64 `json:"after"`
+}
+
+func (c *RefreshAheadConfig) SetDefaults() {
+	if c.Hits == 0 {
+		c.Hits = DefaultRefreshHits
+	}
+	if c.After == 0 {
+		c.After = DefaultRefreshAfter
+	}
 }
 
 func (cc *CacheConfig) Sort() {
 	sort.Strings(cc.Methods)
 }
 
+// shortestTTL is For shortened by the whole Jitter.
+func (cc *CacheConfig) shortestTTL() time.Duration {
+	return time.Duration(float64(cc.For.Duration) * (1 - cc.Jitter))
+}
+
+// CacheManagerConfig configures the storage of cache, how long every method is cached is
+// configured by CacheConfig.
+type CacheManagerConfig struct {
+	// Engine is one of "bigcache" and "lru". bigcache routes entries into tiers by their TTL,
+	// lru is a single cache with native TTL of every entry.
+	Engine string `json:"engine"`
+	// MemoryLimitMb is the total memory budget of cache. For bigcache tiers without sizeMb
+	// share what's left of it by their weight, at least 1MB each.
+	MemoryLimitMb int `json:"memoryLimitMb"`
+	// MaxEntrySize is the max size in bytes of a cached key and value, larger results are not cached.
+	MaxEntrySize int `json:"maxEntrySize"`
+	// Tiers are used by bigcache engine
+	Tiers []*CacheTierConfig `json:"tiers,omitempty"`
+	// Shards and CleanWindow are used by lru engine
+	Shards      int      `json:"shards,omitempty"`
+	CleanWindow Duration `json:"cleanWindow,omitempty"`
+	// Redis shares cache among proxy replicas
+	Redis *RedisCacheConfig `json:"redis,omitempty"`
+	// Disk persists long lived entries, so that they survive restarts
+	Disk *DiskCacheConfig `json:"disk,omitempty"`
+	// ImmutableSizeMb is the size of the tier of immutable results besides MemoryLimitMb, they are
+	// evicted only for space. It defaults to 64 if any cache rule is immutable.
+	ImmutableSizeMb int `json:"immutableSizeMb,omitempty"`
+}
+
+// WarmupConfig configures requests sent to upstream to fill the cache without client requests.
+type WarmupConfig struct {
+	// File is a JSONL file of JSON-RPC requests replayed at startup, the proxy is not ready until
+	// they are done or Timeout passed
+	File        string   `json:"file,omitempty"`
+	Timeout     Duration `json:"timeout"`
+	Concurrency int      `json:"concurrency"`
+	// BatchSize is the max number of requests sent in a batch
+	BatchSize int             `json:"batchSize"`
+	Warmers   []*WarmerConfig `json:"warmers,omitempty"`
+}
+
+// WarmerConfig re-issues a call periodically, so that its result never expires.
+type WarmerConfig struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+	// Ahead is how long before the cached result expires it's refreshed, defaults to 1/10 of its
+	// shortest TTL
+	Ahead Duration `json:"ahead,omitempty"`
+}
+
+// interval is how often the warmer refreshes the result cached by cc, Ahead before its shortest TTL.
+func (w *WarmerConfig) interval(cc *CacheConfig) time.Duration {
+	ttl := cc.shortestTTL()
+	ahead := w.Ahead.Duration
+	if ahead == 0 {
+		ahead = ttl / 10
+	}
+	return ttl - ahead
+}
+
+func (c *WarmupConfig) SetDefaults() {
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = 5 * time.Minute
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 4
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = 20
+	}
+}
+
+func (c *WarmupConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.Timeout.Duration < 0 {
+		errs.Add("warmup.timeout", "must not be negative")
+	}
+	if c.Concurrency < 0 {
+		errs.Add("warmup.concurrency", "must not be negative")
+	}
+	if c.BatchSize < 0 {
+		errs.Add("warmup.batchSize", "must not be negative")
+	}
+	for i, w := range c.Warmers {
+		p := fmt.Sprintf("warmup.warmers[%d]", i)
+		if w.Method == "" {
+			errs.Add(p+".method", "is empty")
+		}
+		if w.Ahead.Duration < 0 {
+			errs.Add(p+".ahead", "must not be negative")
+		}
+	}
+	return errs
+}
+
+type DiskCacheConfig struct {
+	Path      string `json:"path"`
+	MaxSizeMb int    `json:"maxSizeMb"`
+	// entries with TTL of at least MinTTL are persisted
+	MinTTL Duration `json:"minTTL"`
+	// CleanWindow is the interval of removing expired entries and compaction
+	CleanWindow Duration `json:"cleanWindow"`
+}
+
+func (c *DiskCacheConfig) SetDefaults() {
+	if c.Path == "" {
+		c.Path = "cache.db"
+	}
+	if c.MaxSizeMb == 0 {
+		c.MaxSizeMb = 1024
+	}
+	if c.MinTTL.Duration == 0 {
+		c.MinTTL.Duration = time.Hour
+	}
+	if c.CleanWindow.Duration == 0 {
+		c.CleanWindow.Duration = 10 * time.Minute
+	}
+}
+
+func (c *DiskCacheConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.MaxSizeMb < 0 {
+		errs.Add("cache.disk.maxSizeMb", "must not be negative")
+	}
+	if c.MinTTL.Duration < 0 {
+		errs.Add("cache.disk.minTTL", "must not be negative")
+	}
+	if c.CleanWindow.Duration < 0 {
+		errs.Add("cache.disk.cleanWindow", "must not be negative")
+	}
+	return errs
+}
+
+type RedisCacheConfig struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	DB       int    `json:"db"`
+	// KeyPrefix is prepended to every key, so that a redis could be shared with other services.
+	KeyPrefix string `json:"keyPrefix"`
+	// TwoLevel keeps a local cache in front of redis, otherwise local cache is only used
+	// when redis is unreachable.
+	TwoLevel    bool     `json:"twoLevel"`
+	PoolSize    int      `json:"poolSize"`
+	DialTimeout Duration `json:"dialTimeout"`
+	// Timeout of every read and write
+	Timeout Duration `json:"timeout"`
+	// RetryInterval is how long redis is considered down after an error
+	RetryInterval Duration `json:"retryInterval"`
+	// writes are sent in pipelines of at most PipelineLimit entries every PipelineWindow
+	PipelineWindow Duration `json:"pipelineWindow"`
+	PipelineLimit  int      `json:"pipelineLimit"`
+}
+
+func (c *RedisCacheConfig) SetDefaults() {
+	if c.KeyPrefix == "" {
+		c.KeyPrefix = "jrp:"
+	}
+	if c.PoolSize == 0 {
+		c.PoolSize = 10 * runtime.NumCPU()
+	}
+	if c.DialTimeout.Duration == 0 {
+		c.DialTimeout.Duration = time.Second
+	}
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = 100 * time.Millisecond
+	}
+	if c.RetryInterval.Duration == 0 {
+		c.RetryInterval.Duration = 5 * time.Second
+	}
+	if c.PipelineWindow.Duration == 0 {
+		c.PipelineWindow.Duration = time.Millisecond
+	}
+	if c.PipelineLimit == 0 {
+		c.PipelineLimit = 100
+	}
+}
+
+func (c *RedisCacheConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		errs.Wrap("cache.redis.addr", err)
+	}
+	if c.Timeout.Duration < 0 {
+		errs.Add("cache.redis.timeout", "must not be negative")
+	}
+	if c.PipelineLimit < 0 {
+		errs.Add("cache.redis.pipelineLimit", "must not be negative")
+	}
+	return errs
+}
+
+// CacheTierConfig configures a tier of cache, an entry is stored in the first tier
+// whose maxTTL is longer than the entry's TTL.
+type CacheTierConfig struct {
+	Name string `json:"name"`
+	// MaxTTL is the longest TTL of entries stored in this tier, 0 means unlimited.
+	MaxTTL      Duration `json:"maxTTL"`
+	SizeMb      int      `json:"sizeMb"`
+	Weight      int      `json:"weight"`
+	Shards      int      `json:"shards"`
+	CleanWindow Duration `json:"cleanWindow"`
+}
+
+const (
+	CacheEngineBigCache = "bigcache"
+	CacheEngineLRU      = "lru"
+
+	DefaultCacheMemoryLimitMb = 2048
+	DefaultCacheMaxEntrySize  = 512 * 1024
+	// the overhead of an entry in bigcache, includes the headers of bigcache and BigCacheTTL
+	bigCacheEntryOverhead = 18 + bigCacheTTLHeaderSize
+)
+
+// DefaultCacheTiers are the tiers used when none is configured.
+func DefaultCacheTiers() []*CacheTierConfig {
+	return []*CacheTierConfig{
+		{Name: "1m", MaxTTL: Duration{time.Minute}, SizeMb: 1024, Weight: 2, CleanWindow: Duration{50 * time.Second}},
+		{Name: "1h", MaxTTL: Duration{time.Hour}, SizeMb: 512, Weight: 1, CleanWindow: Duration{time.Minute}},
+		{Name: "solid", SizeMb: 512, Weight: 1},
+	}
+}
+
+func (c *CacheManagerConfig) SetDefaults() {
+	if c.Engine == "" {
+		c.Engine = CacheEngineBigCache
+	}
+	if c.MaxEntrySize == 0 {
+		c.MaxEntrySize = DefaultCacheMaxEntrySize
+	}
+	if c.Redis != nil {
+		c.Redis.SetDefaults()
+	}
+	if c.Disk != nil {
+		c.Disk.SetDefaults()
+	}
+	if c.Engine == CacheEngineLRU {
+		if c.MemoryLimitMb == 0 {
+			c.MemoryLimitMb = DefaultCacheMemoryLimitMb
+		}
+		if c.Shards == 0 {
+			c.Shards = calcShards(c.MemoryLimitMb, c.MaxEntrySize)
+		}
+		if c.CleanWindow.Duration == 0 {
+			c.CleanWindow.Duration = time.Minute
+		}
+		return
+	}
+	if len(c.Tiers) == 0 {
+		c.Tiers = DefaultCacheTiers()
+		if c.MemoryLimitMb > 0 {
+			for _, t := range c.Tiers {
+				t.SizeMb = 0
+			}
+		}
+	}
+	budget, weights := c.MemoryLimitMb, 0
+	for _, t := range c.Tiers {
+		if t.Weight == 0 {
+			t.Weight = 1
+		}
+		if t.SizeMb > 0 {
+			budget -= t.SizeMb
+		} else {
+			weights += t.Weight
+		}
+	}
+	for _, t := range c.Tiers {
+		// at least 1MB, the total exceeding memoryLimitMb is reported by Check
+		if t.SizeMb == 0 && budget > 0 {
+			if t.SizeMb = budget * t.Weight / weights; t.SizeMb == 0 {
+				t.SizeMb = 1
+			}
+		}
+		if t.Shards == 0 && t.SizeMb > 0 {
+			t.Shards = calcShards(t.SizeMb, c.MaxEntrySize)
+		}
+		if t.CleanWindow.Duration == 0 && t.MaxTTL.Duration > 0 {
+			t.CleanWindow.Duration = t.MaxTTL.Duration * 5 / 6
+			if t.CleanWindow.Duration > time.Minute {
+				t.CleanWindow.Duration = time.Minute
+			}
+		}
+	}
+}
+
+func (c *CacheManagerConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.MemoryLimitMb < 0 {
+		errs.Add("cache.memoryLimitMb", "must not be negative")
+	}
+	if c.MaxEntrySize < 0 {
+		errs.Add("cache.maxEntrySize", "must not be negative")
+	}
+	if c.ImmutableSizeMb < 0 {
+		errs.Add("cache.immutableSizeMb", "must not be negative")
+	}
+	if c.Redis != nil {
+		errs = append(errs, c.Redis.Check()...)
+	}
+	if c.Disk != nil {
+		errs = append(errs, c.Disk.Check()...)
+	}
+	switch c.Engine {
+	case CacheEngineBigCache:
+	case CacheEngineLRU:
+		if len(c.Tiers) > 0 {
+			errs.Add("cache.tiers", "tiers are only used by %s engine", CacheEngineBigCache)
+		}
+		if c.Shards <= 0 || c.Shards&(c.Shards-1) != 0 {
+			errs.Add("cache.shards", "must be a power of two")
+		} else if shardSize := c.MemoryLimitMb * 1024 * 1024 / c.Shards; c.MaxEntrySize+lruEntryOverhead > shardSize {
+			errs.Add("cache.shards", "shard size %d bytes is smaller than cache.maxEntrySize %d, use less shards", shardSize, c.MaxEntrySize)
+		}
+		return errs
+	default:
+		errs.Add("cache.engine", "unknown engine %q, should be one of %s and %s", c.Engine, CacheEngineBigCache, CacheEngineLRU)
+	}
+	names := map[string]bool{}
+	unlimited, total := 0, 0
+	for i, t := range c.Tiers {
+		p := fmt.Sprintf("cache.tiers[%d]", i)
+		if t.Name == "" {
+			errs.Add(p+".name", "is empty")
+		} else if names[t.Name] {
+			errs.Add(p+".name", "duplicated tier %q", t.Name)
+		}
+		names[t.Name] = true
+		if t.MaxTTL.Duration < 0 {
+			errs.Add(p+".maxTTL", "must not be negative")
+		} else if t.MaxTTL.Duration == 0 {
+			unlimited++
+		}
+		if t.SizeMb == 0 && c.MemoryLimitMb > 0 {
+			errs.Add(p+".sizeMb", "nothing is left of cache.memoryLimitMb %dMB after the sized tiers", c.MemoryLimitMb)
+			continue
+		} else if t.SizeMb <= 0 {
+			errs.Add(p+".sizeMb", "must be positive, or set cache.memoryLimitMb to size it automatically")
+			continue
+		}
+		total += t.SizeMb
+		if t.Shards <= 0 || t.Shards&(t.Shards-1) != 0 {
+			errs.Add(p+".shards", "must be a power of two")
+		} else if shardSize := t.SizeMb * 1024 * 1024 / t.Shards; c.MaxEntrySize+bigCacheEntryOverhead > shardSize {
+			errs.Add(p+".shards", "shard size %d bytes is smaller than cache.maxEntrySize %d, use less shards", shardSize, c.MaxEntrySize)
+		}
+		if t.CleanWindow.Duration < 0 {
+			errs.Add(p+".cleanWindow", "must not be negative")
+		}
+	}
+	if unlimited > 1 {
+		errs.Add("cache.tiers", "only one tier could have unlimited maxTTL")
+	}
+	if c.MemoryLimitMb > 0 && total > c.MemoryLimitMb {
+		errs.Add("cache.tiers", "total size %dMB exceeds cache.memoryLimitMb %dMB", total, c.MemoryLimitMb)
+	}
+	return errs
+}
+
 type K8sSDConfig struct {
 	Namespace string `json:"namespace"`
 	Name      string `json:"name"`
@@ -58,18 +505,129 @@ type StatisticConfig struct {
 }
 
 func LoadConfig(path string) (conf *Config, err error) {
-	content, err := ioutil.ReadFile(path)
+	conf, err = readConfig(path)
 	if err != nil {
 		return
 	}
-	conf = new(Config)
-	err = yaml.UnmarshalStrict(content, conf)
+	if errs := conf.ResolveSecrets(); len(errs) > 0 {
+		return nil, errs
+	}
 	for _, c := range conf.CacheConfigs {
 		c.Sort()
 	}
 	return
 }
 
+// readConfig loads config with environment overrides and defaults applied, secret references are
+// left unresolved and the order of values is kept as they are in file.
+func readConfig(path string) (conf *Config, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	content, version, err := migrateConfig(content)
+	if err != nil {
+		return
+	}
+	if version < CurrentConfigVersion {
+		log.Warnf("config %s is in legacy version %d, run `jsonrpc-proxy config migrate` to upgrade it", path, version)
+	}
+	return parseConfig(content)
+}
+
+func parseConfig(content []byte) (*Config, error) {
+	conf := new(Config)
+	if err := yaml.UnmarshalStrict(content, conf); err != nil {
+		return nil, err
+	}
+	if err := conf.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	conf.SetDefaults()
+	return conf, nil
+}
+
+// SetDefaults fills the fields left empty in config file with their default values.
+func (c *Config) SetDefaults() {
+	if c.Version == 0 {
+		c.Version = CurrentConfigVersion
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.UpstreamRequestTimeout.Duration == 0 {
+		c.UpstreamRequestTimeout.Duration = DefaultReadTimeout
+	}
+	if c.Manage == nil {
+		c.Manage = &ManageConfig{}
+	}
+	if c.Manage.Listen == "" {
+		c.Manage.Listen = DefaultManageListen
+	}
+	if c.Manage.Path == "" {
+		c.Manage.Path = "/manage"
+	}
+	if c.Manage.MetricsPath == "" {
+		c.Manage.MetricsPath = "/metrics"
+	}
+	if c.Statistic == nil {
+		c.Statistic = &StatisticConfig{}
+	}
+	if c.Cache == nil {
+		c.Cache = &CacheManagerConfig{}
+	}
+	c.Cache.SetDefaults()
+	for _, cc := range c.CacheConfigs {
+		if cc.Compression != "" && cc.CompressMinSize == 0 {
+			cc.CompressMinSize = DefaultCompressMinSize
+		}
+		if cc.Immutable != nil && c.Cache.ImmutableSizeMb == 0 {
+			c.Cache.ImmutableSizeMb = DefaultImmutableSizeMb
+		}
+		if cc.RefreshAhead != nil {
+			cc.RefreshAhead.SetDefaults()
+			if c.RefreshRate == 0 {
+				c.RefreshRate = DefaultRefreshRate
+			}
+		}
+	}
+	if c.Warmup != nil {
+		c.Warmup.SetDefaults()
+	}
+	if c.Tip != nil {
+		c.Tip.SetDefaults()
+	}
+	if c.NegativeCache != nil {
+		c.NegativeCache.SetDefaults()
+	}
+	if c.RateLimit != nil {
+		c.RateLimit.SetDefaults()
+	}
+	if c.Quota != nil {
+		c.Quota.SetDefaults()
+	}
+	if c.Auth != nil {
+		c.Auth.SetDefaults()
+	}
+	if c.Abuse != nil {
+		c.Abuse.SetDefaults()
+	}
+	if c.Cors != nil {
+		c.Cors.SetDefaults()
+	}
+	if c.Manage.Cors != nil {
+		c.Manage.Cors.SetDefaults()
+	}
+	for _, r := range c.Routes {
+		if r.Cors != nil {
+			r.Cors.SetDefaults()
+		}
+	}
+}
+
 func (c *Config) Search(method string) *CacheConfig {
 	for _, cc := range c.CacheConfigs {
 		i := sort.SearchStrings(cc.Methods, method)
@@ -80,6 +638,18 @@ func (c *Config) Search(method string) *CacheConfig {
 	return nil
 }
 
+// findCacheConfig is Search without requiring methods to be sorted.
+func (c *Config) findCacheConfig(method string) *CacheConfig {
+	for _, cc := range c.CacheConfigs {
+		for _, m := range cc.Methods {
+			if m == method {
+				return cc
+			}
+		}
+	}
+	return nil
+}
+
 func validateListen(l string) error {
 	if strings.Index(l, "://") == -1 {
 		l = "http://" + l
@@ -94,22 +664,250 @@ func validateListen(l string) error {
 	return nil
 }
 
-func (c Config) Validate() error {
-	err := validateListen(c.Listen)
+// ConfigError is a problem found in config, Path is the YAML path of the offending value.
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+type ConfigErrors []*ConfigError
+
+func (es *ConfigErrors) Add(path string, format string, args ...interface{}) {
+	*es = append(*es, &ConfigError{Path: path, Err: fmt.Errorf(format, args...)})
+}
+
+func (es *ConfigErrors) Wrap(path string, err error) {
 	if err != nil {
-		return errors.Wrap(err, "config.listen address is not valid")
+		*es = append(*es, &ConfigError{Path: path, Err: err})
 	}
-	if !strings.HasPrefix(c.Path, "/") {
-		return errors.New("config.path is not valid")
+}
+
+func (es ConfigErrors) Error() string {
+	s := make([]string, len(es))
+	for i, e := range es {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Check reports every structural problem of config instead of stopping at the first one.
+func (c Config) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.Version > CurrentConfigVersion {
+		errs.Add("version", "unsupported config version %d, newest known is %d", c.Version, CurrentConfigVersion)
 	}
-	if c.Manage.Path != "" && !strings.HasPrefix(c.Manage.Path, "/") {
-		return errors.New("config.manage.Path is not valid")
+	if _, err := log.ParseLevel(strings.ToLower(c.LogLevel)); err != nil {
+		errs.Add("logLevel", "invalid log level %q", c.LogLevel)
 	}
-	if c.Manage.MetricsPath != "" && !strings.HasPrefix(c.Manage.MetricsPath, "/") {
-		return errors.New("config.manage.metricsPath is not valid")
+	errs.Wrap("listen", validateListen(c.Listen))
+	if !strings.HasPrefix(c.Path, "/") {
+		errs.Add("path", "must start with '/'")
+	}
+	if c.Manage != nil {
+		if c.Manage.Listen != "" {
+			errs.Wrap("manage.listen", validateListen(c.Manage.Listen))
+		}
+		if c.Manage.Path != "" && !strings.HasPrefix(c.Manage.Path, "/") {
+			errs.Add("manage.path", "must start with '/'")
+		}
+		if c.Manage.MetricsPath != "" && !strings.HasPrefix(c.Manage.MetricsPath, "/") {
+			errs.Add("manage.metricsPath", "must start with '/'")
+		}
+		if c.Manage.IPAccess != nil {
+			c.Manage.IPAccess.check("manage.ipAccess", &errs)
+		}
+		if c.Manage.Cors != nil {
+			c.Manage.Cors.check("manage.cors", &errs)
+		}
 	}
 	if len(c.Upstreams) == 0 {
-		return errors.New("config.upstreams is empty")
+		errs.Add("upstreams", "is empty")
+	}
+	for i, u := range c.Upstreams {
+		if secretRefRe.MatchString(u) {
+			// unresolved
+			continue
+		}
+		if p, err := url.Parse(u); err != nil {
+			errs.Wrap(fmt.Sprintf("upstreams[%d]", i), err)
+		} else if p.Scheme != "http" && p.Scheme != "https" || p.Host == "" {
+			errs.Add(fmt.Sprintf("upstreams[%d]", i), "invalid upstream url %q", u)
+		}
+	}
+	if c.UpstreamRequestTimeout.Duration < 0 {
+		errs.Add("upstreamRequestTimeout", "must not be negative")
+	}
+	if c.Cache != nil {
+		errs = append(errs, c.Cache.Check()...)
+	}
+	for i, cc := range c.CacheConfigs {
+		p := fmt.Sprintf("cacheConfigs[%d]", i)
+		if len(cc.Methods) == 0 {
+			errs.Add(p+".methods", "is empty")
+		}
+		if cc.For.Duration < 0 {
+			errs.Add(p+".for", "must not be negative")
+		}
+		if cc.ErrFor.Duration < 0 {
+			errs.Add(p+".errFor", "must not be negative")
+		}
+		if cc.Compression != "" && !isValidCompression(cc.Compression) {
+			errs.Add(p+".compression", "unknown compression %q, should be one of %s, %s and %s",
+				cc.Compression, CompressionSnappy, CompressionZstd, CompressionGzip)
+		}
+		if cc.CompressMinSize < 0 {
+			errs.Add(p+".compressMinSize", "must not be negative")
+		}
+		for j, c := range cc.Canonical {
+			cp := fmt.Sprintf("%s.canonical[%d]", p, j)
+			if c.Param < 0 {
+				errs.Add(cp+".param", "must not be negative")
+			}
+			if canonicalizers[c.As] == nil {
+				errs.Add(cp+".as", "unknown canonicalizer %q", c.As)
+			}
+		}
+		if cc.MaxResultSize < 0 {
+			errs.Add(p+".maxResultSize", "must not be negative")
+		}
+		for j, cond := range cc.Conditions {
+			cp := fmt.Sprintf("%s.conditions[%d]", p, j)
+			if cond.Path == "" {
+				errs.Add(cp+".path", "is empty")
+			}
+			if cond.For.Duration < 0 {
+				errs.Add(cp+".for", "must not be negative")
+			}
+			if cond.Skip && cond.For.Duration > 0 {
+				errs.Add(cp+".for", "must not be given with skip")
+			}
+		}
+		if im := cc.Immutable; im != nil {
+			if im.HeightParam == nil && len(im.Conditions) == 0 {
+				errs.Add(p+".immutable", "heightParam or conditions is required")
+			}
+			if im.HeightParam != nil && *im.HeightParam < 0 {
+				errs.Add(p+".immutable.heightParam", "must not be negative")
+			}
+			if im.HeightParam != nil && c.Tip == nil {
+				errs.Add(p+".immutable.heightParam", "tip is required to track the height of the chain")
+			}
+			for j, cond := range im.Conditions {
+				cp := fmt.Sprintf("%s.immutable.conditions[%d]", p, j)
+				if cond.Path == "" {
+					errs.Add(cp+".path", "is empty")
+				}
+				if cond.Skip || cond.For.Duration != 0 {
+					errs.Add(cp, "only path and equals are used")
+				}
+			}
+		}
+		if cc.Jitter < 0 || cc.Jitter >= 1 {
+			errs.Add(p+".jitter", "must be in [0, 1)")
+		}
+		if cc.XFetchBeta < 0 {
+			errs.Add(p+".xfetchBeta", "must not be negative")
+		}
+		if r := cc.RefreshAhead; r != nil {
+			if r.Hits < 0 {
+				errs.Add(p+".refreshAhead.hits", "must not be negative")
+			}
+			if r.After <= 0 || r.After >= 1 {
+				errs.Add(p+".refreshAhead.after", "must be between 0 and 1")
+			}
+		}
+	}
+	if c.Tip != nil {
+		errs = append(errs, c.Tip.Check()...)
+	}
+	if c.NegativeCache != nil {
+		errs = append(errs, c.NegativeCache.Check()...)
+	}
+	if c.RateLimit != nil {
+		errs = append(errs, c.RateLimit.Check()...)
+		if c.RateLimit.By == RateLimitByHeader && c.Auth == nil {
+			errs.Add("rateLimit.by", "header requires auth, unauthenticated keys are not trusted")
+		}
+	}
+	if c.Quota != nil {
+		errs = append(errs, c.Quota.Check()...)
+		if c.Quota.By == RateLimitByHeader && c.Auth == nil {
+			errs.Add("quota.by", "header requires auth, unauthenticated keys are not trusted")
+		}
+	}
+	if c.Auth != nil {
+		errs = append(errs, c.Auth.Check(c.UpstreamGroups)...)
+	}
+	if c.Abuse != nil {
+		errs = append(errs, c.Abuse.Check()...)
+	}
+	groups := map[string]bool{}
+	for i, g := range c.UpstreamGroups {
+		p := fmt.Sprintf("upstreamGroups[%d]", i)
+		if g.Name == "" {
+			errs.Add(p+".name", "is empty")
+		} else if groups[g.Name] {
+			errs.Add(p+".name", "duplicated group %s", g.Name)
+		}
+		groups[g.Name] = true
+		if len(g.Upstreams) == 0 {
+			errs.Add(p+".upstreams", "is empty")
+		}
+	}
+	if c.MethodAccess != nil {
+		c.MethodAccess.check("methodAccess", &errs)
+	}
+	checkIPNets("trustedProxies", c.TrustedProxies, &errs)
+	if c.IPAccess != nil {
+		c.IPAccess.check("ipAccess", &errs)
+	}
+	if c.Cors != nil {
+		c.Cors.check("cors", &errs)
+	}
+	paths := map[string]bool{c.Path: true}
+	for i, r := range c.Routes {
+		p := fmt.Sprintf("routes[%d]", i)
+		if !strings.HasPrefix(r.Path, "/") {
+			errs.Add(p+".path", "must start with '/'")
+		} else if paths[r.Path] {
+			errs.Add(p+".path", "duplicated path %s", r.Path)
+		}
+		paths[r.Path] = true
+		if r.MethodAccess != nil {
+			r.MethodAccess.check(p+".methodAccess", &errs)
+		}
+		if r.IPAccess != nil {
+			r.IPAccess.check(p+".ipAccess", &errs)
+		}
+		if r.Cors != nil {
+			r.Cors.check(p+".cors", &errs)
+		}
+	}
+	if c.RefreshRate < 0 {
+		errs.Add("refreshRate", "must not be negative")
+	}
+	if c.Warmup != nil {
+		errs = append(errs, c.Warmup.Check()...)
+		for i, w := range c.Warmup.Warmers {
+			p := fmt.Sprintf("warmup.warmers[%d]", i)
+			cc := c.findCacheConfig(w.Method)
+			if cc == nil || cc.For.Duration <= 0 {
+				errs.Add(p+".method", "method %q is not cached", w.Method)
+			} else if w.interval(cc) <= 0 {
+				errs.Add(p+".ahead", "must be shorter than %s, the shortest TTL of %s with jitter", cc.shortestTTL(), w.Method)
+			}
+		}
+	}
+	return errs
+}
+
+func (c Config) Validate() error {
+	if errs := c.Check(); len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
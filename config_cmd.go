@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+)
+
+// ZilliqaMethods are the methods of Zilliqa JSON-RPC API, `config check` reports
+// methods of cache rules that are not in this list.
+// ref: https://dev.zilliqa.com/docs/apis/api-introduction
+var ZilliqaMethods = []string{
+	// blockchain
+	"DSBlockListing",
+	"GetBlockchainInfo",
+	"GetCurrentDSEpoch",
+	"GetCurrentMiniEpoch",
+	"GetDSBlockRate",
+	"GetDsBlock",
+	"GetLatestDsBlock",
+	"GetLatestTxBlock",
+	"GetMinerInfo",
+	"GetNetworkId",
+	"GetNumDSBlocks",
+	"GetNumTransactions",
+	"GetNumTxBlocks",
+	"GetPrevDSDifficulty",
+	"GetPrevDifficulty",
+	"GetTotalCoinSupply",
+	"GetTransactionRate",
+	"GetTxBlock",
+	"GetTxBlockRate",
+	"TxBlockListing",
+	// transaction
+	"CreateTransaction",
+	"GetMinimumGasPrice",
+	"GetNumTxnsDSEpoch",
+	"GetNumTxnsTxEpoch",
+	"GetPendingTxn",
+	"GetPendingTxns",
+	"GetRecentTransactions",
+	"GetTransaction",
+	"GetTransactionStatus",
+	"GetTransactionsForTxBlock",
+	"GetTransactionsForTxBlockEx",
+	"GetTxnBodiesForTxBlock",
+	"GetTxnBodiesForTxBlockEx",
+	// contract
+	"GetContractAddressFromTransactionID",
+	"GetSmartContractCode",
+	"GetSmartContractInit",
+	"GetSmartContractState",
+	"GetSmartContractSubState",
+	"GetSmartContracts",
+	"GetStateProof",
+	// account
+	"GetBalance",
+}
+
+func newConfigCmd(path *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "check, print or migrate the config file",
+	}
+	cmd.AddCommand(newConfigCheckCmd(path), newConfigPrintCmd(path), newConfigMigrateCmd(path))
+	return cmd
+}
+
+func newConfigCheckCmd(path *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "check",
+		Short:        "report every error of the config file with its YAML path, exits non-zero if any",
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	methods := flags.StringSlice("method", nil, "extra method names to be treated as known")
+	skipMethods := flags.Bool("skip-methods", false, "do not check method names of cache rules")
+	bind := flags.Bool("bind", false, "try binding the listen addresses")
+	skipSecrets := flags.Bool("skip-secrets", false, "do not resolve ${env:NAME} and ${file:/path} references")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		known := map[string]bool{}
+		if !*skipMethods {
+			for _, m := range append(ZilliqaMethods, *methods...) {
+				known[m] = true
+			}
+		}
+		errs, err := checkConfigFile(*path, known, *bind, !*skipSecrets)
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		for _, e := range errs {
+			_, _ = fmt.Fprintln(out, e.Error())
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("found %d error(s) in %s", len(errs), *path)
+		}
+		_, _ = fmt.Fprintf(out, "%s is valid\n", *path)
+		return nil
+	}
+	return cmd
+}
+
+func newConfigPrintCmd(path *string) *cobra.Command {
+	return &cobra.Command{
+		Use:     "print",
+		Aliases: []string{"print-effective"},
+		Short:   "print the effective config with environment overrides and defaults applied",
+		Long: "Print the effective config with environment overrides and defaults applied.\n" +
+			"Secret references like ${env:NAME} and ${file:/path} are printed as they are.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conf, err := readConfig(*path)
+			if err != nil {
+				return err
+			}
+			out, err := yaml.Marshal(conf)
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(out)
+			return err
+		},
+	}
+}
+
+func newConfigMigrateCmd(path *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "rewrite a legacy config file into the newest schema",
+		Long: "Rewrite a legacy config file into the newest schema and print it.\n" +
+			"Note that comments and the order of keys are not preserved.",
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	write := flags.BoolP("write", "w", false, "write result back to the config file, the original is kept as <file>.bak")
+	output := flags.StringP("output", "o", "", "write result to this file instead of stdout")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		content, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return err
+		}
+		migrated, version, err := migrateConfig(content)
+		if err != nil {
+			return err
+		}
+		if _, err := parseConfig(migrated); err != nil {
+			return errors.Wrap(err, "migrated config is invalid")
+		}
+		if version >= CurrentConfigVersion {
+			_, _ = fmt.Fprintf(cmd.ErrOrStderr(), "%s is already in version %d\n", *path, version)
+		}
+		switch {
+		case *write:
+			if version >= CurrentConfigVersion {
+				return nil
+			}
+			if err := ioutil.WriteFile(*path+".bak", content, 0644); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(*path, migrated, 0644)
+		case *output != "":
+			return ioutil.WriteFile(*output, migrated, 0644)
+		default:
+			_, err = cmd.OutOrStdout().Write(migrated)
+			return err
+		}
+	}
+	return cmd
+}
+
+// checkConfigFile returns the problems found in config file, the error is only returned when the
+// file cannot be checked at all.
+func checkConfigFile(path string, knownMethods map[string]bool, bind, secrets bool) (ConfigErrors, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content, _, err = migrateConfig(content)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	var errs ConfigErrors
+	checkFields(&errs, "", doc, reflect.TypeOf(Config{}))
+	if len(errs) > 0 {
+		// the same errors would be reported once more by the decoder
+		return errs, nil
+	}
+	conf, err := parseConfig(content)
+	if err != nil {
+		errs.Wrap("(root)", err)
+		return errs, nil
+	}
+	if secrets {
+		errs = append(errs, conf.ResolveSecrets()...)
+	}
+	errs = append(errs, conf.Check()...)
+	if len(knownMethods) > 0 {
+		errs = append(errs, checkCacheMethods(conf, knownMethods)...)
+	}
+	errs = append(errs, checkCacheOverlaps(conf)...)
+	errs = append(errs, checkListenAddrs(conf, bind)...)
+	return errs, nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkFields reports the keys of doc that are unknown to type t and the values that
+// cannot be decoded into their field.
+func checkFields(errs *ConfigErrors, path string, doc interface{}, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if doc == nil {
+		return
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		checkValue(errs, path, doc, t)
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			errs.Add(path, "expect an object, got %v", doc)
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fields[name] = f.Type
+		}
+		for _, k := range sortedKeys(m) {
+			p := joinConfigPath(path, k)
+			ft, ok := fields[k]
+			if !ok {
+				errs.Add(p, "unknown field")
+				continue
+			}
+			checkFields(errs, p, m[k], ft)
+		}
+	case reflect.Slice, reflect.Array:
+		s, ok := doc.([]interface{})
+		if !ok {
+			errs.Add(path, "expect a list, got %v", doc)
+			return
+		}
+		for i, v := range s {
+			checkFields(errs, fmt.Sprintf("%s[%d]", path, i), v, t.Elem())
+		}
+	case reflect.Map:
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			errs.Add(path, "expect an object, got %v", doc)
+			return
+		}
+		for _, k := range sortedKeys(m) {
+			checkFields(errs, joinConfigPath(path, k), m[k], t.Elem())
+		}
+	default:
+		checkValue(errs, path, doc, t)
+	}
+}
+
+func checkValue(errs *ConfigErrors, path string, doc interface{}, t reflect.Type) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		errs.Wrap(path, err)
+		return
+	}
+	if err := json.Unmarshal(data, reflect.New(t).Interface()); err != nil {
+		errs.Add(path, "invalid value %s: %s", data, err)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// checkCacheMethods reports the methods of cache rules that are not known.
+func checkCacheMethods(c *Config, known map[string]bool) ConfigErrors {
+	var errs ConfigErrors
+	for i, cc := range c.CacheConfigs {
+		for j, m := range cc.Methods {
+			if !known[m] {
+				errs.Add(fmt.Sprintf("cacheConfigs[%d].methods[%d]", i, j), "unknown method %q", m)
+			}
+		}
+	}
+	return errs
+}
+
+// checkCacheOverlaps reports methods covered by more than one cache rule, only the first rule
+// of a method takes effect.
+func checkCacheOverlaps(c *Config) ConfigErrors {
+	var errs ConfigErrors
+	seen := map[string]string{}
+	for i, cc := range c.CacheConfigs {
+		for j, m := range cc.Methods {
+			p := fmt.Sprintf("cacheConfigs[%d].methods[%d]", i, j)
+			if prev, ok := seen[m]; ok {
+				errs.Add(p, "method %q is already cached by %s, this rule never takes effect", m, prev)
+				continue
+			}
+			seen[m] = p
+		}
+	}
+	return errs
+}
+
+func checkListenAddrs(c *Config, bind bool) ConfigErrors {
+	var errs ConfigErrors
+	checked := map[string]bool{}
+	for _, l := range []struct{ path, addr string }{{"listen", c.Listen}, {"manage.listen", c.Manage.Listen}} {
+		host := GetHostFromUrl(l.addr)
+		if host == "" || checked[host] {
+			continue
+		}
+		checked[host] = true
+		errs.Wrap(l.path, checkListenAddr(host, bind))
+	}
+	return errs
+}
+
+// checkListenAddr makes sure the host of addr is resolved to an address of this machine.
+func checkListenAddr(addr string, bind bool) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return errors.Wrapf(err, "cannot resolve %s", host)
+		}
+		local, err := localIPs()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, ip := range ips {
+			if ip.IsUnspecified() || ip.IsLoopback() || local[ip.String()] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not an address of any local interface", host)
+		}
+	}
+	if bind {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		_ = l.Close()
+	}
+	return nil
+}
+
+func localIPs() (map[string]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := map[string]bool{}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			ips[n.IP.String()] = true
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// ConfigEnvPrefix is the prefix of environment variables overriding config fields.
+// The name of the variable is the YAML path of the field in upper case joined by '_',
+// e.g. JRP_UPSTREAMREQUESTTIMEOUT=5s, JRP_MANAGE_LISTEN=0.0.0.0:8088, JRP_UPSTREAMS=http://a,http://b.
+// Lists and objects are given as YAML or JSON, lists of strings may also be comma separated.
+const ConfigEnvPrefix = "JRP_"
+
+// ApplyEnv overrides fields of config with environment variables.
+func (c *Config) ApplyEnv() error {
+	return applyEnv(reflect.ValueOf(c).Elem(), strings.TrimSuffix(ConfigEnvPrefix, "_"), "", os.Environ())
+}
+
+func applyEnv(v reflect.Value, name, path string, environ []string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		fName := name + "_" + strings.ToUpper(tag)
+		fPath := joinConfigPath(path, tag)
+		if isConfigStruct(fv.Type()) {
+			if fv.Kind() == reflect.Ptr {
+				if !hasEnvPrefix(environ, fName+"_") {
+					continue
+				}
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if err := applyEnv(fv, fName, fPath, environ); err != nil {
+				return err
+			}
+			continue
+		}
+		val, ok := os.LookupEnv(fName)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fv, val); err != nil {
+			return errors.Wrapf(err, "invalid value of %s for %s", fName, fPath)
+		}
+	}
+	return nil
+}
+
+// isConfigStruct tells whether fields of t could be overridden one by one.
+func isConfigStruct(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(jsonUnmarshalerType)
+}
+
+func hasEnvPrefix(environ []string, prefix string) bool {
+	for _, e := range environ {
+		if strings.HasPrefix(e, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func setFromEnv(v reflect.Value, val string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(val)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(val), "["):
+		s := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, e := range strings.Split(val, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				s = reflect.Append(s, reflect.ValueOf(e).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	n := reflect.New(v.Type())
+	if err := yaml.UnmarshalStrict([]byte(val), n.Interface()); err != nil {
+		return err
+	}
+	v.Set(n.Elem())
+	return nil
+}
+
+var secretRefRe = regexp.MustCompile(`\$\{(env|file):([^}]+)}`)
+
+// resolveSecretRefs replaces `${env:NAME}` with the value of environment variable NAME
+// and `${file:/path}` with the content of the file, without the trailing new line.
+func resolveSecretRefs(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	s = secretRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+		m := secretRefRe.FindStringSubmatch(ref)
+		switch m[1] {
+		case "env":
+			val, ok := os.LookupEnv(m[2])
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s is not set", m[2])
+			}
+			return val
+		default:
+			content, e := ioutil.ReadFile(m[2])
+			if e != nil && err == nil {
+				err = e
+			}
+			return strings.TrimRight(string(content), "\r\n")
+		}
+	})
+	return s, err
+}
+
+// ResolveSecrets resolves the secret references in every string of config.
+func (c *Config) ResolveSecrets() ConfigErrors {
+	return resolveSecretsIn(reflect.ValueOf(c).Elem(), "")
+}
+
+// resolveSecretsIn resolves the secret references in every string of v at path.
+func resolveSecretsIn(v reflect.Value, path string) ConfigErrors {
+	var errs ConfigErrors
+	walkConfigStrings(v, path, func(path string, s string) string {
+		r, err := resolveSecretRefs(s)
+		errs.Wrap(path, err)
+		return r
+	})
+	return errs
+}
+
+// walkConfigStrings calls fn with every string in v and replaces the string with its result.
+func walkConfigStrings(v reflect.Value, path string, fn func(path string, s string) string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			walkConfigStrings(v.Elem(), path, fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if tag == "" || tag == "-" || !v.Field(i).CanSet() {
+				continue
+			}
+			walkConfigStrings(v.Field(i), joinConfigPath(path, tag), fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walkConfigStrings(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			for _, k := range v.MapKeys() {
+				walkConfigStrings(v.MapIndex(k), joinConfigPath(path, fmt.Sprint(k)), fn)
+			}
+			return
+		}
+		for _, k := range v.MapKeys() {
+			s := fn(joinConfigPath(path, fmt.Sprint(k)), v.MapIndex(k).String())
+			v.SetMapIndex(k, reflect.ValueOf(s).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(fn(path, v.String()))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+	"time"
+)
+
+// configMigration upgrades a config document by exactly one version.
+type configMigration func(doc map[string]interface{}) error
+
+// configMigrations is keyed by the version a migration upgrades from.
+var configMigrations = map[int]configMigration{
+	0: migrateConfigV0,
+}
+
+// migrateConfigV0 upgrades unversioned config files:
+//   - removes `keepAlive`, which has never been used by the proxy
+//   - rewrites durations given as integer nanoseconds to duration strings
+func migrateConfigV0(doc map[string]interface{}) error {
+	delete(doc, "keepAlive")
+	for _, k := range []string{"upstreamRequestTimeout", "readTimeout", "writeTimeout", "idleTimeout", "errFor"} {
+		normalizeDuration(doc, k)
+	}
+	if ccs, ok := doc["cacheConfigs"].([]interface{}); ok {
+		for _, cc := range ccs {
+			if m, ok := cc.(map[string]interface{}); ok {
+				normalizeDuration(m, "for")
+				normalizeDuration(m, "errFor")
+			}
+		}
+	}
+	return nil
+}
+
+func normalizeDuration(doc map[string]interface{}, key string) {
+	if n, ok := doc[key].(float64); ok {
+		doc[key] = time.Duration(n).String()
+	}
+}
+
+func configVersion(doc map[string]interface{}) (int, error) {
+	switch v := doc["version"].(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		if v != float64(int(v)) {
+			return 0, fmt.Errorf("invalid config version %v", v)
+		}
+		return int(v), nil
+	default:
+		return 0, fmt.Errorf("invalid config version %v", v)
+	}
+}
+
+// migrateConfig upgrades content to CurrentConfigVersion, the returned version is the one
+// content was written in. Content which is already up to date is returned untouched.
+func migrateConfig(content []byte) ([]byte, int, error) {
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, 0, err
+	}
+	version, err := configVersion(doc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version >= CurrentConfigVersion {
+		return content, version, nil
+	}
+	for v := version; v < CurrentConfigVersion; v++ {
+		if err := configMigrations[v](doc); err != nil {
+			return nil, version, errors.Wrapf(err, "migrating config from version %d", v)
+		}
+		doc["version"] = v + 1
+	}
+	content, err = yaml.Marshal(doc)
+	return content, version, err
+}
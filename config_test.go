@@ -3,7 +3,12 @@ package main
 import (
 	"github.com/ghodss/yaml"
 	assertion "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -16,3 +21,97 @@ func TestConfig(t *testing.T) {
 	cc := conf.Search("GetTxBlock")
 	assert.NotNil(cc)
 }
+
+func TestConfigCheck(t *testing.T) {
+	assert := assertion.New(t)
+	known := map[string]bool{}
+	for _, m := range ZilliqaMethods {
+		known[m] = true
+	}
+	errs, err := checkConfigFile("./proxy.yaml", known, false, true)
+	assert.NoError(err)
+	assert.Empty(errs)
+
+	conf, err := parseConfig([]byte(`
+listen: 0.0.0.0:8080
+path: api
+upstreams: [http://localhost:4201]
+cacheConfigs:
+- methods: [GetBalance, GetFoo]
+  for: 5s
+- methods: [GetBalance]
+  for: -1s
+  compression: br
+  jitter: 1.5
+`))
+	assert.NoError(err)
+	errs = append(conf.Check(), checkCacheMethods(conf, known)...)
+	errs = append(errs, checkCacheOverlaps(conf)...)
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal([]string{"path", "cacheConfigs[1].for", "cacheConfigs[1].compression", "cacheConfigs[1].jitter", "cacheConfigs[0].methods[1]", "cacheConfigs[1].methods[0]"}, paths)
+	// overlaps are reported without known methods
+	errs = checkCacheOverlaps(conf)
+	assert.Len(errs, 1)
+	assert.Equal("cacheConfigs[1].methods[0]", errs[0].Path)
+
+	errs = nil
+	doc := map[string]interface{}{"listen": []interface{}{1}, "manage": map[string]interface{}{"foo": 1}}
+	checkFields(&errs, "", doc, reflect.TypeOf(Config{}))
+	assert.Len(errs, 2)
+	assert.Equal("listen", errs[0].Path)
+	assert.Equal("manage.foo", errs[1].Path)
+}
+
+func TestMigrateConfig(t *testing.T) {
+	assert := assertion.New(t)
+	content, version, err := migrateConfig([]byte("keepAlive: 'false'\nerrFor: 1000000000\ncacheConfigs:\n- for: 5s\n  errFor: 2000000\n"))
+	assert.NoError(err)
+	assert.Equal(0, version)
+	assert.Equal("cacheConfigs:\n- errFor: 2ms\n  for: 5s\nerrFor: 1s\nversion: 1\n", string(content))
+
+	_, version, err = migrateConfig(content)
+	assert.NoError(err)
+	assert.Equal(CurrentConfigVersion, version)
+}
+
+func TestConfigEnv(t *testing.T) {
+	assert := assertion.New(t)
+	setenv(t, "JRP_UPSTREAMREQUESTTIMEOUT", "3s")
+	setenv(t, "JRP_MANAGE_PATH", "/admin")
+	setenv(t, "JRP_UPSTREAMS", "http://a:4201, http://b:4201")
+	setenv(t, "JRP_CACHECONFIGS", `[{methods: [GetBalance], for: 1s}]`)
+	conf, err := parseConfig([]byte("listen: 0.0.0.0:8080\nupstreams: [http://localhost:4201]\n"))
+	assert.NoError(err)
+	assert.Equal(3*time.Second, conf.UpstreamRequestTimeout.Duration)
+	assert.Equal("/admin", conf.Manage.Path)
+	assert.Equal(DefaultManageListen, conf.Manage.Listen)
+	assert.Equal([]string{"http://a:4201", "http://b:4201"}, conf.Upstreams)
+	assert.Equal(time.Second, conf.CacheConfigs[0].For.Duration)
+
+	setenv(t, "JRP_DEBUG", "maybe")
+	_, err = parseConfig([]byte("listen: 0.0.0.0:8080\n"))
+	assert.Error(err)
+}
+
+func TestResolveSecrets(t *testing.T) {
+	assert := assertion.New(t)
+	f := filepath.Join(t.TempDir(), "token")
+	assert.NoError(ioutil.WriteFile(f, []byte("file-token\n"), 0600))
+	setenv(t, "JRP_TEST_TOKEN", "env-token")
+	conf := &Config{Upstreams: []string{"https://u:${env:JRP_TEST_TOKEN}@a", "https://b/${file:" + f + "}", "https://c"}}
+	assert.Empty(conf.ResolveSecrets())
+	assert.Equal([]string{"https://u:env-token@a", "https://b/file-token", "https://c"}, conf.Upstreams)
+
+	conf = &Config{Listen: "${env:JRP_TEST_NOT_SET}"}
+	errs := conf.ResolveSecrets()
+	assert.Len(errs, 1)
+	assert.Equal("listen", errs[0].Path)
+}
+
+func setenv(t *testing.T, key, val string) {
+	_ = os.Setenv(key, val)
+	t.Cleanup(func() { _ = os.Unsetenv(key) })
+}
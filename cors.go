@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCorsMaxAge = 10 * time.Minute
+	// maxCorsPreflights bounds the preflight results remembered by a policy
+	maxCorsPreflights = 1024
+)
+
+var DefaultCorsMethods = []string{fasthttp.MethodGet, fasthttp.MethodPost}
+
+// CorsConfig is the CORS policy of a server or a route. Origins are `*`, or like
+// https://example.com, with `*.` before the host to allow its subdomains. Headers may be `*`.
+type CorsConfig struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedHeaders   []string `json:"allowedHeaders,omitempty"`
+	AllowedMethods   []string `json:"allowedMethods,omitempty"`
+	ExposedHeaders   []string `json:"exposedHeaders,omitempty"`
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	// MaxAge is how long browsers cache preflight responses
+	MaxAge Duration `json:"maxAge,omitempty"`
+}
+
+// anyOriginCors is the policy of the RPC server if it has none.
+func anyOriginCors() *CorsConfig {
+	c := &CorsConfig{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"*"}}
+	c.SetDefaults()
+	return c
+}
+
+func (c *CorsConfig) SetDefaults() {
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = DefaultCorsMethods
+	}
+	if c.MaxAge.Duration == 0 {
+		c.MaxAge.Duration = DefaultCorsMaxAge
+	}
+}
+
+func (c *CorsConfig) check(path string, errs *ConfigErrors) {
+	for i, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				errs.Add(fmt.Sprintf("%s.allowedOrigins[%d]", path, i), "can't allow credentials from any origin")
+			}
+			continue
+		}
+		if err := checkCorsOrigin(o); err != nil {
+			errs.Add(fmt.Sprintf("%s.allowedOrigins[%d]", path, i), "%v", err)
+		}
+	}
+	for i, m := range c.AllowedMethods {
+		if m == "" || strings.ToUpper(m) != m {
+			errs.Add(fmt.Sprintf("%s.allowedMethods[%d]", path, i), "invalid method %q", m)
+		}
+	}
+	if c.MaxAge.Duration < 0 {
+		errs.Add(path+".maxAge", "must not be negative")
+	}
+}
+
+func checkCorsOrigin(origin string) error {
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+	if err != nil || u.Scheme == "" || u.Host == "" || strings.Contains(u.Host, "*") {
+		return fmt.Errorf("invalid origin %q", origin)
+	}
+	if u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("origin %q must be scheme://host[:port]", origin)
+	}
+	return nil
+}
+
+// corsPolicy is a parsed CorsConfig.
+type corsPolicy struct {
+	anyOrigin    bool
+	origins      map[string]bool
+	wildcards    [][2]string // prefix and suffix of subdomains
+	anyHeader    bool
+	headers      map[string]bool
+	methods      map[string]bool
+	allowMethods string
+	exposed      string
+	credentials  bool
+	maxAge       string
+
+	mu         sync.Mutex
+	preflights map[string]*corsPreflight
+}
+
+// corsPreflight is the result of a preflight request.
+type corsPreflight struct {
+	allowed bool
+	headers string
+}
+
+// newCorsPolicy parses conf checked by check, nil if conf is nil.
+func newCorsPolicy(conf *CorsConfig) *corsPolicy {
+	if conf == nil {
+		return nil
+	}
+	c := &corsPolicy{
+		origins:      map[string]bool{},
+		headers:      map[string]bool{},
+		methods:      map[string]bool{},
+		allowMethods: strings.Join(conf.AllowedMethods, ", "),
+		exposed:      strings.Join(conf.ExposedHeaders, ", "),
+		credentials:  conf.AllowCredentials,
+		preflights:   map[string]*corsPreflight{},
+	}
+	for _, o := range conf.AllowedOrigins {
+		o = strings.ToLower(o)
+		if o == "*" {
+			c.anyOrigin = true
+		} else if i := strings.Index(o, "://*."); i >= 0 {
+			c.wildcards = append(c.wildcards, [2]string{o[:i+3], o[i+4:]})
+		} else {
+			c.origins[o] = true
+		}
+	}
+	for _, h := range conf.AllowedHeaders {
+		if h == "*" {
+			c.anyHeader = true
+		}
+		c.headers[strings.ToLower(h)] = true
+	}
+	for _, m := range conf.AllowedMethods {
+		c.methods[m] = true
+	}
+	if s := int(conf.MaxAge.Seconds()); s > 0 {
+		c.maxAge = strconv.Itoa(s)
+	}
+	return c
+}
+
+// allowOrigin tells whether origin is allowed, subdomains of a wildcard must not be empty.
+func (c *corsPolicy) allowOrigin(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if c.origins[origin] {
+		return true
+	}
+	for _, w := range c.wildcards {
+		if len(origin) > len(w[0])+len(w[1]) && strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) &&
+			!strings.ContainsAny(origin[len(w[0]):len(origin)-len(w[1])], "/:@") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedOrigin returns Access-Control-Allow-Origin for an allowed origin.
+func (c *corsPolicy) allowedOrigin(origin string) string {
+	if c.anyOrigin && !c.credentials {
+		return "*"
+	}
+	return origin
+}
+
+// preflight returns the result of a preflight request, results are remembered by the origin,
+// method and headers requested.
+func (c *corsPolicy) preflight(origin, method, headers string) *corsPreflight {
+	key := origin + "\n" + method + "\n" + headers
+	c.mu.Lock()
+	res, ok := c.preflights[key]
+	c.mu.Unlock()
+	if ok {
+		return res
+	}
+	res = &corsPreflight{allowed: c.allowOrigin(origin) && c.methods[method]}
+	var allowed []string
+	for _, h := range strings.Split(headers, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		if !c.anyHeader && !c.headers[h] {
+			res.allowed = false
+			break
+		}
+		allowed = append(allowed, h)
+	}
+	res.headers = strings.Join(allowed, ", ")
+	c.mu.Lock()
+	if len(c.preflights) >= maxCorsPreflights {
+		c.preflights = map[string]*corsPreflight{}
+	}
+	c.preflights[key] = res
+	c.mu.Unlock()
+	return res
+}
+
+// corsHandler applies the CORS policy of the request, requests without a policy are passed as is.
+// Preflight requests are answered with 204, or 403 if they are not allowed.
+func corsHandler(policyOf func(ctx *fasthttp.RequestCtx) *corsPolicy) MiddleWare {
+	return func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			c := policyOf(ctx)
+			origin := string(ctx.Request.Header.Peek(fasthttp.HeaderOrigin))
+			if c == nil || origin == "" {
+				h(ctx)
+				return
+			}
+			method := ctx.Request.Header.Peek(fasthttp.HeaderAccessControlRequestMethod)
+			if ctx.IsOptions() && len(method) > 0 {
+				header := &ctx.Response.Header
+				header.Add(fasthttp.HeaderVary, fasthttp.HeaderOrigin)
+				header.Add(fasthttp.HeaderVary, fasthttp.HeaderAccessControlRequestMethod)
+				header.Add(fasthttp.HeaderVary, fasthttp.HeaderAccessControlRequestHeaders)
+				res := c.preflight(origin, string(method), string(ctx.Request.Header.Peek(fasthttp.HeaderAccessControlRequestHeaders)))
+				if !res.allowed {
+					ctx.SetStatusCode(fasthttp.StatusForbidden)
+					return
+				}
+				header.Set(fasthttp.HeaderAccessControlAllowOrigin, c.allowedOrigin(origin))
+				header.Set(fasthttp.HeaderAccessControlAllowMethods, c.allowMethods)
+				if res.headers != "" {
+					header.Set(fasthttp.HeaderAccessControlAllowHeaders, res.headers)
+				}
+				if c.credentials {
+					header.Set(fasthttp.HeaderAccessControlAllowCredentials, "true")
+				}
+				if c.maxAge != "" {
+					header.Set(fasthttp.HeaderAccessControlMaxAge, c.maxAge)
+				}
+				ctx.SetStatusCode(fasthttp.StatusNoContent)
+				return
+			}
+			h(ctx)
+			header := &ctx.Response.Header
+			if !c.anyOrigin || c.credentials {
+				header.Add(fasthttp.HeaderVary, fasthttp.HeaderOrigin)
+			}
+			if !c.allowOrigin(origin) {
+				return
+			}
+			header.Set(fasthttp.HeaderAccessControlAllowOrigin, c.allowedOrigin(origin))
+			if c.exposed != "" {
+				header.Set(fasthttp.HeaderAccessControlExposeHeaders, c.exposed)
+			}
+			if c.credentials {
+				header.Set(fasthttp.HeaderAccessControlAllowCredentials, "true")
+			}
+		}
+	}
+}
+
+// corsPolicy returns the CORS policy of the RPC route of the request, falling back to the one of
+// the server, other paths get other.
+func (p *Proxy) corsPolicy(other *corsPolicy) func(ctx *fasthttp.RequestCtx) *corsPolicy {
+	return func(ctx *fasthttp.RequestCtx) *corsPolicy {
+		r := p.routeOf(ctx)
+		if r == nil {
+			return other
+		}
+		if r.cors != nil {
+			return r.cors
+		}
+		return p.cors
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/fasthttp/router"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"testing"
+	"time"
+)
+
+func TestCorsPolicy(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &CorsConfig{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.org", "http://*.local:8080"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+	}
+	conf.SetDefaults()
+	var errs ConfigErrors
+	conf.check("cors", &errs)
+	assert.Empty(errs)
+	c := newCorsPolicy(conf)
+	for origin, allowed := range map[string]bool{
+		"https://app.example.com":       true,
+		"https://APP.example.com":       true,
+		"http://app.example.com":        false,
+		"https://a.example.org":         true,
+		"https://a.b.example.org":       true,
+		"https://example.org":           false,
+		"https://.example.org":          false,
+		"https://evil.com/.example.org": false,
+		"http://a.local:8080":           true,
+		"http://a.local":                false,
+	} {
+		assert.Equal(allowed, c.allowOrigin(origin), origin)
+	}
+	assert.Equal("https://a.example.org", c.allowedOrigin("https://a.example.org"))
+
+	res := c.preflight("https://a.example.org", "POST", "content-type, Authorization")
+	assert.Equal(&corsPreflight{allowed: true, headers: "content-type, authorization"}, res)
+	assert.Same(res, c.preflight("https://a.example.org", "POST", "content-type, Authorization"))
+	assert.False(c.preflight("https://a.example.org", "PUT", "").allowed)
+	assert.False(c.preflight("https://a.example.org", "POST", "X-Other").allowed)
+	assert.False(c.preflight("https://example.org", "POST", "").allowed)
+	assert.Len(c.preflights, 4)
+
+	anyOrigin := newCorsPolicy(anyOriginCors())
+	assert.Equal("*", anyOrigin.allowedOrigin("https://a.com"))
+	assert.Equal("x-any", anyOrigin.preflight("https://a.com", "GET", "X-Any").headers)
+	assert.Nil(newCorsPolicy(nil))
+
+	errs = nil
+	(&CorsConfig{
+		AllowedOrigins:   []string{"*", "example.com", "https://a.com/path", "https://a.*.com"},
+		AllowedMethods:   []string{"post"},
+		AllowCredentials: true,
+		MaxAge:           Duration{Duration: -time.Second},
+	}).check("cors", &errs)
+	assert.Len(errs, 6)
+}
+
+func TestCorsHandler(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newNegativeUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		Routes: []*RouteConfig{{Path: "/private", Cors: &CorsConfig{
+			AllowedOrigins:   []string{"https://*.example.com"},
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			ExposedHeaders:   []string{"X-Cache"},
+			AllowCredentials: true,
+			MaxAge:           Duration{Duration: time.Hour},
+		}}},
+		Manage: &ManageConfig{Cors: &CorsConfig{AllowedOrigins: []string{"https://admin.example.com"}}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	r := router.New()
+	p.RegisterHandler(r)
+	m := NewManage(config, p)
+	m.registerHandler(r)
+	rpc := corsHandler(p.corsPolicy(p.cors))(r.Handler)
+	manage := corsHandler(func(ctx *fasthttp.RequestCtx) *corsPolicy { return m.cors })(r.Handler)
+	do := func(h fasthttp.RequestHandler, method, uri, origin, reqMethod, reqHeaders string) *fasthttp.ResponseHeader {
+		ctx := newTestCtx(method, uri, "1.1.1.1")
+		if origin != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderOrigin, origin)
+		}
+		if reqMethod != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderAccessControlRequestMethod, reqMethod)
+		}
+		if reqHeaders != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderAccessControlRequestHeaders, reqHeaders)
+		}
+		if method == "POST" {
+			ctx.Request.SetBodyString(`{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}`)
+		}
+		h(ctx)
+		return &ctx.Response.Header
+	}
+
+	// any origin on the path without a policy
+	header := do(rpc, "OPTIONS", "/", "https://a.com", "POST", "Content-Type, X-Api-Key")
+	assert.Equal(fasthttp.StatusNoContent, header.StatusCode())
+	assert.Equal("*", string(header.Peek(fasthttp.HeaderAccessControlAllowOrigin)))
+	assert.Equal("GET, POST", string(header.Peek(fasthttp.HeaderAccessControlAllowMethods)))
+	assert.Equal("content-type, x-api-key", string(header.Peek(fasthttp.HeaderAccessControlAllowHeaders)))
+	assert.Equal("600", string(header.Peek(fasthttp.HeaderAccessControlMaxAge)))
+	header = do(rpc, "POST", "/", "https://a.com", "", "")
+	assert.Equal(200, header.StatusCode())
+	assert.Equal("*", string(header.Peek(fasthttp.HeaderAccessControlAllowOrigin)))
+	assert.Empty(header.Peek(fasthttp.HeaderVary))
+	assert.Empty(do(rpc, "POST", "/", "", "", "").Peek(fasthttp.HeaderAccessControlAllowOrigin))
+
+	// routes have their own policy
+	header = do(rpc, "OPTIONS", "/private", "https://app.example.com", "POST", "authorization")
+	assert.Equal(fasthttp.StatusNoContent, header.StatusCode())
+	assert.Equal("https://app.example.com", string(header.Peek(fasthttp.HeaderAccessControlAllowOrigin)))
+	assert.Equal("true", string(header.Peek(fasthttp.HeaderAccessControlAllowCredentials)))
+	assert.Equal("3600", string(header.Peek(fasthttp.HeaderAccessControlMaxAge)))
+	assert.Equal(fasthttp.StatusForbidden, do(rpc, "OPTIONS", "/private", "https://a.com", "POST", "").StatusCode())
+	assert.Equal(fasthttp.StatusForbidden, do(rpc, "OPTIONS", "/private", "https://app.example.com", "POST", "X-Api-Key").StatusCode())
+	header = do(rpc, "POST", "/private", "https://app.example.com", "", "")
+	assert.Equal(200, header.StatusCode())
+	assert.Equal("https://app.example.com", string(header.Peek(fasthttp.HeaderAccessControlAllowOrigin)))
+	assert.Equal("X-Cache", string(header.Peek(fasthttp.HeaderAccessControlExposeHeaders)))
+	assert.Equal(fasthttp.HeaderOrigin, string(header.Peek(fasthttp.HeaderVary)))
+	header = do(rpc, "POST", "/private", "https://a.com", "", "")
+	assert.Equal(200, header.StatusCode())
+	assert.Empty(header.Peek(fasthttp.HeaderAccessControlAllowOrigin))
+
+	// the manage server
+	header = do(manage, "GET", "/healthz", "https://admin.example.com", "", "")
+	assert.Equal("https://admin.example.com", string(header.Peek(fasthttp.HeaderAccessControlAllowOrigin)))
+	assert.Empty(do(manage, "GET", "/healthz", "https://a.com", "", "").Peek(fasthttp.HeaderAccessControlAllowOrigin))
+	assert.Equal(fasthttp.StatusForbidden, do(manage, "OPTIONS", "/manage/cache", "https://a.com", "DELETE", "").StatusCode())
+	// sharing the listener with the RPC server
+	shared := corsHandler(p.corsPolicy(m.cors))(r.Handler)
+	assert.Empty(do(shared, "GET", "/healthz", "https://a.com", "", "").Peek(fasthttp.HeaderAccessControlAllowOrigin))
+	assert.Equal("*", string(do(shared, "POST", "/", "https://a.com", "", "").Peek(fasthttp.HeaderAccessControlAllowOrigin)))
+	// without a policy the manage server sends no CORS headers
+	m.cors = nil
+	header = do(manage, "OPTIONS", "/healthz", "https://admin.example.com", "GET", "")
+	assert.Empty(header.Peek(fasthttp.HeaderAccessControlAllowOrigin))
+}
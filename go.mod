@@ -3,16 +3,16 @@ module github.com/revolution1/jsonrpc-proxy
 go 1.15
 
 require (
-	github.com/AdhityaRamadhanus/fasthttpcors v0.0.0-20170121111917-d4c07198763a
-	github.com/Ferluci/fast-realip v1.0.0
+	github.com/alicebob/miniredis/v2 v2.14.1
 	github.com/allegro/bigcache v1.2.1
 	github.com/andybalholm/brotli v1.0.1 // indirect
 	github.com/certifi/gocertifi v0.0.0-20200922220541-2c3bb06c6054
 	github.com/fasthttp/router v1.3.3
 	github.com/ghodss/yaml v1.0.0
+	github.com/go-redis/redis/v8 v8.4.4
 	github.com/google/gops v0.3.14
 	github.com/json-iterator/go v1.1.10
-	github.com/klauspost/compress v1.11.3 // indirect
+	github.com/klauspost/compress v1.11.3
 	github.com/mailru/easyjson v0.7.6
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.8.0
@@ -22,6 +22,7 @@ require (
 	github.com/spf13/cobra v1.1.1
 	github.com/stretchr/testify v1.6.1
 	github.com/valyala/fasthttp v1.18.0
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/multierr v1.6.0
 	golang.org/x/sys v0.0.0-20201211090839-8ad439b19e0f // indirect
 	google.golang.org/protobuf v1.25.0 // indirect
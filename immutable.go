@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ImmutableTTL is the TTL of immutable results in every cache, they are evicted only for space.
+const ImmutableTTL = 10 * 365 * 24 * time.Hour
+
+const (
+	DefaultImmutableSizeMb = 64
+	DefaultTipInterval     = 10 * time.Second
+)
+
+// ImmutableConfig marks a result immutable if the requested block is at least Confirmations
+// below the tip, or any of Conditions matches the result.
+type ImmutableConfig struct {
+	// HeightParam is the index of the param holding the requested block height
+	HeightParam   *int   `json:"heightParam,omitempty"`
+	Confirmations uint64 `json:"confirmations,omitempty"`
+	// Conditions only use path and equals
+	Conditions []*CacheCondition `json:"conditions,omitempty"`
+}
+
+// TipConfig tracks the height of the chain tip by calling Method every Interval, the height is
+// the result or the value at Path of it, in decimal or hex.
+type TipConfig struct {
+	Method   string      `json:"method"`
+	Params   interface{} `json:"params,omitempty"`
+	Path     string      `json:"path,omitempty"`
+	Interval Duration    `json:"interval"`
+}
+
+func (c *TipConfig) SetDefaults() {
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = DefaultTipInterval
+	}
+}
+
+func (c *TipConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.Method == "" {
+		errs.Add("tip.method", "is empty")
+	}
+	if c.Interval.Duration < 0 {
+		errs.Add("tip.interval", "must not be negative")
+	}
+	return errs
+}
+
+// parseHeight parses a block height in a JSON number or string in decimal or hex.
+func parseHeight(v interface{}) (uint64, bool) {
+	switch h := v.(type) {
+	case float64:
+		return uint64(h), h >= 0
+	case string:
+		var n uint64
+		var err error
+		if strings.HasPrefix(h, "0x") || strings.HasPrefix(h, "0X") {
+			n, err = strconv.ParseUint(h[2:], 16, 64)
+		} else {
+			n, err = strconv.ParseUint(h, 10, 64)
+		}
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// Tip returns the tracked height of the chain tip, 0 if it's unknown.
+func (p *Proxy) Tip() uint64 {
+	return atomic.LoadUint64(&p.tip)
+}
+
+// updateTip fetches the height of the tip, the tip never goes backwards.
+func (p *Proxy) updateTip() error {
+	conf := p.config.Tip
+	resps, _, err := p.fetch([]*jsonrpc.RpcRequest{{Method: conf.Method, Params: conf.Params}})
+	if err != nil {
+		return err
+	}
+	if resps[0].Error != nil {
+		return resps[0].Error
+	}
+	result, err := jsoniter.Marshal(resps[0].Result)
+	if err != nil {
+		return err
+	}
+	v := jsoniter.Get(result)
+	if conf.Path != "" {
+		v = jsoniter.Get(result, jsonPath(conf.Path)...)
+	}
+	height, ok := parseHeight(v.GetInterface())
+	if !ok {
+		return fmt.Errorf("invalid height %s", v.ToString())
+	}
+	for {
+		old := atomic.LoadUint64(&p.tip)
+		if height <= old || atomic.CompareAndSwapUint64(&p.tip, old, height) {
+			return nil
+		}
+	}
+}
+
+// TrackTip updates the tip every tip.interval until ctx is done.
+func (p *Proxy) TrackTip(ctx context.Context) {
+	p.initOnce.Do(p.init)
+	if p.config.Tip == nil {
+		return
+	}
+	ticker := time.NewTicker(p.config.Tip.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		if err := p.updateTip(); err != nil {
+			log.WithError(err).Warn("error while tracking tip of the chain")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isImmutable tells whether result of req will never change by the immutable rule of cc.
+func (p *Proxy) isImmutable(req *jsonrpc.RpcRequest, cc *CacheConfig, result []byte) bool {
+	conf := cc.Immutable
+	if conf == nil {
+		return false
+	}
+	if conf.HeightParam != nil {
+		if tip := p.Tip(); tip > 0 {
+			if height, ok := parseHeight(paramAt(req.Params, *conf.HeightParam)); ok && height+conf.Confirmations <= tip {
+				return true
+			}
+		}
+	}
+	for _, c := range conf.Conditions {
+		if c.Match(result) {
+			return true
+		}
+	}
+	return false
+}
+
+// paramAt returns the i-th param of positional params.
+func paramAt(params interface{}, i int) interface{} {
+	switch ps := params.(type) {
+	case []interface{}:
+		if i >= 0 && i < len(ps) {
+			return ps[i]
+		}
+	case jsoniter.RawMessage:
+		var v []interface{}
+		if jsoniter.Unmarshal(ps, &v) == nil {
+			return paramAt(v, i)
+		}
+	}
+	return nil
+}
+
+// IsImmutable tells whether the item is cached as an immutable result.
+func (i *CachedItem) IsImmutable() bool {
+	return i.TTL >= int64(ImmutableTTL/time.Millisecond)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHeight(t *testing.T) {
+	assert := assertion.New(t)
+	for v, expected := range map[interface{}]uint64{float64(12): 12, "12": 12, "0x1f": 31} {
+		h, ok := parseHeight(v)
+		assert.True(ok)
+		assert.Equal(expected, h)
+	}
+	for _, v := range []interface{}{"x", float64(-1), nil, true} {
+		_, ok := parseHeight(v)
+		assert.False(ok, v)
+	}
+}
+
+func TestImmutableCache(t *testing.T) {
+	assert := assertion.New(t)
+	upstream := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		var reqs []jsonrpc.RpcRequest
+		if err := jsoniter.Unmarshal(ctx.PostBody(), &reqs); err != nil {
+			var req jsonrpc.RpcRequest
+			_ = jsoniter.Unmarshal(ctx.PostBody(), &req)
+			reqs = append(reqs, req)
+		}
+		var resps []string
+		for _, r := range reqs {
+			result := `null`
+			switch r.Method {
+			case "GetNumTxBlocks":
+				result = `"100"`
+			case "GetTxBlock":
+				result = fmt.Sprintf(`[%q]`, r.Params.([]interface{})[0])
+			case "GetTransaction":
+				// results are arrays, as maps can't be marshaled by jsoniter with the reflect2 in use
+				result = fmt.Sprintf(`["receipt",%v]`, r.Params.([]interface{})[0] == "confirmed")
+			}
+			resps = append(resps, fmt.Sprintf(`{"jsonrpc":"2.0","id":%v,"result":%s}`, r.Id, result))
+		}
+		ctx.SetContentType("application/json")
+		if ctx.PostBody()[0] == '{' {
+			ctx.SetBodyString(resps[0])
+		} else {
+			ctx.SetBodyString("[" + strings.Join(resps, ",") + "]")
+		}
+	})
+	conf, err := parseConfig([]byte(`
+listen: 127.0.0.1:8080
+upstreams: [` + upstream + `]
+cache: {engine: lru, memoryLimitMb: 16}
+tip: {method: GetNumTxBlocks, params: []}
+cacheConfigs:
+- methods: [GetTxBlock]
+  for: 5s
+  immutable: {heightParam: 0, confirmations: 10}
+- methods: [GetTransaction]
+  for: 5s
+  immutable:
+    conditions: [{path: "1", equals: true}]
+- methods: [GetBalance]
+  for: 5s
+`))
+	assert.NoError(err)
+	assert.Empty(conf.Check())
+	assert.Equal(DefaultImmutableSizeMb, conf.Cache.ImmutableSizeMb)
+	p := NewProxy(conf)
+	p.initOnce.Do(p.init)
+	assert.NoError(p.updateTip())
+	assert.EqualValues(100, p.Tip())
+
+	lookup := func(method, param string) (string, *CachedItem) {
+		key := method + `(["` + param + `"])`
+		doProxyRequest(p, `{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":["`+param+`"]}`)
+		entries := p.CacheManager.Lookup(key)
+		if !assert.Len(entries, 1, key) {
+			return "", nil
+		}
+		item := &CachedItem{}
+		assert.NoError(item.Unmarshal(entries[0].Value))
+		return entries[0].Tier, item
+	}
+	tier, item := lookup("GetTxBlock", "90")
+	assert.Equal("immutable", tier)
+	assert.True(item.IsImmutable())
+	tier, item = lookup("GetTxBlock", "91")
+	assert.Equal(CacheEngineLRU, tier)
+	assert.EqualValues(5000, item.TTL)
+	tier, _ = lookup("GetTransaction", "confirmed")
+	assert.Equal("immutable", tier)
+	tier, _ = lookup("GetTransaction", "pending")
+	assert.Equal(CacheEngineLRU, tier)
+
+	reqs := []*jsonrpc.RpcRequest{
+		{Method: "GetBalance", Params: []interface{}{"a"}},
+		{Method: "GetTxBlock", Params: []interface{}{"90"}},
+		{Method: "GetTxBlock", Params: []interface{}{"1"}},
+	}
+	reqs = p.prioritizeWarmup(reqs)
+	assert.Len(reqs, 2)
+	assert.Equal("GetTxBlock", reqs[0].Method)
+	assert.Equal("GetBalance", reqs[1].Method)
+
+	// immutable entries are not moved to other tiers by TTL
+	assert.Equal("immutable", p.CacheManager.getTierForTTL(ImmutableTTL).name)
+	assert.Equal(CacheEngineLRU, p.CacheManager.getTierForTTL(100*24*time.Hour).name)
+
+	conf.CacheConfigs[0].Immutable.HeightParam = nil
+	conf.Tip = nil
+	var paths []string
+	for _, e := range conf.Check() {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal([]string{"cacheConfigs[0].immutable"}, paths)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	"github.com/valyala/fasthttp"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultBanFor = time.Hour
+
+var ErrUnknownBan = errors.New("no such ban")
+
+// IPAccess allows clients in Allow, or every client if it's empty, except those in Deny. Entries
+// are IPs or CIDR ranges.
+type IPAccess struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func (c *IPAccess) check(path string, errs *ConfigErrors) {
+	checkIPNets(path+".allow", c.Allow, errs)
+	checkIPNets(path+".deny", c.Deny, errs)
+}
+
+func checkIPNets(path string, nets []string, errs *ConfigErrors) {
+	for i, s := range nets {
+		if _, err := parseIPNet(s); err != nil {
+			errs.Add(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+// parseIPNet parses a CIDR range, or an IP as the range of itself.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid CIDR %q", s)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.Errorf("invalid IP %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+type ipNets []*net.IPNet
+
+// newIPNets parses nets checked by checkIPNets, invalid ones are skipped.
+func newIPNets(nets []string) ipNets {
+	var n ipNets
+	for _, s := range nets {
+		if ipNet, err := parseIPNet(s); err == nil {
+			n = append(n, ipNet)
+		}
+	}
+	return n
+}
+
+func (n ipNets) Contains(ip net.IP) bool {
+	for _, ipNet := range n {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAccess is a parsed IPAccess, nil allows every client.
+type ipAccess struct {
+	allow ipNets
+	deny  ipNets
+}
+
+func newIPAccess(conf *IPAccess) *ipAccess {
+	if conf == nil || len(conf.Allow) == 0 && len(conf.Deny) == 0 {
+		return nil
+	}
+	return &ipAccess{allow: newIPNets(conf.Allow), deny: newIPNets(conf.Deny)}
+}
+
+func (a *ipAccess) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	return (len(a.allow) == 0 || a.allow.Contains(ip)) && !a.deny.Contains(ip)
+}
+
+// resolveClientIP returns the IP of the client, forwarding headers are honored only if the peer is
+// a trusted proxy. X-Forwarded-For is walked from the nearest hop, skipping trusted proxies.
+func resolveClientIP(ctx *fasthttp.RequestCtx, trusted ipNets) net.IP {
+	ip := ctx.RemoteIP()
+	if !trusted.Contains(ip) {
+		return ip
+	}
+	if xff := ctx.Request.Header.Peek(fasthttp.HeaderXForwardedFor); len(xff) > 0 {
+		hops := bytes.Split(xff, []byte{','})
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(string(bytes.TrimSpace(hops[i])))
+			if hop == nil {
+				// the hops before are not trustworthy
+				break
+			}
+			ip = hop
+			if !trusted.Contains(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := net.ParseIP(string(bytes.TrimSpace(ctx.Request.Header.Peek("X-Real-IP")))); realIP != nil {
+		return realIP
+	}
+	return ip
+}
+
+// clientIPHandler resolves the IP of the client once for the other handlers.
+func clientIPHandler(trusted ipNets) MiddleWare {
+	return func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			ctx.SetUserValue("clientIP", resolveClientIP(ctx, trusted))
+			h(ctx)
+		}
+	}
+}
+
+// clientIP returns the IP of the client resolved by clientIPHandler, or the IP of the peer.
+func clientIP(ctx *fasthttp.RequestCtx) net.IP {
+	if ip, ok := ctx.UserValue("clientIP").(net.IP); ok {
+		return ip
+	}
+	return ctx.RemoteIP()
+}
+
+// IPBan bans clients in Prefix from RPC routes until Until.
+type IPBan struct {
+	Prefix string    `json:"prefix"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+
+	net *net.IPNet
+}
+
+// ipBans keeps temporary bans by prefix, expired bans are forgotten.
+type ipBans struct {
+	clock Clock
+	mu    sync.RWMutex
+	bans  map[string]*IPBan
+}
+
+func newIPBans(clock Clock) *ipBans {
+	return &ipBans{clock: clock, bans: map[string]*IPBan{}}
+}
+
+// Ban bans prefix, an IP or a CIDR range, for d, the ban of the prefix is replaced.
+func (b *ipBans) Ban(prefix string, d time.Duration, reason string) (*IPBan, error) {
+	n, err := parseIPNet(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if d <= 0 {
+		return nil, errors.New("ban duration must be positive")
+	}
+	ban := &IPBan{Prefix: n.String(), Until: b.clock.Now().Add(d), Reason: reason, net: n}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans[ban.Prefix] = ban
+	return ban, nil
+}
+
+// Unban lifts the ban of prefix.
+func (b *ipBans) Unban(prefix string) error {
+	n, err := parseIPNet(prefix)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.bans[n.String()]; !ok {
+		return ErrUnknownBan
+	}
+	delete(b.bans, n.String())
+	return nil
+}
+
+// Banned returns the ban of ip, nil if it's not banned.
+func (b *ipBans) Banned(ip net.IP) *IPBan {
+	if b == nil {
+		return nil
+	}
+	now := b.clock.Now()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ban := range b.bans {
+		if ban.net.Contains(ip) && now.Before(ban.Until) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// List lists bans in effect sorted by prefix, expired bans are forgotten.
+func (b *ipBans) List() []*IPBan {
+	now := b.clock.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bans := make([]*IPBan, 0, len(b.bans))
+	for k, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, k)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Prefix < bans[j].Prefix })
+	return bans
+}
+
+// ipFilterHandler rejects RPC requests of clients denied on the route or banned with Forbidden and
+// HTTP 403.
+func (p *Proxy) ipFilterHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		r := p.routeOf(ctx)
+		if r == nil {
+			h(ctx)
+			return
+		}
+		ip := clientIP(ctx)
+		var e *jsonrpc.RpcError
+		if !r.ips.Allowed(ip) {
+			e = jsonrpc.ErrRpcForbidden
+			IPRejected.WithLabelValues("denied").Inc()
+		} else if ban := p.bans.Banned(ip); ban != nil {
+			e = jsonrpc.ErrWithData(jsonrpc.ErrRpcForbidden, "banned until "+ban.Until.UTC().Format(time.RFC3339))
+			IPRejected.WithLabelValues("banned").Inc()
+		}
+		if e == nil {
+			h(ctx)
+			return
+		}
+		methods, id := peekRpcRequests(ctx.Request.Body())
+		ctx.SetUserValue("isRpcReq", true)
+		setCtxRpcMethods(ctx, methods)
+		writeRpcErrResp(ctx, e, id)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/fasthttp/router"
+	jsoniter "github.com/json-iterator/go"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCtx(method, uri, remote string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	var req fasthttp.Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(remote), Port: 1234}, nil)
+	return ctx
+}
+
+func TestResolveClientIP(t *testing.T) {
+	assert := assertion.New(t)
+	trusted := newIPNets([]string{"10.0.0.0/8", "192.168.1.1"})
+	for _, c := range []struct{ remote, xff, realIP, ip string }{
+		{"1.1.1.1", "2.2.2.2", "3.3.3.3", "1.1.1.1"},
+		{"10.0.0.1", "", "", "10.0.0.1"},
+		{"10.0.0.1", "", "3.3.3.3", "3.3.3.3"},
+		{"10.0.0.1", "2.2.2.2", "3.3.3.3", "2.2.2.2"},
+		{"10.0.0.1", "5.5.5.5, 2.2.2.2, 192.168.1.1", "", "2.2.2.2"},
+		{"10.0.0.1", "10.0.0.3,10.0.0.2", "", "10.0.0.3"},
+		{"10.0.0.1", "2.2.2.2, bad, 10.0.0.2", "", "10.0.0.2"},
+		{"192.168.1.2", "2.2.2.2", "", "192.168.1.2"},
+	} {
+		ctx := newTestCtx("POST", "/", c.remote)
+		if c.xff != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderXForwardedFor, c.xff)
+		}
+		if c.realIP != "" {
+			ctx.Request.Header.Set("X-Real-IP", c.realIP)
+		}
+		clientIPHandler(trusted)(func(ctx *fasthttp.RequestCtx) {})(ctx)
+		assert.Equal(c.ip, clientIP(ctx).String(), c)
+	}
+	assert.Equal("0.0.0.0", clientIP(&fasthttp.RequestCtx{}).String())
+}
+
+func TestIPAccess(t *testing.T) {
+	assert := assertion.New(t)
+	var a *ipAccess
+	assert.True(a.Allowed(net.ParseIP("1.1.1.1")))
+	assert.Nil(newIPAccess(&IPAccess{}))
+	a = newIPAccess(&IPAccess{Allow: []string{"10.0.0.0/8", "::1"}, Deny: []string{"10.0.0.1"}})
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3": true,
+		"10.0.0.1": false,
+		"::1":      true,
+		"1.1.1.1":  false,
+	} {
+		assert.Equal(allowed, a.Allowed(net.ParseIP(ip)), ip)
+	}
+	var errs ConfigErrors
+	(&IPAccess{Allow: []string{"10.0.0.0/33", "a"}, Deny: []string{"::1/128"}}).check("ipAccess", &errs)
+	assert.Len(errs, 2)
+}
+
+func TestIPBans(t *testing.T) {
+	assert := assertion.New(t)
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	b := newIPBans(clock)
+	_, err := b.Ban("1.1.1.1", 0, "")
+	assert.Error(err)
+	_, err = b.Ban("bad", time.Minute, "")
+	assert.Error(err)
+	ban, err := b.Ban("10.1.2.3/16", time.Minute, "spam")
+	assert.NoError(err)
+	assert.Equal("10.1.0.0/16", ban.Prefix)
+	_, err = b.Ban("1.1.1.1", 2*time.Minute, "")
+	assert.NoError(err)
+	assert.Equal(ban, b.Banned(net.ParseIP("10.1.9.9")))
+	assert.Nil(b.Banned(net.ParseIP("10.2.0.1")))
+	assert.Len(b.List(), 2)
+
+	clock.Add(time.Minute)
+	assert.Nil(b.Banned(net.ParseIP("10.1.9.9")))
+	assert.Len(b.List(), 1)
+	assert.Equal(ErrUnknownBan, b.Unban("10.1.0.0/16"))
+	assert.NoError(b.Unban("1.1.1.1"))
+	assert.Empty(b.List())
+}
+
+func TestIPFilterHandler(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newNegativeUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		IPAccess:  &IPAccess{Deny: []string{"1.0.0.0/8"}},
+		Routes:    []*RouteConfig{{Path: "/internal", IPAccess: &IPAccess{Allow: []string{"10.0.0.0/8"}}}},
+		Manage:    &ManageConfig{IPAccess: &IPAccess{Allow: []string{"127.0.0.1"}}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	r := router.New()
+	p.RegisterHandler(r)
+	NewManage(config, p).registerHandler(r)
+	h := p.ipFilterHandler(r.Handler)
+	do := func(method, uri, remote, body string) *fasthttp.RequestCtx {
+		ctx := newTestCtx(method, uri, remote)
+		ctx.Request.SetBodyString(body)
+		h(ctx)
+		return ctx
+	}
+	req := `{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}`
+	assert.Equal(200, do("POST", "/", "2.2.2.2", req).Response.StatusCode())
+	ctx := do("POST", "/", "1.2.3.4", req)
+	assert.Equal(fasthttp.StatusForbidden, ctx.Response.StatusCode())
+	assert.Equal(`{"id":1,"jsonrpc":"2.0","error":{"code":-32010,"message":"Forbidden"}}`, string(ctx.Response.Body()))
+	assert.Equal(fasthttp.StatusForbidden, do("POST", "/internal", "2.2.2.2", req).Response.StatusCode())
+	assert.Equal(200, do("POST", "/internal", "10.0.0.1", req).Response.StatusCode())
+
+	// manage API
+	assert.Equal(fasthttp.StatusForbidden, do("GET", "/manage/bans", "2.2.2.2", "").Response.StatusCode())
+	assert.Equal(fasthttp.StatusBadRequest, do("POST", "/manage/bans?prefix=2.2.2.2&for=x", "127.0.0.1", "").Response.StatusCode())
+	assert.Equal(200, do("POST", "/manage/bans?prefix=2.2.2.0/24&for=1m&reason=spam", "127.0.0.1", "").Response.StatusCode())
+	ctx = do("POST", "/", "2.2.2.2", req)
+	assert.Equal(fasthttp.StatusForbidden, ctx.Response.StatusCode())
+	assert.Contains(string(ctx.Response.Body()), "banned until")
+	ctx = do("GET", "/manage/bans", "127.0.0.1", "")
+	var res manageBans
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &res))
+	if assert.Len(res.Bans, 1) {
+		assert.Equal("2.2.2.0/24", res.Bans[0].Prefix)
+		assert.Equal("spam", res.Bans[0].Reason)
+	}
+	assert.Equal(200, do("DELETE", "/manage/bans?prefix=2.2.2.0/24", "127.0.0.1", "").Response.StatusCode())
+	assert.Equal(fasthttp.StatusNotFound, do("DELETE", "/manage/bans?prefix=2.2.2.0/24", "127.0.0.1", "").Response.StatusCode())
+	assert.Equal(200, do("POST", "/", "2.2.2.2", req).Response.StatusCode())
+}
+
+func TestIPFilterPathKeys(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newNegativeUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		IPAccess:  &IPAccess{Deny: []string{"1.0.0.0/8"}},
+		Auth:      &AuthConfig{Keys: []*ApiKey{{Key: "k1"}}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	r := router.New()
+	p.RegisterHandler(r)
+	// in the order of main
+	h := p.ipFilterHandler(p.authHandler(r.Handler))
+	do := func(remote string) *fasthttp.RequestCtx {
+		ctx := newTestCtx("POST", "/v1/k1", remote)
+		ctx.Request.SetBodyString(`{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}`)
+		h(ctx)
+		return ctx
+	}
+	assert.Equal(200, do("2.2.2.2").Response.StatusCode())
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+	assert.Equal(fasthttp.StatusForbidden, do("1.2.3.4").Response.StatusCode())
+	_, err := p.bans.Ban("3.3.3.3", time.Minute, "test")
+	assert.NoError(err)
+	ctx := do("3.3.3.3")
+	assert.Equal(fasthttp.StatusForbidden, ctx.Response.StatusCode())
+	assert.Contains(string(ctx.Response.Body()), "banned until")
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+}
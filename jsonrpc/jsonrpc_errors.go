@@ -56,8 +56,17 @@ var (
 	ErrRpcInvalidParams  = &RpcError{name: "InvalidParams", Code: -32602, Message: "Invalid params"}
 	ErrRpcInternalError  = &RpcError{name: "InternalError", Code: -32603, Message: "Internal error"}
 	ErrProcedureIsMethod = &RpcError{name: "ProcedureIsMethod", Code: -32604, Message: "Procedure is method"}
+	// ErrRpcLimitExceeded is of EIP-1474
+	ErrRpcLimitExceeded = &RpcError{name: "LimitExceeded", Code: -32005, Message: "Limit exceeded"}
+	ErrRpcUnauthorized  = &RpcError{name: "Unauthorized", Code: -32001, Message: "Unauthorized"}
+	ErrRpcForbidden     = &RpcError{name: "Forbidden", Code: -32010, Message: "Forbidden"}
 )
 
+// NewRpcError returns an error named name in access logs.
+func NewRpcError(name string, code int, message string) *RpcError {
+	return &RpcError{name: name, Code: code, Message: message}
+}
+
 func ErrWithData(rpcError *RpcError, data interface{}) *RpcError {
 	e := new(RpcError)
 	e.name = rpcError.name
@@ -87,6 +96,12 @@ func StatusCodeOfRpcError(e *RpcError) int {
 		return fasthttp.StatusInternalServerError
 	case e.Code == ErrRpcInternalError.Code:
 		return fasthttp.StatusInternalServerError
+	case e.Code == ErrRpcLimitExceeded.Code:
+		return fasthttp.StatusTooManyRequests
+	case e.Code == ErrRpcUnauthorized.Code:
+		return fasthttp.StatusUnauthorized
+	case e.Code == ErrRpcForbidden.Code:
+		return fasthttp.StatusForbidden
 	case -32099 < e.Code && e.Code < -32000:
 		return fasthttp.StatusInternalServerError
 	default:
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// signing algorithms of tokens
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+)
+
+const (
+	DefaultJWTSubjectClaim = "sub"
+	DefaultJWTScopeClaim   = "scope"
+	DefaultJWTMethodsClaim = "methods"
+	defaultJWTLabel        = "jwt"
+)
+
+var (
+	ErrJWTMalformed    = errors.New("malformed token")
+	ErrJWTAlgorithm    = errors.New("unsupported algorithm")
+	ErrJWTUnknownKey   = errors.New("unknown key")
+	ErrJWTSignature    = errors.New("invalid signature")
+	ErrJWTExpired      = errors.New("token is expired")
+	ErrJWTNoExpiry     = errors.New("missing expiry")
+	ErrJWTNotYetValid  = errors.New("token is not valid yet")
+	ErrJWTIssuer       = errors.New("invalid issuer")
+	ErrJWTAudience     = errors.New("invalid audience")
+	ErrJWTNoSubject    = errors.New("missing subject")
+	ErrJWTInvalidClaim = errors.New("invalid claim")
+)
+
+// JWTScope is the policy of tokens having Scope, the label is the scope if it's empty.
+type JWTScope struct {
+	Scope string `json:"scope"`
+	ClientPolicy
+}
+
+// JWTConfig accepts HS256 tokens signed by Secrets, and RS256 and ES256 tokens signed by keys of
+// the JWKS file.
+type JWTConfig struct {
+	Secrets  []string `json:"secrets,omitempty"`
+	JWKSFile string   `json:"jwksFile,omitempty"`
+	// Issuer and Audience are checked if they are not empty
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+	// Leeway tolerates clock skew when checking exp and nbf
+	Leeway Duration `json:"leeway,omitempty"`
+	// AllowNoExp accepts tokens without exp, they never expire
+	AllowNoExp bool `json:"allowNoExp,omitempty"`
+	// SubjectClaim keys clients for rate limits and quotas
+	SubjectClaim string `json:"subjectClaim"`
+	// ScopeClaim is a space separated string or a list of scopes
+	ScopeClaim string `json:"scopeClaim"`
+	// MethodsClaim is a list of method patterns, it further restricts the methods of the scope if
+	// present
+	MethodsClaim string `json:"methodsClaim"`
+	// Scopes are matched in order, tokens without scope matched are limited by rateLimit
+	Scopes []*JWTScope `json:"scopes,omitempty"`
+}
+
+func (c *JWTConfig) SetDefaults() {
+	if c.SubjectClaim == "" {
+		c.SubjectClaim = DefaultJWTSubjectClaim
+	}
+	if c.ScopeClaim == "" {
+		c.ScopeClaim = DefaultJWTScopeClaim
+	}
+	if c.MethodsClaim == "" {
+		c.MethodsClaim = DefaultJWTMethodsClaim
+	}
+	for _, s := range c.Scopes {
+		if s.Label == "" {
+			s.Label = s.Scope
+		}
+		s.ClientPolicy.SetDefaults()
+	}
+}
+
+func (c *JWTConfig) check(path string, groups []*UpstreamGroupConfig, errs *ConfigErrors) {
+	if len(c.Secrets) == 0 && c.JWKSFile == "" {
+		errs.Add(path, "secrets or jwksFile is required")
+	}
+	for i, s := range c.Secrets {
+		if s == "" {
+			errs.Add(fmt.Sprintf("%s.secrets[%d]", path, i), "is empty")
+		}
+	}
+	if c.Leeway.Duration < 0 {
+		errs.Add(path+".leeway", "must not be negative")
+	}
+	seen := map[string]bool{}
+	for i, s := range c.Scopes {
+		p := fmt.Sprintf("%s.scopes[%d]", path, i)
+		if s.Scope == "" {
+			errs.Add(p+".scope", "is empty")
+		} else if seen[s.Scope] {
+			errs.Add(p+".scope", "duplicated scope %s", s.Scope)
+		}
+		seen[s.Scope] = true
+		s.ClientPolicy.check(p, groups, errs)
+	}
+}
+
+// jwk is a public key of a JWKS file.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwtKey is a public key verifying tokens of alg.
+type jwtKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// loadJWKS loads the RS256 and ES256 signing keys of a JWKS file, other keys are skipped.
+func loadJWKS(file string) ([]*jwtKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := jsoniter.Unmarshal(content, &set); err != nil {
+		return nil, errors.Wrap(err, "invalid JWKS")
+	}
+	var keys []*jwtKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %d of JWKS", i)
+		}
+		if key == nil {
+			log.Warnf("skipped key %d of JWKS %s: unsupported key type %s %s", i, file, k.Kty, k.Crv)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("no RS256 or ES256 key in JWKS %s", file)
+	}
+	return keys, nil
+}
+
+// publicKey returns the key of k, nil if it's not supported.
+func (k *jwk) publicKey() (*jwtKey, error) {
+	switch {
+	case k.Kty == "RSA" && (k.Alg == "" || k.Alg == JWTAlgRS256):
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 || e.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &jwtKey{kid: k.Kid, alg: JWTAlgRS256, key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+	case k.Kty == "EC" && k.Crv == "P-256" && (k.Alg == "" || k.Alg == JWTAlgES256):
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve P-256")
+		}
+		return &jwtKey{kid: k.Kid, alg: JWTAlgES256, key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// jwtVerifier verifies bearer tokens and maps their claims to client policies.
+type jwtVerifier struct {
+	conf    *JWTConfig
+	clock   Clock
+	secrets [][]byte
+	keys    []*jwtKey
+	scopes  []*JWTScope
+	// defaults is the policy of tokens without scope matched
+	defaults *ClientPolicy
+}
+
+func newJWTVerifier(conf *JWTConfig, rate *RateLimitConfig, clock Clock) (*jwtVerifier, error) {
+	v := &jwtVerifier{conf: conf, clock: clock, defaults: &ClientPolicy{Label: defaultJWTLabel}}
+	for _, s := range conf.Secrets {
+		v.secrets = append(v.secrets, []byte(s))
+	}
+	if conf.JWKSFile != "" {
+		keys, err := loadJWKS(conf.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+	}
+	for _, s := range conf.Scopes {
+		scope := *s
+		scope.init(rate)
+		v.scopes = append(v.scopes, &scope)
+	}
+	v.defaults.init(rate)
+	return v, nil
+}
+
+// Verify verifies the signature and the time and the issuer and audience claims of token, and
+// returns its claims.
+func (v *jwtVerifier) Verify(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || !isJSONObject(header) {
+		return nil, ErrJWTMalformed
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !isJSONObject(claims) {
+		return nil, ErrJWTMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	alg := jsoniter.Get(header, "alg").ToString()
+	kid := jsoniter.Get(header, "kid").ToString()
+	if err := v.verifySignature(alg, kid, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	if err := v.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func isJSONObject(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) > 0 && b[0] == '{' && jsoniter.Valid(b)
+}
+
+// verifySignature verifies sig of signed by alg, tokens with kid are verified by the key of kid
+// only, others by every key of alg. HS256 tokens are never verified by public keys.
+func (v *jwtVerifier) verifySignature(alg, kid string, signed, sig []byte) error {
+	if alg == JWTAlgHS256 {
+		if len(v.secrets) == 0 {
+			return ErrJWTAlgorithm
+		}
+		for _, s := range v.secrets {
+			mac := hmac.New(sha256.New, s)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return nil
+			}
+		}
+		return ErrJWTSignature
+	}
+	if alg != JWTAlgRS256 && alg != JWTAlgES256 {
+		return ErrJWTAlgorithm
+	}
+	digest := sha256.Sum256(signed)
+	found := false
+	for _, k := range v.keys {
+		if k.alg != alg || (kid != "" && k.kid != kid) {
+			continue
+		}
+		found = true
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			// ES256 signatures are r and s of 32 bytes each
+			if len(sig) == 64 && ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return nil
+			}
+		}
+	}
+	if !found {
+		return ErrJWTUnknownKey
+	}
+	return ErrJWTSignature
+}
+
+func (v *jwtVerifier) verifyClaims(claims []byte) error {
+	now := v.clock.Now()
+	leeway := v.conf.Leeway.Duration
+	if exp := jsoniter.Get(claims, "exp"); exp.LastError() == nil {
+		if exp.ValueType() != jsoniter.NumberValue {
+			return ErrJWTInvalidClaim
+		}
+		if !now.Before(unixTime(exp.ToFloat64()).Add(leeway)) {
+			return ErrJWTExpired
+		}
+	} else if !v.conf.AllowNoExp {
+		return ErrJWTNoExpiry
+	}
+	if nbf := jsoniter.Get(claims, "nbf"); nbf.LastError() == nil {
+		if nbf.ValueType() != jsoniter.NumberValue {
+			return ErrJWTInvalidClaim
+		}
+		if now.Add(leeway).Before(unixTime(nbf.ToFloat64())) {
+			return ErrJWTNotYetValid
+		}
+	}
+	if v.conf.Issuer != "" && jsoniter.Get(claims, "iss").ToString() != v.conf.Issuer {
+		return ErrJWTIssuer
+	}
+	if v.conf.Audience != "" {
+		found := false
+		for _, aud := range claimStrings(claims, "aud") {
+			found = found || aud == v.conf.Audience
+		}
+		if !found {
+			return ErrJWTAudience
+		}
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// claimStrings returns a claim of a string or a list of strings, strings are split by spaces.
+func claimStrings(claims []byte, name string) []string {
+	c := jsoniter.Get(claims, name)
+	switch c.ValueType() {
+	case jsoniter.StringValue:
+		return strings.Fields(c.ToString())
+	case jsoniter.ArrayValue:
+		var values []string
+		for i := 0; i < c.Size(); i++ {
+			if s := c.Get(i); s.ValueType() == jsoniter.StringValue {
+				values = append(values, s.ToString())
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Authenticate verifies token and returns its client, keyed by the subject claim and limited by
+// the policy of the first scope matched.
+func (v *jwtVerifier) Authenticate(token string) (*authClient, error) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	sub := jsoniter.Get(claims, v.conf.SubjectClaim).ToString()
+	if sub == "" {
+		return nil, ErrJWTNoSubject
+	}
+	policy := v.defaults
+	scopes := claimStrings(claims, v.conf.ScopeClaim)
+	for _, s := range v.scopes {
+		if containsString(scopes, s.Scope) {
+			policy = &s.ClientPolicy
+			break
+		}
+	}
+	client := &authClient{id: "jwt:" + sub, label: policy.Label, policy: policy}
+	if jsoniter.Get(claims, v.conf.MethodsClaim).LastError() == nil {
+		// an empty list allows no method
+		client.access = &methodAccess{allow: append([]string{}, claimStrings(claims, v.conf.MethodsClaim)...), err: errMethodNotAllowed}
+	}
+	return client, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims string) string {
+	header := fmt.Sprintf(`{"alg":%q,"typ":"JWT"}`, alg)
+	if kid != "" {
+		header = fmt.Sprintf(`{"alg":%q,"kid":%q}`, alg, kid)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"rsa","use":"sig","n":%q,"e":%q},
+		{"kty":"EC","kid":"ec","crv":"P-256","x":%q,"y":%q},
+		{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"},
+		{"kty":"OKP","kid":"ed","crv":"Ed25519","x":"AAAA"}
+	]}`, enc(rsaKey.N.Bytes()), enc(big.NewInt(int64(rsaKey.E)).Bytes()), enc(ecKey.X.Bytes()), enc(ecKey.Y.Bytes()))
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(file, []byte(jwks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestJWTVerify(t *testing.T) {
+	assert := assertion.New(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	conf := &JWTConfig{
+		Secrets:  []string{"old", "secret"},
+		JWKSFile: writeJWKS(t, rsaKey, ecKey),
+		Issuer:   "auth",
+		Audience: "rpc",
+		Leeway:   Duration{Duration: time.Minute},
+	}
+	conf.SetDefaults()
+	var errs ConfigErrors
+	conf.check("auth.jwt", nil, &errs)
+	assert.Empty(errs)
+	rate := &RateLimitConfig{}
+	rate.SetDefaults()
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	v, err := newJWTVerifier(conf, rate, clock)
+	assert.NoError(err)
+	assert.Len(v.keys, 2)
+
+	claims := `{"sub":"alice","iss":"auth","aud":["rpc","other"],"exp":1600000100,"nbf":1600000030}`
+	for _, c := range []struct {
+		token string
+		err   error
+	}{
+		{signJWT(t, JWTAlgHS256, "", []byte("secret"), claims), nil},
+		{signJWT(t, JWTAlgRS256, "rsa", rsaKey, claims), nil},
+		{signJWT(t, JWTAlgRS256, "", rsaKey, claims), nil},
+		{signJWT(t, JWTAlgES256, "ec", ecKey, claims), nil},
+		{signJWT(t, JWTAlgHS256, "", []byte("wrong"), claims), ErrJWTSignature},
+		{signJWT(t, JWTAlgRS256, "ec", rsaKey, claims), ErrJWTUnknownKey},
+		{signJWT(t, JWTAlgES256, "", rsaKey, claims), ErrJWTSignature},
+		{signJWT(t, "none", "", []byte{}, claims), ErrJWTAlgorithm},
+		{signJWT(t, JWTAlgHS256, "", []byte("secret"), `{"sub":"alice","iss":"auth","aud":"rpc","exp":1599999900}`), ErrJWTExpired},
+		{signJWT(t, JWTAlgHS256, "", []byte("secret"), `{"sub":"alice","iss":"auth","aud":"rpc","exp":1600000200,"nbf":1600000100}`), ErrJWTNotYetValid},
+		{signJWT(t, JWTAlgHS256, "", []byte("secret"), `{"sub":"alice","iss":"other","aud":"rpc","exp":1600000100}`), ErrJWTIssuer},
+		{signJWT(t, JWTAlgHS256, "", []byte("secret"), `{"sub":"alice","iss":"auth","aud":"other","exp":1600000100}`), ErrJWTAudience},
+		{signJWT(t, JWTAlgHS256, "", []byte("secret"), `{"sub":"alice","iss":"auth","aud":"rpc"}`), ErrJWTNoExpiry},
+		{signJWT(t, JWTAlgHS256, "", []byte("secret"), `{"sub":"alice","iss":"auth","aud":"rpc","exp":"never"}`), ErrJWTInvalidClaim},
+		{signJWT(t, JWTAlgHS256, "", []byte("secret"), `[]`), ErrJWTMalformed},
+		{"a.b", ErrJWTMalformed},
+	} {
+		_, err := v.Verify(c.token)
+		assert.Equal(c.err, err, c.token)
+	}
+	conf.AllowNoExp = true
+	_, err = v.Verify(signJWT(t, JWTAlgHS256, "", []byte("secret"), `{"sub":"alice","iss":"auth","aud":"rpc"}`))
+	assert.NoError(err)
+
+	// public keys only
+	conf = &JWTConfig{JWKSFile: conf.JWKSFile}
+	conf.SetDefaults()
+	v, err = newJWTVerifier(conf, rate, clock)
+	assert.NoError(err)
+	_, err = v.Verify(signJWT(t, JWTAlgHS256, "", []byte(""), claims))
+	assert.Equal(ErrJWTAlgorithm, err)
+
+	errs = nil
+	(&JWTConfig{Secrets: []string{""}, Scopes: []*JWTScope{{Scope: "a"}, {Scope: "a"}}}).check("jwt", nil, &errs)
+	assert.Len(errs, 2)
+	errs = nil
+	(&JWTConfig{}).check("jwt", nil, &errs)
+	assert.Len(errs, 1)
+}
+
+func TestJWTAuthHandler(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newNegativeUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		Auth: &AuthConfig{Required: true, JWT: &JWTConfig{
+			Secrets:    []string{"secret"},
+			AllowNoExp: true,
+			Scopes: []*JWTScope{
+				{Scope: "read", ClientPolicy: ClientPolicy{Methods: []string{"GetBalance", "GetBlock"}, RateLimit: &RateLimit{Rate: 1, Burst: 2}}},
+				{Scope: "admin", ClientPolicy: ClientPolicy{Label: "admins"}},
+			},
+		}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+	h := p.authHandler(p.rateLimitHandler(p.requestHandler))
+	do := func(token, body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/")
+		if token != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+token)
+		}
+		ctx.Request.SetBodyString(body)
+		h(ctx)
+		return ctx
+	}
+	secret := []byte("secret")
+	req := `{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}`
+	batch := `[{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]},{"jsonrpc":"2.0","id":2,"method":"Echo","params":[]}]`
+
+	ctx := do("", req)
+	assert.Equal(fasthttp.StatusUnauthorized, ctx.Response.StatusCode())
+	assert.Contains(string(ctx.Response.Body()), "API key or bearer token is required")
+	ctx = do(signJWT(t, JWTAlgHS256, "", []byte("wrong"), `{"sub":"alice"}`), req)
+	assert.Equal(fasthttp.StatusUnauthorized, ctx.Response.StatusCode())
+	assert.Equal(`{"id":1,"jsonrpc":"2.0","error":{"code":-32001,"message":"Unauthorized","data":"invalid token: invalid signature"}}`, string(ctx.Response.Body()))
+	assert.Equal(`Bearer error="invalid_token"`, string(ctx.Response.Header.Peek(fasthttp.HeaderWWWAuthenticate)))
+	ctx = do(signJWT(t, JWTAlgHS256, "", secret, `{"scope":"read"}`), req)
+	assert.Contains(string(ctx.Response.Body()), "missing subject")
+	assert.EqualValues(0, atomic.LoadInt64(&calls))
+
+	// methods of the scope
+	alice := signJWT(t, JWTAlgHS256, "", secret, `{"sub":"alice","scope":"profile read"}`)
+	ctx = do(alice, batch)
+	assert.Equal(200, ctx.Response.StatusCode())
+	var resps []jsonrpc.RpcResponse
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &resps))
+	if assert.Len(resps, 2) {
+		assert.Equal([]interface{}{"GetBalance"}, resps[0].Result)
+		assert.EqualValues(jsonrpc.ErrRpcMethodNotFound.Code, resps[1].Error.Code)
+	}
+	assert.Equal("read", getCtxClient(ctx).label)
+	// rate limits of the scope are per subject
+	ctx = do(alice, req)
+	assert.Equal(fasthttp.StatusTooManyRequests, ctx.Response.StatusCode())
+	ctx = do(signJWT(t, JWTAlgHS256, "", secret, `{"sub":"bob","scope":["read"]}`), req)
+	assert.Equal(200, ctx.Response.StatusCode())
+
+	// methods of the claim restrict those of the scope
+	ctx = do(signJWT(t, JWTAlgHS256, "", secret, `{"sub":"carol","scope":"admin","methods":["Echo"]}`), batch)
+	resps = nil
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &resps))
+	if assert.Len(resps, 2) {
+		assert.EqualValues(jsonrpc.ErrRpcMethodNotFound.Code, resps[0].Error.Code)
+		assert.Equal([]interface{}{"Echo"}, resps[1].Result)
+	}
+	assert.Equal("admins", getCtxClient(ctx).label)
+	assert.Equal("jwt:carol", getCtxClient(ctx).id)
+	// tokens without scope matched
+	ctx = do(signJWT(t, JWTAlgHS256, "", secret, `{"sub":"dave"}`), batch)
+	assert.Equal(200, ctx.Response.StatusCode())
+	assert.Equal(defaultJWTLabel, getCtxClient(ctx).label)
+}
@@ -28,8 +28,8 @@ func main() {
 	}
 	flags := rootCmd.Flags()
 	printVer := flags.BoolP("version", "v", false, "print version")
-	path := flags.StringP("config", "c", "proxy.yaml", "the path of config file")
-	_ = rootCmd.MarkFlagFilename("config", "yaml", "yml")
+	path := rootCmd.PersistentFlags().StringP("config", "c", "proxy.yaml", "the path of config file")
+	_ = rootCmd.MarkPersistentFlagFilename("config", "yaml", "yml")
 	//_ = cobra.MarkFlagRequired(flags, "config")
 	//ctx, cancel := context.WithCancel(context.Background())
 	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
@@ -51,7 +51,10 @@ func main() {
 		initLog(config)
 		return runMain(config)
 	}
-	_ = rootCmd.Execute()
+	rootCmd.AddCommand(newConfigCmd(path))
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
 
 func runMain(config *Config) error {
@@ -73,18 +76,29 @@ func runMain(config *Config) error {
 		statistic.InitStatistic(debugMode)
 	}
 
+	// forwarding headers are honored only from trusted proxies
+	trusted := newIPNets(config.TrustedProxies)
 	var manageServer *fasthttp.Server
 	m := NewManage(config, p)
+	// paths other than RPC routes get the CORS policy of their server
+	cors := p.corsPolicy(p.cors)
 	if serverListen == manageListen {
 		log.Warn("Manage Server listens at the same address with RPC Server")
+		if m.ips == nil {
+			// anyone reaching the RPC Server could purge the cache or lift bans
+			log.Warn("manage handlers changing the cache, bans and throttles are disabled, set manage.ipAccess to enable them")
+			m.readOnly = true
+		}
 		m.registerHandler(r)
+		cors = p.corsPolicy(m.cors)
 	} else {
 		r := router.New()
 		m.registerHandler(r)
-		h := useMiddleWares(r.Handler, panicHandler, Cors, fasthttp.CompressHandler, accessLogMetricHandler("[Manage] ", config))
+		manageCors := func(ctx *fasthttp.RequestCtx) *corsPolicy { return m.cors }
+		h := useMiddleWares(r.Handler, panicHandler, corsHandler(manageCors), fasthttp.CompressHandler, accessLogMetricHandler("[Manage] ", config), clientIPHandler(trusted))
 		manageServer = newServer("JSON-RPC Proxy Manage Server", h, log.TraceLevel, config)
 	}
-	h := useMiddleWares(r.Handler, panicHandler, Cors, fasthttp.CompressHandler, accessLogMetricHandler("", config))
+	h := useMiddleWares(r.Handler, p.quotaHandler, p.rateLimitHandler, p.abuseHandler, p.authHandler, p.ipFilterHandler, panicHandler, corsHandler(cors), fasthttp.CompressHandler, accessLogMetricHandler("", config), clientIPHandler(trusted))
 	server := newServer("JSON-RPC Proxy Server", h, log.TraceLevel, config)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -96,6 +110,8 @@ func runMain(config *Config) error {
 		wg.Add(1)
 		go runServer(ctx, manageServer, manageListen, wg)
 	}
+	go p.StartWarmup(ctx)
+	go p.TrackTip(ctx)
 
 	sigCh := make(chan os.Signal)
 	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM)
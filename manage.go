@@ -1,29 +1,404 @@
 package main
 
 import (
+	"fmt"
 	"github.com/fasthttp/router"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
 	"github.com/savsgio/gotils/nocopy"
+	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/pprofhandler"
+	"time"
 )
 
+// DefaultManageKeysLimit is the max number of keys listed by the cache keys API if limit is not given
+const DefaultManageKeysLimit = 1000
+
+type manageError struct {
+	Error string `json:"error"`
+}
+
+type manageCacheTiers struct {
+	Tiers []string `json:"tiers"`
+}
+
+type manageCacheEntries struct {
+	Key     string        `json:"key"`
+	Entries []*CacheEntry `json:"entries,omitempty"`
+}
+
+type manageCacheKeys struct {
+	Prefix string   `json:"prefix,omitempty"`
+	Keys   []string `json:"keys,omitempty"`
+	Count  int      `json:"count"`
+}
+
+type manageNegativeEntries struct {
+	Entries []*NegativeEntry `json:"entries"`
+	Count   int              `json:"count"`
+}
+
+type manageUsage struct {
+	Usage []*QuotaUsage `json:"usage"`
+}
+
+type manageBans struct {
+	Bans  []*IPBan `json:"bans"`
+	Count int      `json:"count"`
+}
+
+type manageThrottled struct {
+	Clients []*ThrottledClient `json:"clients"`
+	Count   int                `json:"count"`
+}
+
+type manageStatus struct {
+	Version string            `json:"version"`
+	Tip     uint64            `json:"tip,omitempty"`
+	Cache   []*CacheTierStats `json:"cache"`
+}
+
 type Manage struct {
 	nocopy.NoCopy
 	config *Config
 	Proxy  *Proxy
+	ips    *ipAccess
+	cors   *corsPolicy
+	// readOnly leaves out the handlers changing the cache, bans and throttles
+	readOnly bool
 }
 
 func NewManage(config *Config, proxy *Proxy) *Manage {
-	return &Manage{config: config, Proxy: proxy}
+	return &Manage{config: config, Proxy: proxy, ips: newIPAccess(config.Manage.IPAccess), cors: newCorsPolicy(config.Manage.Cors)}
 }
 
 func (m *Manage) registerHandler(r *router.Router) {
-	r.GET("/debug/pprof/{name:*}", pprofhandler.PprofHandler)
-	r.GET(m.config.Manage.MetricsPath, PrometheusHandler)
+	r.GET("/debug/pprof/{name:*}", m.guard(pprofhandler.PprofHandler))
+	r.GET(m.config.Manage.MetricsPath, m.guard(PrometheusHandler))
+	r.GET("/healthz", m.guard(m.Healthz))
+	r.GET("/ready", m.guard(m.Ready))
 	group := r.Group(m.config.Manage.Path)
-	group.GET("/", m.Index)
+	group.GET("/", m.guard(m.Index))
+	group.GET("/status", m.guard(m.Status))
+	group.GET("/cache/tiers", m.guard(m.CacheTiers))
+	group.GET("/cache/entry", m.guard(m.GetCacheEntry))
+	group.GET("/cache/keys", m.guard(m.ListCacheKeys))
+	group.GET("/usage", m.guard(m.Usage))
+	group.GET("/negative", m.guard(m.ListNegative))
+	group.GET("/bans", m.guard(m.ListBans))
+	group.GET("/abuse/throttled", m.guard(m.ListThrottled))
+	if m.readOnly {
+		return
+	}
+	group.DELETE("/cache", m.guard(m.ClearCache))
+	group.DELETE("/cache/tiers/{tier}", m.guard(m.ClearCacheTier))
+	group.DELETE("/cache/entry", m.guard(m.DeleteCacheEntry))
+	group.DELETE("/cache/keys", m.guard(m.DeleteCacheKeys))
+	group.DELETE("/negative", m.guard(m.DeleteNegative))
+	group.POST("/bans", m.guard(m.Ban))
+	group.DELETE("/bans", m.guard(m.Unban))
+	group.DELETE("/abuse/throttled", m.guard(m.Unthrottle))
+}
+
+// guard rejects clients denied by manage.ipAccess, the handlers are guarded one by one as they may
+// share the router of the RPC server.
+func (m *Manage) guard(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if m.ips == nil {
+		return h
+	}
+	return func(ctx *fasthttp.RequestCtx) {
+		if !m.ips.Allowed(clientIP(ctx)) {
+			IPRejected.WithLabelValues("denied").Inc()
+			writeManageError(ctx, fasthttp.StatusForbidden, errors.New("forbidden"))
+			return
+		}
+		h(ctx)
+	}
 }
 
 func (m *Manage) Index(ctx *fasthttp.RequestCtx) {
 	_, _ = ctx.WriteString("JSON-RPC PROXY MANAGE PAGE")
 }
+
+func (m *Manage) Healthz(ctx *fasthttp.RequestCtx) {
+	_, _ = ctx.WriteString("ok")
+}
+
+// Ready responds 503 until the startup warmup is done.
+func (m *Manage) Ready(ctx *fasthttp.RequestCtx) {
+	if !m.Proxy.Ready() {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		_, _ = ctx.WriteString("warming up")
+		return
+	}
+	_, _ = ctx.WriteString("ok")
+}
+
+func (m *Manage) Status(ctx *fasthttp.RequestCtx) {
+	writeManageJson(ctx, fasthttp.StatusOK, &manageStatus{Version: version, Tip: m.Proxy.Tip(), Cache: m.Proxy.CacheManager.Stats()})
+}
+
+func (m *Manage) CacheTiers(ctx *fasthttp.RequestCtx) {
+	writeManageJson(ctx, fasthttp.StatusOK, &manageCacheTiers{Tiers: m.Proxy.CacheManager.TierNames()})
+}
+
+// GetCacheEntry looks up a key given by `key`, or by `method` and `params` in JSON.
+func (m *Manage) GetCacheEntry(ctx *fasthttp.RequestCtx) {
+	key, err := manageCacheKey(ctx, m.Proxy)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	entries := m.Proxy.CacheManager.Lookup(key)
+	if len(entries) == 0 {
+		writeManageError(ctx, fasthttp.StatusNotFound, fmt.Errorf("key %s is not cached", key))
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageCacheEntries{Key: key, Entries: entries})
+}
+
+func (m *Manage) DeleteCacheEntry(ctx *fasthttp.RequestCtx) {
+	key, err := manageCacheKey(ctx, m.Proxy)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	err = m.Proxy.CacheManager.Delete(key)
+	auditLog(ctx, "cache.delete", log.Fields{"key": key}, err)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageCacheEntries{Key: key})
+}
+
+// ListCacheKeys lists keys of `method` or having `prefix`, at most `limit` keys are listed.
+func (m *Manage) ListCacheKeys(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	limit := DefaultManageKeysLimit
+	if args.Has("limit") {
+		l, err := args.GetUint("limit")
+		if err != nil {
+			writeManageError(ctx, fasthttp.StatusBadRequest, errors.Wrap(err, "invalid limit"))
+			return
+		}
+		limit = l
+	}
+	keys, err := m.Proxy.CacheManager.Keys(manageCachePrefix(ctx), limit)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageCacheKeys{Keys: keys, Count: len(keys)})
+}
+
+// DeleteCacheKeys deletes keys of `method` or having `prefix`, use DELETE /cache to delete all.
+func (m *Manage) DeleteCacheKeys(ctx *fasthttp.RequestCtx) {
+	prefix := manageCachePrefix(ctx)
+	if prefix == "" {
+		writeManageError(ctx, fasthttp.StatusBadRequest, errors.New("method or prefix is required"))
+		return
+	}
+	n, err := m.Proxy.CacheManager.DeleteByPrefix(prefix)
+	auditLog(ctx, "cache.deleteKeys", log.Fields{"prefix": prefix, "deleted": n}, err)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageCacheKeys{Prefix: prefix, Count: n})
+}
+
+// Usage lists compute units spent by the client of `key`, or by every client.
+func (m *Manage) Usage(ctx *fasthttp.RequestCtx) {
+	if m.Proxy.quotas == nil {
+		writeManageError(ctx, fasthttp.StatusNotFound, errors.New("quota is not enabled"))
+		return
+	}
+	key := string(ctx.QueryArgs().Peek("key"))
+	usage := m.Proxy.quotas.Usage(key)
+	if key != "" && len(usage) == 0 {
+		writeManageError(ctx, fasthttp.StatusNotFound, fmt.Errorf("no usage of %s", key))
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageUsage{Usage: usage})
+}
+
+// ListNegative lists the errors learned from upstream.
+func (m *Manage) ListNegative(ctx *fasthttp.RequestCtx) {
+	if m.Proxy.negative == nil {
+		writeManageError(ctx, fasthttp.StatusNotFound, ErrNegativeCacheDisabled)
+		return
+	}
+	entries := m.Proxy.negative.Entries()
+	writeManageJson(ctx, fasthttp.StatusOK, &manageNegativeEntries{Entries: entries, Count: len(entries)})
+}
+
+// DeleteNegative forgets the learned error of `key`, or all learned errors if key is not given.
+func (m *Manage) DeleteNegative(ctx *fasthttp.RequestCtx) {
+	key := string(ctx.QueryArgs().Peek("key"))
+	n, err := m.Proxy.negative.Delete(key)
+	auditLog(ctx, "negative.delete", log.Fields{"key": key, "deleted": n}, err)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusNotFound, err)
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageNegativeEntries{Count: n})
+}
+
+// ListBans lists the temporary bans of client IPs in effect.
+func (m *Manage) ListBans(ctx *fasthttp.RequestCtx) {
+	bans := m.Proxy.bans.List()
+	writeManageJson(ctx, fasthttp.StatusOK, &manageBans{Bans: bans, Count: len(bans)})
+}
+
+// Ban bans `prefix`, an IP or a CIDR range, from RPC routes for `for` (1h by default) for `reason`.
+func (m *Manage) Ban(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	prefix := string(args.Peek("prefix"))
+	d := DefaultBanFor
+	if args.Has("for") {
+		var err error
+		if d, err = time.ParseDuration(string(args.Peek("for"))); err != nil {
+			writeManageError(ctx, fasthttp.StatusBadRequest, errors.Wrap(err, "invalid for"))
+			return
+		}
+	}
+	reason := string(args.Peek("reason"))
+	ban, err := m.Proxy.bans.Ban(prefix, d, reason)
+	auditLog(ctx, "ip.ban", log.Fields{"prefix": prefix, "for": d, "reason": reason}, err)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageBans{Bans: []*IPBan{ban}, Count: 1})
+}
+
+// Unban lifts the ban of `prefix`.
+func (m *Manage) Unban(ctx *fasthttp.RequestCtx) {
+	prefix := string(ctx.QueryArgs().Peek("prefix"))
+	err := m.Proxy.bans.Unban(prefix)
+	auditLog(ctx, "ip.unban", log.Fields{"prefix": prefix}, err)
+	switch {
+	case errors.Is(err, ErrUnknownBan):
+		writeManageError(ctx, fasthttp.StatusNotFound, err)
+	case err != nil:
+		writeManageError(ctx, fasthttp.StatusBadRequest, err)
+	default:
+		writeManageJson(ctx, fasthttp.StatusOK, &manageBans{Count: 1})
+	}
+}
+
+// ListThrottled lists clients throttled by abuse rules.
+func (m *Manage) ListThrottled(ctx *fasthttp.RequestCtx) {
+	if m.Proxy.abuse == nil {
+		writeManageError(ctx, fasthttp.StatusNotFound, errors.New("abuse detection is not enabled"))
+		return
+	}
+	clients := m.Proxy.abuse.Throttled()
+	writeManageJson(ctx, fasthttp.StatusOK, &manageThrottled{Clients: clients, Count: len(clients)})
+}
+
+// Unthrottle lifts the throttle of the client of `key`.
+func (m *Manage) Unthrottle(ctx *fasthttp.RequestCtx) {
+	if m.Proxy.abuse == nil {
+		writeManageError(ctx, fasthttp.StatusNotFound, errors.New("abuse detection is not enabled"))
+		return
+	}
+	key := string(ctx.QueryArgs().Peek("key"))
+	err := m.Proxy.abuse.Unthrottle(key)
+	auditLog(ctx, "abuse.unthrottle", log.Fields{"key": key}, err)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusNotFound, err)
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageThrottled{Count: 1})
+}
+
+func (m *Manage) ClearCacheTier(ctx *fasthttp.RequestCtx) {
+	tier, _ := ctx.UserValue("tier").(string)
+	err := m.Proxy.CacheManager.ClearTier(tier)
+	auditLog(ctx, "cache.clearTier", log.Fields{"tier": tier}, err)
+	switch {
+	case errors.Is(err, ErrUnknownCacheTier):
+		writeManageError(ctx, fasthttp.StatusNotFound, err)
+	case err != nil:
+		writeManageError(ctx, fasthttp.StatusInternalServerError, err)
+	default:
+		writeManageJson(ctx, fasthttp.StatusOK, &manageCacheTiers{Tiers: []string{tier}})
+	}
+}
+
+func (m *Manage) ClearCache(ctx *fasthttp.RequestCtx) {
+	err := m.Proxy.CacheManager.Clear()
+	auditLog(ctx, "cache.clear", nil, err)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	writeManageJson(ctx, fasthttp.StatusOK, &manageCacheTiers{Tiers: m.Proxy.CacheManager.TierNames()})
+}
+
+func manageCacheKey(ctx *fasthttp.RequestCtx, p *Proxy) (string, error) {
+	args := ctx.QueryArgs()
+	if key := args.Peek("key"); len(key) > 0 {
+		return string(key), nil
+	}
+	method := string(args.Peek("method"))
+	if method == "" {
+		return "", errors.New("key or method is required")
+	}
+	req := jsonrpc.RpcRequest{Method: method}
+	if params := args.Peek("params"); len(params) > 0 {
+		if err := jsoniter.Unmarshal(params, &req.Params); err != nil {
+			return "", errors.Wrap(err, "invalid params")
+		}
+	}
+	group := string(args.Peek("group"))
+	if group != "" && p.groups[group] == nil {
+		return "", fmt.Errorf("unknown upstream group %s", group)
+	}
+	return p.cacheKey(group, &req)
+}
+
+func manageCachePrefix(ctx *fasthttp.RequestCtx) string {
+	args := ctx.QueryArgs()
+	if method := args.Peek("method"); len(method) > 0 {
+		// keys are in the form of `method(params)`
+		return string(method) + "("
+	}
+	return string(args.Peek("prefix"))
+}
+
+// auditLog logs a mutating call of the manage API.
+func auditLog(ctx *fasthttp.RequestCtx, action string, fields log.Fields, err error) {
+	entry := log.WithFields(fields).WithFields(log.Fields{
+		"audit":  true,
+		"action": action,
+		"remote": clientIP(ctx).String(),
+	})
+	if err != nil {
+		entry.WithError(err).Warn("manage action failed")
+		return
+	}
+	entry.Info("manage action done")
+}
+
+func writeManageJson(ctx *fasthttp.RequestCtx, code int, v interface{}) {
+	data, err := jsoniter.Marshal(v)
+	if err != nil {
+		writeManageError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetStatusCode(code)
+	ctx.SetBody(data)
+}
+
+func writeManageError(ctx *fasthttp.RequestCtx, code int, err error) {
+	data, _ := jsoniter.Marshal(&manageError{Error: err.Error()})
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetStatusCode(code)
+	ctx.SetBody(data)
+}
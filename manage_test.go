@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/fasthttp/router"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"testing"
+	"time"
+)
+
+func TestManageCache(t *testing.T) {
+	assert := assertion.New(t)
+	config := &Config{Upstreams: []string{"http://127.0.0.1:4201"}, Cache: &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16}}
+	config.SetDefaults()
+	p := NewProxy(config)
+	r := router.New()
+	p.RegisterHandler(r)
+	NewManage(config, p).registerHandler(r)
+	do := func(method, uri string) (int, map[string]interface{}) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI(uri)
+		r.Handler(ctx)
+		res := map[string]interface{}{}
+		_ = jsoniter.Unmarshal(ctx.Response.Body(), &res)
+		return ctx.Response.StatusCode(), res
+	}
+	assert.NoError(p.CacheManager.Set(`GetBalance(["a"])`, []byte(`{"r":1}`), time.Minute))
+	assert.NoError(p.CacheManager.Set(`GetBalance(["b"])`, []byte(`{"r":2}`), time.Minute))
+
+	code, res := do("GET", `/manage/cache/entry?method=GetBalance&params=["a"]`)
+	assert.Equal(200, code)
+	assert.Equal(`GetBalance(["a"])`, res["key"])
+	code, _ = do("GET", `/manage/cache/entry?key=none`)
+	assert.Equal(404, code)
+	code, _ = do("GET", `/manage/cache/entry`)
+	assert.Equal(400, code)
+	code, _ = do("GET", `/manage/cache/entry?method=GetBalance&params=["a"]&group=none`)
+	assert.Equal(400, code)
+
+	code, res = do("GET", `/manage/cache/keys?method=GetBalance`)
+	assert.Equal(200, code)
+	assert.EqualValues(2, res["count"])
+
+	code, res = do("GET", `/manage/status`)
+	assert.Equal(200, code)
+	tiers := res["cache"].([]interface{})
+	assert.Len(tiers, 1)
+	assert.EqualValues(2, tiers[0].(map[string]interface{})["entries"])
+	assert.Equal(8, testutil.CollectAndCount(CacheCollector))
+
+	code, _ = do("DELETE", `/manage/cache/entry?key=GetBalance(["a"])`)
+	assert.Equal(200, code)
+	assert.Nil(p.CacheManager.Get(`GetBalance(["a"])`, time.Minute))
+
+	code, _ = do("DELETE", `/manage/cache/keys`)
+	assert.Equal(400, code)
+	code, res = do("DELETE", `/manage/cache/keys?method=GetBalance`)
+	assert.Equal(200, code)
+	assert.EqualValues(1, res["count"])
+
+	code, _ = do("DELETE", `/manage/cache/tiers/none`)
+	assert.Equal(404, code)
+	code, _ = do("DELETE", `/manage/cache/tiers/lru`)
+	assert.Equal(200, code)
+	code, _ = do("DELETE", `/manage/cache`)
+	assert.Equal(200, code)
+
+	// without changing handlers
+	r = router.New()
+	m := NewManage(config, p)
+	m.readOnly = true
+	m.registerHandler(r)
+	code, _ = do("GET", `/manage/cache/keys?method=GetBalance`)
+	assert.Equal(200, code)
+	code, _ = do("DELETE", `/manage/cache`)
+	assert.Equal(fasthttp.StatusNotFound, code)
+	code, _ = do("POST", `/manage/bans?prefix=2.2.2.2&for=1m`)
+	assert.Equal(fasthttp.StatusMethodNotAllowed, code)
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"sync"
 )
 
 const MetricsNs = "jsonrpc_proxy"
@@ -65,8 +66,194 @@ var (
 		},
 		[]string{"method"},
 	)
+	WarmupRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "cache_warmup_requests_total",
+			Help:      "Total number of requests sent to warm up cache by source and result.",
+		},
+		[]string{"source", "result"},
+	)
+	RefreshAheadRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "cache_refresh_ahead_total",
+			Help:      "Total number of hot results refreshed before expiring by method and result.",
+		},
+		[]string{"method", "result"},
+	)
+	RpcCacheEarlyExpired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "rpc_cache_early_expired_total",
+			Help:      "Total number of cached results recomputed early by XFetch.",
+		},
+		[]string{"method"},
+	)
+	RpcCacheNotAdmitted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "rpc_cache_not_admitted_total",
+			Help:      "Total number of results not cached by admission policies of cache rules by reason.",
+		},
+		[]string{"method", "reason"},
+	)
+	RpcCacheBypass = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "rpc_cache_bypass_total",
+			Help:      "Total number of requests fetched from upstream as clients asked by Cache-Control: no-cache.",
+		},
+		[]string{"method"},
+	)
+	RateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "rate_limited_requests_total",
+			Help:      "Total number of requests rejected by rate limits of clients or methods.",
+		},
+		[]string{"limit", "rpc_method"},
+	)
+	ComputeUnits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "compute_units_total",
+			Help:      "Total number of compute units charged to clients by method.",
+		},
+		[]string{"rpc_method"},
+	)
+	QuotaExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "quota_exceeded_requests_total",
+			Help:      "Total number of HTTP requests rejected as clients are out of compute units by period.",
+		},
+		[]string{"period"},
+	)
+	AuthRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "auth_rejected_requests_total",
+			Help:      "Total number of HTTP requests rejected for missing or unknown API keys or invalid tokens.",
+		},
+		[]string{"reason"},
+	)
+	ApiKeyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "api_key_requests_total",
+			Help:      "Total number of RPC requests by label of API keys and token scopes.",
+		},
+		[]string{"key", "rpc_method"},
+	)
+	MethodDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "method_denied_requests_total",
+			Help:      "Total number of RPC requests of methods reserved, or denied on their route or to their client.",
+		},
+		[]string{"by"},
+	)
+	IPRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "ip_rejected_requests_total",
+			Help:      "Total number of HTTP requests rejected for denied or banned client IPs.",
+		},
+		[]string{"reason"},
+	)
+	AbuseDetected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "abuse_detected_total",
+			Help:      "Total number of abuse rules triggered by clients, by rule and action.",
+		},
+		[]string{"rule", "action"},
+	)
+	RpcNegativeCacheHit = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "rpc_negative_cache_hits_total",
+			Help:      "Total number of requests answered by errors learned from upstream.",
+		},
+		[]string{"method"},
+	)
+	RpcCacheImmutable = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "rpc_cache_immutable_total",
+			Help:      "Total number of results cached as immutable.",
+		},
+		[]string{"method"},
+	)
+	CacheOversized = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricsNs,
+			Name:      "cache_oversized_total",
+			Help:      "Total number of entries not cached for exceeding cache.maxEntrySize.",
+		},
+		[]string{"tier"},
+	)
 )
 
+// cacheCollector collects stats of the cache tiers at scraping time.
+type cacheCollector struct {
+	mu      sync.RWMutex
+	manager *CacheManager
+
+	entries, bytes, methodBytes                         *prometheus.Desc
+	hits, misses, collisions, evictions, expiredEntries *prometheus.Desc
+}
+
+func newCacheDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(MetricsNs, "cache", name), help, append([]string{"tier"}, labels...), nil)
+}
+
+var CacheCollector = &cacheCollector{
+	entries:        newCacheDesc("entries", "Number of entries in the cache tier."),
+	bytes:          newCacheDesc("bytes", "Bytes used by entries of the cache tier."),
+	methodBytes:    newCacheDesc("method_bytes", "Bytes used by entries of the cache tier by rpc method.", "method"),
+	hits:           newCacheDesc("hits_total", "Total number of hits of the cache tier."),
+	misses:         newCacheDesc("misses_total", "Total number of misses of the cache tier."),
+	collisions:     newCacheDesc("collisions_total", "Total number of key collisions of the cache tier."),
+	evictions:      newCacheDesc("evictions_total", "Total number of entries evicted for lack of space."),
+	expiredEntries: newCacheDesc("expired_total", "Total number of entries found expired and removed."),
+}
+
+// SetManager sets the CacheManager whose tiers are collected.
+func (c *cacheCollector) SetManager(m *CacheManager) {
+	c.mu.Lock()
+	c.manager = m
+	c.mu.Unlock()
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.entries, c.bytes, c.methodBytes, c.hits, c.misses, c.collisions, c.evictions, c.expiredEntries} {
+		ch <- d
+	}
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	m := c.manager
+	c.mu.RUnlock()
+	if m == nil {
+		return
+	}
+	for _, s := range m.Stats() {
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(s.Entries), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(s.Bytes), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(s.Hits), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(s.Misses), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.collisions, prometheus.CounterValue, float64(s.Collisions), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(s.Evictions), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.expiredEntries, prometheus.CounterValue, float64(s.Expired), s.Name)
+		for _, mb := range s.Methods {
+			ch <- prometheus.MustNewConstMetric(c.methodBytes, prometheus.GaugeValue, float64(mb.Bytes), s.Name, mb.Method)
+		}
+	}
+}
+
 //func PromFastHttpMiddleware(metricsPath string) MiddleWare {
 //	return func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 //		return func(ctx *fasthttp.RequestCtx) {
@@ -90,6 +277,8 @@ var (
 func init() {
 	prometheus.MustRegister(
 		ReqDuration, ReqCount, HttpReqCnt, SentBytes, RecvBytes,
-		RpcCacheHit, RpcCacheMiss,
+		RpcCacheHit, RpcCacheMiss, CacheOversized, CacheCollector, WarmupRequests, RefreshAheadRequests, RpcCacheEarlyExpired, RpcCacheNotAdmitted, RpcCacheImmutable,
+		RpcNegativeCacheHit, RpcCacheBypass, RateLimited, ComputeUnits, QuotaExceeded,
+		AuthRejected, ApiKeyRequests, MethodDenied, IPRejected, AbuseDetected,
 	)
 }
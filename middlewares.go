@@ -3,8 +3,6 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"github.com/AdhityaRamadhanus/fasthttpcors"
-	realip "github.com/Ferluci/fast-realip"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
 	"github.com/savsgio/gotils"
@@ -80,11 +78,17 @@ func accessLogMetricHandler(prefix string, config *Config) MiddleWare {
 				if rpcMethods = getCtxRpcMethods(ctx); rpcMethods != nil {
 					methodsStr = strings.Join(rpcMethods, ",")
 				}
+				// the user is the label of the client, API keys are never logged
+				user := "-"
+				if c := getCtxClient(ctx); c != nil {
+					user = c.label
+				}
 				if config.AccessLog {
 					log.Infof(
-						`%sRPC - %s - "%s %s" %s %d %d "%s" %s`+"\n",
+						`%sRPC - %s %s "%s %s" %s %d %d "%s" %s`+"\n",
 						prefix,
-						realip.FromRequest(ctx),
+						clientIP(ctx).String(),
+						user,
 						ctx.RequestURI(),
 						methodsStr,
 						errStr,
@@ -104,7 +108,7 @@ func accessLogMetricHandler(prefix string, config *Config) MiddleWare {
 						`%s%s - %s - "%s %s" %d %d %d "%s" %s`+"\n",
 						prefix,
 						bytes.ToUpper(ctx.URI().Scheme()),
-						realip.FromRequest(ctx),
+						clientIP(ctx).String(),
 						ctx.Method(),
 						ctx.RequestURI(),
 						status,
@@ -165,14 +169,3 @@ type LeveledLogger struct {
 func (l LeveledLogger) Printf(format string, args ...interface{}) {
 	log.StandardLogger().Logf(l.level, format, args...)
 }
-
-var Cors MiddleWare
-
-func init() {
-	corsHandler := fasthttpcors.NewCorsHandler(fasthttpcors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedHeaders: []string{"*"},
-		AllowedMethods: []string{"GET", "POST"},
-	})
-	Cors = corsHandler.CorsMiddleware
-}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMethodNotFoundFor   = time.Minute
+	DefaultInvalidParamsFor    = 10 * time.Second
+	DefaultNegativeMaxEntries  = 10000
+	negativeCacheSweepInterval = time.Minute
+)
+
+var ErrNegativeCacheDisabled = errors.New("negative cache is not enabled")
+
+// NegativeCacheConfig configures errors learned from upstream and answered locally, even for
+// methods without cache rule.
+type NegativeCacheConfig struct {
+	// MethodNotFoundFor is how long a method answered with MethodNotFound is answered locally
+	MethodNotFoundFor Duration `json:"methodNotFoundFor"`
+	// InvalidParamsFor is how long a request answered with InvalidParams is answered locally by
+	// its method and params, negative to disable
+	InvalidParamsFor Duration `json:"invalidParamsFor"`
+	// MaxEntries limits the learned errors, no more is learned when it's reached
+	MaxEntries int `json:"maxEntries"`
+}
+
+func (c *NegativeCacheConfig) SetDefaults() {
+	if c.MethodNotFoundFor.Duration == 0 {
+		c.MethodNotFoundFor.Duration = DefaultMethodNotFoundFor
+	}
+	if c.InvalidParamsFor.Duration == 0 {
+		c.InvalidParamsFor.Duration = DefaultInvalidParamsFor
+	}
+	if c.MaxEntries == 0 {
+		c.MaxEntries = DefaultNegativeMaxEntries
+	}
+}
+
+func (c *NegativeCacheConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.MethodNotFoundFor.Duration < 0 {
+		errs.Add("negativeCache.methodNotFoundFor", "must not be negative")
+	}
+	if c.MaxEntries < 0 {
+		errs.Add("negativeCache.maxEntries", "must not be negative")
+	}
+	return errs
+}
+
+// NegativeEntry is a learned error, Key is the method for MethodNotFound, or the cache key of
+// the request for InvalidParams.
+type NegativeEntry struct {
+	Key     string   `json:"key"`
+	Code    int      `json:"code"`
+	Message string   `json:"message"`
+	TTL     Duration `json:"ttl"`
+}
+
+type negativeEntry struct {
+	err    *jsonrpc.RpcError
+	expire time.Time
+}
+
+// negativeCache keeps errors learned from upstream, a nil negativeCache learns nothing.
+type negativeCache struct {
+	mu      sync.Mutex
+	conf    *NegativeCacheConfig
+	p       *Proxy
+	entries map[string]*negativeEntry
+	// params is the number of entries of InvalidParams, cache keys are not computed if it's 0
+	params int
+}
+
+func newNegativeCache(p *Proxy, conf *NegativeCacheConfig) *negativeCache {
+	c := &negativeCache{conf: conf, p: p, entries: map[string]*negativeEntry{}}
+	go c.runSweeper(negativeCacheSweepInterval)
+	return c
+}
+
+// Learn keeps e answered by the upstream group for req if it's MethodNotFound or InvalidParams.
+func (c *negativeCache) Learn(group string, req *jsonrpc.RpcRequest, e *jsonrpc.RpcError) {
+	if c == nil || e == nil {
+		return
+	}
+	key, ttl := groupKey(req.Method, group), c.conf.MethodNotFoundFor.Duration
+	switch e.Code {
+	case jsonrpc.ErrRpcMethodNotFound.Code:
+	case jsonrpc.ErrRpcInvalidParams.Code:
+		var err error
+		if key, err = c.p.cacheKey(group, req); err != nil {
+			return
+		}
+		ttl = c.conf.InvalidParamsFor.Duration
+	default:
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.entries[key]
+	if !exists && len(c.entries) >= c.conf.MaxEntries {
+		c.sweep(c.p.clock.Now())
+		if len(c.entries) >= c.conf.MaxEntries {
+			return
+		}
+	}
+	if !exists && isParamsKey(key) {
+		c.params++
+	}
+	c.entries[key] = &negativeEntry{err: e, expire: c.p.clock.Now().Add(ttl)}
+}
+
+// Get returns the learned error of req to the upstream group, nil if there is none.
+func (c *negativeCache) Get(group string, req *jsonrpc.RpcRequest) *jsonrpc.RpcError {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	e := c.getLocked(groupKey(req.Method, group))
+	params := c.params
+	c.mu.Unlock()
+	if e != nil || params == 0 {
+		return e
+	}
+	key, err := c.p.cacheKey(group, req)
+	if err != nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getLocked(key)
+}
+
+func (c *negativeCache) getLocked(key string) *jsonrpc.RpcError {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !c.p.clock.Now().Before(e.expire) {
+		c.removeLocked(key)
+		return nil
+	}
+	return e.err
+}
+
+func (c *negativeCache) removeLocked(key string) {
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		if isParamsKey(key) {
+			c.params--
+		}
+	}
+}
+
+// isParamsKey tells whether key is a cache key with params, rather than a method.
+func isParamsKey(key string) bool {
+	return strings.IndexByte(key, '(') >= 0
+}
+
+// Entries lists the learned errors not expired, sorted by key.
+func (c *negativeCache) Entries() []*NegativeEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.p.clock.Now()
+	var entries []*NegativeEntry
+	for k, e := range c.entries {
+		if ttl := e.expire.Sub(now); ttl > 0 {
+			entries = append(entries, &NegativeEntry{Key: k, Code: e.err.Code, Message: e.err.Message, TTL: Duration{ttl}})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// Delete forgets the error of key, or all errors if key is empty. It returns the number of
+// errors forgotten.
+func (c *negativeCache) Delete(key string) (int, error) {
+	if c == nil {
+		return 0, ErrNegativeCacheDisabled
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(c.p.clock.Now())
+	if key == "" {
+		n := len(c.entries)
+		c.entries, c.params = map[string]*negativeEntry{}, 0
+		return n, nil
+	}
+	if _, ok := c.entries[key]; !ok {
+		return 0, nil
+	}
+	c.removeLocked(key)
+	return 1, nil
+}
+
+func (c *negativeCache) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		c.sweep(c.p.clock.Now())
+		c.mu.Unlock()
+	}
+}
+
+// sweep removes expired errors, c.mu must be held.
+func (c *negativeCache) sweep(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expire) {
+			c.removeLocked(k)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fasthttp/router"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newNegativeUpstream answers Unknown with MethodNotFound, params of "bad" with InvalidParams and
+// others with their methods.
+func newNegativeUpstream(t *testing.T, calls *int64) string {
+	return newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		reqs, rpcErr := jsonrpc.ParseRequest(ctx.PostBody())
+		if rpcErr != nil {
+			t.Error(rpcErr)
+			return
+		}
+		atomic.AddInt64(calls, int64(len(reqs)))
+		var resps []string
+		for _, r := range reqs {
+			id, _ := jsoniter.MarshalToString(r.Id)
+			params, _ := jsoniter.MarshalToString(r.Params)
+			switch {
+			case r.Method == "Unknown":
+				resps = append(resps, jsonrpc.ErrRpcMethodNotFound.JsonError(r.Id))
+			case params == `["bad"]`:
+				resps = append(resps, jsonrpc.ErrRpcInvalidParams.JsonError(r.Id))
+			default:
+				resps = append(resps, fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":["%s"]}`, id, r.Method))
+			}
+		}
+		ctx.SetContentType("application/json")
+		if ctx.PostBody()[0] == '{' {
+			ctx.SetBodyString(resps[0])
+			return
+		}
+		ctx.SetBodyString("[" + strings.Join(resps, ",") + "]")
+	})
+}
+
+func TestNegativeCache(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:        "127.0.0.1:8080",
+		Upstreams:     []string{newNegativeUpstream(t, &calls)},
+		Cache:         &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs:  []*CacheConfig{{Methods: []string{"GetBalance"}, For: Duration{Duration: time.Minute}}},
+		NegativeCache: &NegativeCacheConfig{},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	p.clock = clock
+	r := router.New()
+	p.RegisterHandler(r)
+	NewManage(config, p).registerHandler(r)
+
+	// learned by method
+	for i := 0; i < 2; i++ {
+		ctx := doProxyRequest(p, `{"jsonrpc":"2.0","id":1,"method":"Unknown","params":[]}`)
+		assert.Contains(string(ctx.Response.Body()), `"code":-32601`)
+	}
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+	ctx := doProxyRequest(p, `{"jsonrpc":"2.0","id":1,"method":"Unknown","params":["other"]}`)
+	assert.Contains(string(ctx.Response.Body()), `"code":-32601`)
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+
+	// learned by params, the method is still forwarded
+	for i := 0; i < 2; i++ {
+		ctx = doProxyRequest(p, `{"jsonrpc":"2.0","id":1,"method":"Echo","params":["bad"]}`)
+		assert.Contains(string(ctx.Response.Body()), `"code":-32602`)
+	}
+	assert.EqualValues(2, atomic.LoadInt64(&calls))
+	ctx = doProxyRequest(p, `{"jsonrpc":"2.0","id":1,"method":"Echo","params":["good"]}`)
+	assert.Equal(`{"jsonrpc":"2.0","id":1,"result":["Echo"]}`, string(ctx.Response.Body()))
+	assert.EqualValues(3, atomic.LoadInt64(&calls))
+
+	// only requests not answered locally are forwarded
+	ctx = doProxyRequest(p, `[{"jsonrpc":"2.0","id":"a","method":"Unknown","params":[]},{"jsonrpc":"2.0","id":"b","method":"Echo","params":[]},{"jsonrpc":"2.0","id":"c","method":"GetBalance","params":["x"]}]`)
+	var resps []jsonrpc.RpcResponse
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &resps))
+	assert.Len(resps, 3)
+	assert.Equal("a", resps[0].Id)
+	assert.EqualValues(jsonrpc.ErrRpcMethodNotFound.Code, resps[0].Error.Code)
+	assert.Equal("b", resps[1].Id)
+	assert.Equal([]interface{}{"Echo"}, resps[1].Result)
+	assert.Equal("c", resps[2].Id)
+	assert.Equal([]interface{}{"GetBalance"}, resps[2].Result)
+	assert.EqualValues(5, atomic.LoadInt64(&calls))
+	// methods without cache rule are not cached along with the others
+	assert.Nil(p.CacheManager.Get("Echo([])", 0))
+	assert.NotNil(p.CacheManager.Get(`GetBalance(["x"])`, 0))
+	ctx = doProxyRequest(p, `[{"jsonrpc":"2.0","id":1,"method":"Unknown","params":[]},{"jsonrpc":"2.0","id":2,"method":"GetBalance","params":["x"]}]`)
+	assert.Equal(`[{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"Method not found"}},{"jsonrpc":"2.0","id":2,"result":["GetBalance"]}]`, string(ctx.Response.Body()))
+	assert.EqualValues(5, atomic.LoadInt64(&calls))
+
+	// manage
+	do := func(method, uri string) (int, *manageNegativeEntries) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI(uri)
+		r.Handler(ctx)
+		res := &manageNegativeEntries{}
+		_ = jsoniter.Unmarshal(ctx.Response.Body(), res)
+		return ctx.Response.StatusCode(), res
+	}
+	code, res := do("GET", "/manage/negative")
+	assert.Equal(200, code)
+	if assert.Equal(2, res.Count) {
+		assert.Equal(`Echo(["bad"])`, res.Entries[0].Key)
+		assert.Equal("Unknown", res.Entries[1].Key)
+		assert.Equal(DefaultMethodNotFoundFor, res.Entries[1].TTL.Duration)
+	}
+	code, res = do("DELETE", "/manage/negative?key=Unknown")
+	assert.Equal(200, code)
+	assert.Equal(1, res.Count)
+	doProxyRequest(p, `{"jsonrpc":"2.0","id":1,"method":"Unknown","params":[]}`)
+	assert.EqualValues(6, atomic.LoadInt64(&calls))
+
+	// expired
+	clock.Add(DefaultMethodNotFoundFor)
+	doProxyRequest(p, `{"jsonrpc":"2.0","id":1,"method":"Unknown","params":[]}`)
+	assert.EqualValues(7, atomic.LoadInt64(&calls))
+	code, res = do("DELETE", "/manage/negative")
+	assert.Equal(200, code)
+	assert.Equal(1, res.Count)
+	assert.Empty(p.negative.Entries())
+
+	p.negative = nil
+	code, _ = do("GET", "/manage/negative")
+	assert.Equal(404, code)
+	code, _ = do("DELETE", "/manage/negative")
+	assert.Equal(404, code)
+}
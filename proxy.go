@@ -12,6 +12,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/pprofhandler"
+	"math/rand"
 	"os"
 	"os/signal"
 	"sync"
@@ -26,23 +27,92 @@ type Stats struct {
 
 type Proxy struct {
 	nocopy.NoCopy
+	// tip is the tracked height of the chain tip, accessed atomically, keep it 64-bit aligned
+	tip uint64
 
 	config       *Config
 	CacheManager *CacheManager
 	um           *UpstreamManager
+	refresher    *refresher
+	negative     *negativeCache
+	limiter      *rateLimiter
+	quotas       *quotas
+	apiKeys      *apiKeys
+	tokens       *jwtVerifier
+	// groups are upstreams serving API keys by group name
+	groups map[string]*UpstreamManager
+	// routes are the RPC paths
+	routes map[string]*route
+	bans   *ipBans
+	// cors is the CORS policy of routes without their own
+	cors  *corsPolicy
+	abuse *abuseDetector
+	clock Clock
+	// random returns a random float64 in [0, 1)
+	random func() float64
 
 	httpServer *fasthttp.Server
 	stats      Stats
 	initOnce   sync.Once
+	// ready is set once the startup warmup is done
+	ready int32
 }
 
 func NewProxy(config *Config) *Proxy {
-	return &Proxy{config: config}
+	return &Proxy{config: config, clock: systemClock{}, random: rand.Float64}
 }
 
 func (p *Proxy) init() {
 	p.um = NewUpstreamManager(p.config.Upstreams)
-	p.CacheManager = NewCacheManager()
+	p.CacheManager = NewCacheManager(p.config.Cache)
+	CacheCollector.SetManager(p.CacheManager)
+	if p.config.RefreshRate > 0 {
+		p.refresher = newRefresher(p, p.config.RefreshRate)
+	}
+	if p.config.NegativeCache != nil {
+		p.negative = newNegativeCache(p, p.config.NegativeCache)
+	}
+	p.routes = map[string]*route{p.config.Path: {path: p.config.Path, access: newRouteAccess(p.config.MethodAccess), ips: newIPAccess(p.config.IPAccess)}}
+	for _, r := range p.config.Routes {
+		p.routes[r.Path] = &route{path: r.Path, access: newRouteAccess(r.MethodAccess), ips: newIPAccess(r.IPAccess), cors: newCorsPolicy(r.Cors)}
+	}
+	if p.config.Cors != nil {
+		p.cors = newCorsPolicy(p.config.Cors)
+	} else {
+		p.cors = newCorsPolicy(anyOriginCors())
+	}
+	p.bans = newIPBans(p.clock)
+	if p.config.Abuse != nil {
+		p.abuse = newAbuseDetector(p.config.Abuse, p.clock, p.bans)
+	}
+	p.groups = map[string]*UpstreamManager{}
+	for _, g := range p.config.UpstreamGroups {
+		p.groups[g.Name] = NewUpstreamManager(g.Upstreams)
+	}
+	if p.config.Auth != nil {
+		rate := p.config.RateLimit
+		if rate == nil {
+			// keys may have their own rate limits
+			rate = &RateLimitConfig{By: RateLimitByHeader}
+			rate.SetDefaults()
+		}
+		keys, err := newApiKeys(p.config.Auth, p.config.UpstreamGroups, rate)
+		if err != nil {
+			log.WithError(err).Fatal("unable to load API keys")
+		}
+		p.apiKeys = keys
+		if p.config.Auth.JWT != nil {
+			if p.tokens, err = newJWTVerifier(p.config.Auth.JWT, rate, p.clock); err != nil {
+				log.WithError(err).Fatal("unable to load JWT keys")
+			}
+		}
+		p.limiter = newRateLimiter(rate, p.clock)
+	} else if p.config.RateLimit != nil {
+		p.limiter = newRateLimiter(p.config.RateLimit, p.clock)
+	}
+	if p.config.Quota != nil {
+		p.quotas = newQuotas(p.config.Quota, p.clock)
+	}
 	p.httpServer = &fasthttp.Server{
 		Name:              "JSON-RPC Proxy Server",
 		Handler:           fasthttp.CompressHandler(p.requestHandler),
@@ -61,7 +131,9 @@ func (p *Proxy) RegisterHandler(r *router.Router) {
 	r.GET("/", func(ctx *fasthttp.RequestCtx) {
 		_, _ = fmt.Fprint(ctx, "JSON-RPC Proxy, please request with POST Method")
 	})
-	r.POST(p.config.Path, p.requestHandler)
+	for path := range p.routes {
+		r.POST(path, p.requestHandler)
+	}
 }
 
 func (p *Proxy) Serve() error {
@@ -113,8 +185,23 @@ func (p *Proxy) requestHandler(ctx *fasthttp.RequestCtx) {
 	setCtxRpcMethods(ctx, methodNames)
 	cacheFor := time.Duration(0)
 	errFor := p.config.ErrFor.Duration
-	allCached := true
+	// pending are indexes of requests not answered locally
+	var pending []int
 	resps = make([]jsonrpc.RpcResponse, len(reqs))
+	cacheControl := p.cacheControl(ctx)
+	// statuses are the cache status of every request, age is of the oldest result from cache
+	statuses := make([]string, len(reqs))
+	for i := range statuses {
+		statuses[i] = cacheStatusNone
+	}
+	var age time.Duration
+	client := getCtxClient(ctx)
+	route := p.routeOf(ctx)
+	group := p.groupOf(ctx)
+	defer func() {
+		setCtxCacheStatuses(ctx, statuses)
+		writeCacheStatus(&ctx.Response, statuses, age, !isMonoReq, p.config.CacheStatusItems)
+	}()
 	for idx, req := range reqs {
 		if !req.Validate() {
 			if isMonoReq {
@@ -125,12 +212,33 @@ func (p *Proxy) requestHandler(ctx *fasthttp.RequestCtx) {
 			jsonrpc.ErrRpcInvalidRequest.WriteToRpcResponse(&resps[idx], req.Id)
 			continue
 		}
+		// denied methods are answered locally, the others of the batch are still served
+		if e := deniedError(route, client, req.Method); e != nil {
+			if isMonoReq {
+				writeRpcErrResp(ctx, e, req.Id)
+				return
+			}
+			e.WriteToRpcResponse(&resps[idx], req.Id)
+			continue
+		}
+		// errors learned from upstream are answered locally, even without cache config
+		if e := p.negative.Get(group, req); e != nil {
+			RpcNegativeCacheHit.WithLabelValues(req.Method).Inc()
+			statuses[idx] = CacheStatusHit
+			if isMonoReq {
+				writeRpcErrResp(ctx, e, req.Id)
+				return
+			}
+			e.WriteToRpcResponse(&resps[idx], req.Id)
+			continue
+		}
 		// skip cache if is valid req&upResp but no cache config set
 		cc := p.config.Search(req.Method)
 		if cc == nil {
-			allCached = false
+			pending = append(pending, idx)
+			statuses[idx] = CacheStatusMiss
 			RpcCacheMiss.WithLabelValues(req.Method).Inc()
-			break
+			continue
 		}
 		// use the minimum non-zero cache duration
 		if cacheFor == 0 || cc.For.Duration < cacheFor {
@@ -139,18 +247,73 @@ func (p *Proxy) requestHandler(ctx *fasthttp.RequestCtx) {
 		if errFor == 0 || cc.For.Duration < errFor {
 			errFor = cc.For.Duration
 		}
-		res := p.GetCachedItem(req, cc)
-		if res == nil {
+		// the client asks for a fresh result, it's still cached
+		if cacheControl.noCache {
+			pending = append(pending, idx)
+			statuses[idx] = CacheStatusBypass
+			RpcCacheBypass.WithLabelValues(req.Method).Inc()
+			continue
+		}
+		res := p.GetCachedItem(group, req, cc)
+		if res != nil && !cacheControl.fresh(res, p.clock.Now()) {
+			statuses[idx] = CacheStatusStale
+			res = nil
+		}
+		// recompute before expiry by chance, so that a hot result is not refetched by all clients at once
+		if res != nil && cc.XFetchBeta > 0 && res.IsRpcResult() && res.ShouldRecompute(p.clock.Now(), cc.XFetchBeta, 1-p.random()) {
+			RpcCacheEarlyExpired.WithLabelValues(req.Method).Inc()
+			statuses[idx] = CacheStatusStale
+			res = nil
+		}
+		// the compressed result is sent as it is if client accepts its encoding
+		if res != nil && res.IsCompressed() && isMonoReq && isHTTPCompression(res.Encoding) {
+			ctx.Response.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderAcceptEncoding)
+		}
+		if res != nil && res.IsCompressed() && !(isMonoReq && isHTTPCompression(res.Encoding) &&
+			acceptsEncoding(ctx.Request.Header.Peek(fasthttp.HeaderAcceptEncoding), res.Encoding)) {
+			if err := res.Decompress(); err != nil {
+				log.WithError(err).WithField("method", req.Method).Error("failed to decompress cached item")
+				res = nil
+			}
+		}
+		// cached http errors are only for mono requests
+		if res == nil || (res.IsHttpResponse() && !isMonoReq) {
 			RpcCacheMiss.WithLabelValues(req.Method).Inc()
-			allCached = false
-			break
+			pending = append(pending, idx)
+			if statuses[idx] != CacheStatusStale {
+				statuses[idx] = CacheStatusMiss
+			}
+			continue
 		}
 		// found cached
 		RpcCacheHit.WithLabelValues(req.Method).Inc()
+		statuses[idx] = CacheStatusHit
+		if a, ok := res.Age(p.clock.Now()); ok && a > age {
+			age = a
+		}
+		if p.refresher != nil && res.IsRpcResult() {
+			p.refresher.hit(group, req, cc, res)
+		}
 		if res.IsHttpResponse() && isMonoReq { // cached http error or something
 			res.WriteHttpResponse(&ctx.Response)
 			return
 		} else if res.IsRpc() {
+			if isMonoReq && res.IsCompressed() {
+				err := res.WriteCompressedRpcResponse(&ctx.Response, req.Id)
+				if err == nil {
+					if ctx.Request.Header.ConnectionClose() {
+						ctx.Response.SetConnectionClose()
+					}
+					return
+				}
+				// the decompressed result is sent instead
+				log.WithError(err).WithField("method", req.Method).Error("fail to write compressed response from cache")
+				if err := res.Decompress(); err != nil {
+					log.WithError(err).WithField("method", req.Method).Error("failed to decompress cached item")
+					writeRpcErrResp(ctx, jsonrpc.ErrRpcInternalError, req.Id)
+					return
+				}
+			}
 			if isMonoReq {
 				resp := res.GetRpcResponse(req.Id)
 				writeJsonResp(ctx, resp)
@@ -159,7 +322,7 @@ func (p *Proxy) requestHandler(ctx *fasthttp.RequestCtx) {
 			res.WriteToRpcResponse(&resps[idx], req.Id)
 		}
 	}
-	if allCached {
+	if len(pending) == 0 {
 		writeJsonResps(ctx, resps)
 		//for _, r := range resps {
 		//	ReleaseRpcResponse(r)
@@ -167,18 +330,25 @@ func (p *Proxy) requestHandler(ctx *fasthttp.RequestCtx) {
 		resps = nil
 		return
 	}
+	// only requests not answered locally are forwarded
+	if !isMonoReq && len(pending) < len(reqs) {
+		p.forwardPending(ctx, reqs, resps, pending, cacheFor, errFor)
+		return
+	}
 	// cache not found
 	upResp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(upResp)
 	setAcceptEncoding(ctx)
-	err := p.um.DoTimeout(&ctx.Request, upResp, p.config.UpstreamRequestTimeout.Duration)
+	start := p.clock.Now()
+	err := p.upstreamOf(ctx).DoTimeout(&ctx.Request, upResp, p.config.UpstreamRequestTimeout.Duration)
+	delta := p.clock.Now().Sub(start)
 	// network errors
 	if err != nil {
 		log.WithError(err).WithField("methods", methodNames).Warn("error while requesting from upstream")
 		log.WithError(err).Tracef("error while requesting from upstream: \n%s", &ctx.Request)
 		e := jsonrpc.ErrWithData(jsonrpc.ErrRpcInternalError, err.Error())
 		for idx, req := range reqs {
-			p.SetCachedError(req, e, errFor)
+			p.SetCachedError(group, req, e, errFor)
 			if isMonoReq {
 				writeRpcErrResp(ctx, e, req.Id)
 				return
@@ -196,7 +366,7 @@ func (p *Proxy) requestHandler(ctx *fasthttp.RequestCtx) {
 		log.Debug("decode error: ", err.Error())
 		log.Tracef("request:\n%s\n\nresponse:\n%s", &ctx.Request, upResp)
 		if isMonoReq {
-			p.SetCachedResponse(reqs[0], upResp, errFor)
+			p.SetCachedResponse(group, reqs[0], upResp, errFor)
 		}
 		//upResp.CopyTo(&ctx.Response)
 		p.forwardResponse(ctx, upResp)
@@ -219,23 +389,15 @@ func (p *Proxy) requestHandler(ctx *fasthttp.RequestCtx) {
 		log.Debug("unmarshal error: ", err.Error())
 		log.Debugf("response: \n%s", upResp)
 		if isMonoReq {
-			p.SetCachedResponse(reqs[0], upResp, errFor)
+			p.SetCachedResponse(group, reqs[0], upResp, errFor)
 		} //upResp.CopyTo(&ctx.Response)
 		p.forwardResponse(ctx, upResp)
 		return
 	}
-	fasthttp.ReleaseResponse(upResp)
-	for idx, resp := range resps {
-		// jsonrpc errors
-		if resp.Error != nil {
-			if !resp.Error.Is(jsonrpc.ErrRpcInvalidRequest) {
-				log.WithField("rpcErr", resp.Error).Tracef("rpc error while requesting from upstream: \n%s\n", reqs[idx])
-				p.SetCachedError(reqs[idx], resp.Error, errFor)
-			}
-			continue
+	for idx := range resps {
+		if idx < len(reqs) {
+			p.cacheUpstreamResponse(group, reqs[idx], &resps[idx], cacheFor, errFor, delta)
 		}
-		// no error, cache responses
-		p.SetCachedRpcResponse(reqs[idx], &resp, cacheFor)
 	}
 
 	if isMonoReq {
@@ -245,45 +407,109 @@ func (p *Proxy) requestHandler(ctx *fasthttp.RequestCtx) {
 	}
 }
 
-func (p *Proxy) SetCachedHttpError(req *jsonrpc.RpcRequest, code int, message []byte, errFor time.Duration) {
-	key, err := req.ToCacheKey()
+// forwardPending sends the pending requests of a batch to upstream with the headers of the client
+// request, and writes their responses along with resps answered locally.
+func (p *Proxy) forwardPending(ctx *fasthttp.RequestCtx, reqs []*jsonrpc.RpcRequest, resps []jsonrpc.RpcResponse, pending []int, cacheFor, errFor time.Duration) {
+	subset := make([]*jsonrpc.RpcRequest, len(pending))
+	for i, idx := range pending {
+		subset[i] = &jsonrpc.RpcRequest{Method: reqs[idx].Method, Params: reqs[idx].Params}
+	}
+	setAcceptEncoding(ctx)
+	group := p.groupOf(ctx)
+	upResps, delta, err := p.fetchWithHeader(p.upstreams(group), &ctx.Request.Header, subset)
+	if err != nil {
+		log.WithError(err).WithField("methods", getCtxRpcMethods(ctx)).Warn("error while requesting from upstream")
+	}
+	for i, idx := range pending {
+		req := reqs[idx]
+		if err != nil || upResps[i].Id == nil {
+			e := jsonrpc.ErrWithData(jsonrpc.ErrRpcInternalError, "no response from upstream")
+			if err != nil {
+				e = jsonrpc.ErrWithData(jsonrpc.ErrRpcInternalError, err.Error())
+				if p.config.Search(req.Method) != nil {
+					p.SetCachedError(group, req, e, errFor)
+				}
+			}
+			e.WriteToRpcResponse(&resps[idx], req.Id)
+			continue
+		}
+		p.cacheUpstreamResponse(group, req, &upResps[i], cacheFor, errFor, delta)
+		resps[idx] = upResps[i]
+		resps[idx].Id = req.Id
+	}
+	writeJsonResps(ctx, resps)
+}
+
+// cacheUpstreamResponse caches resp of req from the upstream group, errors are cached for errFor
+// and learned by the negative cache. Responses of methods without cache rule are not cached, as
+// cacheFor and errFor are of the other requests of the batch.
+func (p *Proxy) cacheUpstreamResponse(group string, req *jsonrpc.RpcRequest, resp *jsonrpc.RpcResponse, cacheFor, errFor, delta time.Duration) {
+	cached := p.config.Search(req.Method) != nil
+	// jsonrpc errors
+	if resp.Error != nil {
+		if !resp.Error.Is(jsonrpc.ErrRpcInvalidRequest) {
+			log.WithField("rpcErr", resp.Error).Tracef("rpc error while requesting from upstream: \n%s\n", req)
+			p.negative.Learn(group, req, resp.Error)
+			if cached {
+				p.SetCachedError(group, req, resp.Error, errFor)
+			}
+		}
+		return
+	}
+	if !cached {
+		return
+	}
+	// no error, cache responses
+	p.SetCachedRpcResponse(group, req, resp, cacheFor, delta)
+}
+
+func (p *Proxy) SetCachedHttpError(group string, req *jsonrpc.RpcRequest, code int, message []byte, errFor time.Duration) {
+	key, err := p.cacheKey(group, req)
 	if err != nil {
 		return
 	}
-	err = p.CacheManager.Set(key, (&CachedItem{HttpResponse: &CachedHttpResp{Code: code, Body: message}}).Marshal(), errFor)
+	item := &CachedItem{HttpResponse: &CachedHttpResp{Code: code, Body: message}}
+	item.SetLifetime(p.clock.Now(), errFor, 0)
+	err = p.CacheManager.Set(key, item.Marshal(), errFor)
 	if err != nil {
 		log.WithError(err).Error("error while setting cached HTTP error")
 	}
 }
 
-func (p *Proxy) SetCachedResponse(req *jsonrpc.RpcRequest, resp *fasthttp.Response, errFor time.Duration) {
-	key, err := req.ToCacheKey()
+func (p *Proxy) SetCachedResponse(group string, req *jsonrpc.RpcRequest, resp *fasthttp.Response, errFor time.Duration) {
+	key, err := p.cacheKey(group, req)
 	if err != nil {
 		return
 	}
-	err = p.CacheManager.Set(key, (&CachedItem{HttpResponse: &CachedHttpResp{
+	item := &CachedItem{HttpResponse: &CachedHttpResp{
 		Code:            resp.StatusCode(),
 		ContentEncoding: resp.Header.Peek(fasthttp.HeaderContentEncoding),
 		ContentType:     resp.Header.ContentType(),
 		Body:            resp.Body(),
-	}}).Marshal(), errFor)
+	}}
+	item.SetLifetime(p.clock.Now(), errFor, 0)
+	err = p.CacheManager.Set(key, item.Marshal(), errFor)
 	if err != nil {
 		log.WithError(err).Error("error while setting cached HTTP error")
 	}
 }
 
-func (p *Proxy) SetCachedError(req *jsonrpc.RpcRequest, e *jsonrpc.RpcError, errFor time.Duration) {
-	key, err := req.ToCacheKey()
+func (p *Proxy) SetCachedError(group string, req *jsonrpc.RpcRequest, e *jsonrpc.RpcError, errFor time.Duration) {
+	key, err := p.cacheKey(group, req)
 	if err != nil {
 		return
 	}
-	err = p.CacheManager.Set(key, (&CachedItem{RpcError: e}).Marshal(), errFor)
+	item := &CachedItem{RpcError: e}
+	item.SetLifetime(p.clock.Now(), errFor, 0)
+	err = p.CacheManager.Set(key, item.Marshal(), errFor)
 	if err != nil {
 		log.WithError(err).Error("error while setting cached error")
 	}
 }
-func (p *Proxy) SetCachedRpcResponse(req *jsonrpc.RpcRequest, resp *jsonrpc.RpcResponse, cacheFor time.Duration) {
-	key, err := req.ToCacheKey()
+
+// SetCachedRpcResponse caches the result fetched in delta for cacheFor, shortened by jitter of its cache rule.
+func (p *Proxy) SetCachedRpcResponse(group string, req *jsonrpc.RpcRequest, resp *jsonrpc.RpcResponse, cacheFor, delta time.Duration) {
+	key, err := p.cacheKey(group, req)
 	if err != nil {
 		return
 	}
@@ -291,17 +517,40 @@ func (p *Proxy) SetCachedRpcResponse(req *jsonrpc.RpcRequest, resp *jsonrpc.RpcR
 	if err != nil {
 		log.WithError(err).Error("error while serializing cached response")
 	}
-	err = p.CacheManager.Set(key, (&CachedItem{Result: data}).Marshal(), cacheFor)
+	cc := p.config.Search(req.Method)
+	if cc != nil {
+		var reason string
+		if cacheFor, reason = cc.Admit(data, cacheFor); reason != "" {
+			RpcCacheNotAdmitted.WithLabelValues(req.Method, reason).Inc()
+			return
+		}
+	}
+	immutable := cc != nil && p.isImmutable(req, cc, data)
+	if immutable {
+		cacheFor = ImmutableTTL
+		RpcCacheImmutable.WithLabelValues(req.Method).Inc()
+	}
+	item := &CachedItem{Result: data}
+	if cc != nil && cc.Jitter > 0 && !immutable {
+		cacheFor -= time.Duration(float64(cacheFor) * cc.Jitter * p.random())
+	}
+	item.SetLifetime(p.clock.Now(), cacheFor, delta)
+	if cc != nil && cc.Compression != "" {
+		if err := item.Compress(cc.Compression, cc.CompressMinSize); err != nil {
+			log.WithError(err).WithField("method", req.Method).Error("error while compressing cached response")
+		}
+	}
+	err = p.CacheManager.Set(key, item.Marshal(), cacheFor)
 	if err != nil {
 		log.WithError(err).Error("error while setting cached response")
 	}
 }
 
-func (p *Proxy) GetCachedItem(req *jsonrpc.RpcRequest, cc *CacheConfig) *CachedItem {
+func (p *Proxy) GetCachedItem(group string, req *jsonrpc.RpcRequest, cc *CacheConfig) *CachedItem {
 	dur := time.Duration(0)
-	key, err := req.ToCacheKey()
+	key, err := p.cacheKey(group, req)
 	if err != nil {
-		log.WithError(err).WithField("req", req).Error("error while request.ToCacheKey()")
+		log.WithError(err).WithField("req", req).Error("error while computing cache key")
 		return nil
 	}
 	if cc == nil {
@@ -353,6 +602,18 @@ func setCtxRpcMethods(ctx *fasthttp.RequestCtx, methodNames []string) {
 	ctx.SetUserValue("rpcMethods", methodNames)
 }
 
+// getCtxCacheStatuses returns the cache status of every request, nil if the body is not parsed.
+func getCtxCacheStatuses(ctx *fasthttp.RequestCtx) []string {
+	if s, ok := ctx.UserValue("cacheStatuses").([]string); ok {
+		return s
+	}
+	return nil
+}
+
+func setCtxCacheStatuses(ctx *fasthttp.RequestCtx, statuses []string) {
+	ctx.SetUserValue("cacheStatuses", statuses)
+}
+
 func writeJsonResp(ctx *fasthttp.RequestCtx, resp *jsonrpc.RpcResponse) {
 	data, err := jsoniter.Marshal(resp)
 	if err != nil {
@@ -1,11 +1,237 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestProxy(t *testing.T) {
 	t.Log(jsoniter.MarshalToString(&jsonrpc.RpcRequest{RpcHeader: jsonrpc.RpcHeader{Jsonrpc: jsonrpc.JSONRPC2, Id: 1}, Method: "", Params: jsoniter.RawMessage(`{"a":"b"}`)}))
 }
+
+// newTestUpstream starts an upstream answering every request with body
+func newTestUpstream(t *testing.T, handler fasthttp.RequestHandler) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fasthttp.Server{Handler: handler}
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return "http://" + ln.Addr().String()
+}
+
+func doProxyRequest(p *Proxy, body string, header ...string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetBodyString(body)
+	for i := 0; i+1 < len(header); i += 2 {
+		ctx.Request.Header.Set(header[i], header[i+1])
+	}
+	p.requestHandler(ctx)
+	return ctx
+}
+
+func TestProxyCompressedCache(t *testing.T) {
+	assert := assertion.New(t)
+	result := `["` + strings.Repeat("0123456789abcdef", 200) + `"]`
+	upstreamCalls := 0
+	upstream := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		upstreamCalls++
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"jsonrpc":"2.0","id":1,"result":` + result + `}`)
+	})
+	config := &Config{
+		Listen:       "127.0.0.1:8080",
+		Upstreams:    []string{upstream},
+		Cache:        &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs: []*CacheConfig{{Methods: []string{"GetTxBlock"}, For: Duration{Duration: 60e9}, Compression: CompressionZstd}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+	req := `{"jsonrpc":"2.0","id":1,"method":"GetTxBlock","params":["1"]}`
+	expected := `{"jsonrpc":"2.0","id":1,"result":` + result + `}`
+
+	ctx := doProxyRequest(p, req)
+	assert.Equal(expected, string(ctx.Response.Body()))
+	val := p.CacheManager.Get(`GetTxBlock(["1"])`, 0)
+	assert.Equal(byte(compressedItemMagic), val[0])
+	assert.Less(len(val), len(result))
+
+	ctx = doProxyRequest(p, req, "Accept-Encoding", "gzip, zstd")
+	assert.Equal(1, upstreamCalls)
+	assert.Equal(CompressionZstd, string(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding)))
+	assert.Equal(fasthttp.HeaderAcceptEncoding, string(ctx.Response.Header.Peek(fasthttp.HeaderVary)))
+	body, err := decompressData(CompressionZstd, ctx.Response.Body())
+	assert.NoError(err)
+	assert.Equal(expected, string(body))
+
+	// not compressed again by CompressHandler
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.Set("Accept-Encoding", "gzip, zstd")
+	ctx.Request.SetBodyString(req)
+	fasthttp.CompressHandler(p.requestHandler)(ctx)
+	assert.Equal(CompressionZstd, string(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding)))
+	body, err = decompressData(CompressionZstd, ctx.Response.Body())
+	assert.NoError(err)
+	assert.Equal(expected, string(body))
+
+	ctx = doProxyRequest(p, req, "Accept-Encoding", "gzip")
+	assert.Empty(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding))
+	assert.Equal(fasthttp.HeaderAcceptEncoding, string(ctx.Response.Header.Peek(fasthttp.HeaderVary)))
+	assert.Equal(expected, string(ctx.Response.Body()))
+
+	ctx = doProxyRequest(p, req, "Accept-Encoding", "zstd;q=0, *")
+	assert.Empty(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding))
+	assert.Equal(expected, string(ctx.Response.Body()))
+
+	ctx = doProxyRequest(p, `[`+req+`]`, "Accept-Encoding", "zstd")
+	assert.Equal(`[`+expected+`]`, string(ctx.Response.Body()))
+	assert.Equal(1, upstreamCalls)
+
+	entries := p.CacheManager.Lookup(`GetTxBlock(["1"])`)
+	assert.Equal(CompressionZstd, entries[0].Encoding)
+	item := &CachedItem{}
+	assert.NoError(item.Unmarshal(entries[0].Value))
+	assert.Equal(result, string(item.Result))
+	assert.EqualValues(60000, item.TTL)
+	assert.InDelta(0, item.AgeRatio(time.Now()), 0.01)
+}
+
+func TestProxyCompressedCacheCodings(t *testing.T) {
+	assert := assertion.New(t)
+	result := `["` + strings.Repeat("0123456789abcdef", 200) + `"]`
+	upstream := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"jsonrpc":"2.0","id":1,"result":` + result + `}`)
+	})
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{upstream},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs: []*CacheConfig{
+			{Methods: []string{"GetTxBlock"}, For: Duration{Duration: 60e9}, Compression: CompressionGzip},
+			{Methods: []string{"GetDsBlock"}, For: Duration{Duration: 60e9}, Compression: CompressionSnappy},
+		},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+	expected := `{"jsonrpc":"2.0","id":"a","result":` + result + `}`
+
+	// a single gzip member
+	req := `{"jsonrpc":"2.0","id":"a","method":"GetTxBlock","params":["1"]}`
+	doProxyRequest(p, req)
+	ctx := doProxyRequest(p, req, "Accept-Encoding", "gzip;q=0.5")
+	assert.Equal(CompressionGzip, string(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding)))
+	r, err := gzip.NewReader(bytes.NewReader(ctx.Response.Body()))
+	assert.NoError(err)
+	r.Multistream(false)
+	body, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(expected, string(body))
+	assert.Equal(io.EOF, r.Reset(bytes.NewReader(nil)))
+
+	// snappy is not an HTTP coding
+	req = `{"jsonrpc":"2.0","id":"a","method":"GetDsBlock","params":["1"]}`
+	doProxyRequest(p, req)
+	assert.Equal(byte(compressedItemMagic), p.CacheManager.Get(`GetDsBlock(["1"])`, 0)[0])
+	ctx = doProxyRequest(p, req, "Accept-Encoding", "snappy, *")
+	assert.Empty(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding))
+	assert.Empty(ctx.Response.Header.Peek(fasthttp.HeaderVary))
+	assert.Equal(expected, string(ctx.Response.Body()))
+
+	// gzip not ending by a flush can't be wrapped, its result is sent decompressed
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write([]byte(`["legacy"]`))
+	_ = w.Close()
+	item := &CachedItem{Encoding: CompressionGzip, Compressed: buf.Bytes()}
+	assert.NoError(p.CacheManager.Set(`GetTxBlock(["2"])`, item.Marshal(), time.Minute))
+	ctx = doProxyRequest(p, `{"jsonrpc":"2.0","id":"a","method":"GetTxBlock","params":["2"]}`, "Accept-Encoding", "gzip")
+	assert.Equal(fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Empty(ctx.Response.Header.Peek(fasthttp.HeaderContentEncoding))
+	assert.Equal(`{"jsonrpc":"2.0","id":"a","result":["legacy"]}`, string(ctx.Response.Body()))
+}
+
+// fakeClock is a Clock moved by tests.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestProxyEarlyExpiration(t *testing.T) {
+	assert := assertion.New(t)
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	upstreamCalls := 0
+	upstream := newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		upstreamCalls++
+		// every call takes 1s
+		clock.Add(time.Second)
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`)
+	})
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{upstream},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs: []*CacheConfig{{
+			Methods:    []string{"GetBalance"},
+			For:        Duration{Duration: 10 * time.Second},
+			Jitter:     0.5,
+			XFetchBeta: 1,
+		}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.clock = clock
+	p.random = func() float64 { return 0.5 }
+	p.initOnce.Do(p.init)
+	req := `{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}`
+
+	doProxyRequest(p, req)
+	assert.Equal(1, upstreamCalls)
+	item := p.CacheManager.GetItem(`GetBalance(["a"])`, 0)
+	// 10s shortened by 0.5 * jitter
+	assert.EqualValues(7500, item.TTL)
+	assert.EqualValues(1000, item.Delta)
+
+	// now + delta * -ln(0.5) = 2.69s is before expiry
+	clock.Add(2 * time.Second)
+	doProxyRequest(p, req)
+	assert.Equal(1, upstreamCalls)
+	// now + delta * -ln(0.5) = 7.69s is after expiry
+	clock.Add(5 * time.Second)
+	assert.Equal(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`, string(doProxyRequest(p, req).Response.Body()))
+	assert.Equal(2, upstreamCalls)
+	item = p.CacheManager.GetItem(`GetBalance(["a"])`, 0)
+	assert.InDelta(0, item.AgeRatio(clock.Now()), 1e-9)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	"github.com/valyala/fasthttp"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMethodCost      = 1
+	DefaultQuotaMaxClients = 100000
+	quotaSweepInterval     = time.Minute
+)
+
+// periods of quotas
+const (
+	quotaPerSecond = "second"
+	quotaPerDay    = "day"
+)
+
+// MethodCost is the cost of Methods in compute units.
+type MethodCost struct {
+	Methods []string `json:"methods"`
+	Cost    float64  `json:"cost"`
+}
+
+// Quota limits compute units spent per second and per UTC day, 0 is unlimited.
+type Quota struct {
+	PerSecond float64 `json:"perSecond,omitempty"`
+	PerDay    float64 `json:"perDay,omitempty"`
+}
+
+func (q *Quota) check(path string, errs *ConfigErrors) {
+	if q.PerSecond < 0 {
+		errs.Add(path+".perSecond", "must not be negative")
+	}
+	if q.PerDay < 0 {
+		errs.Add(path+".perDay", "must not be negative")
+	}
+}
+
+// ClientQuota overrides the quota of the client of Key, an IP or an API key.
+type ClientQuota struct {
+	Key string `json:"key"`
+	Quota
+}
+
+// QuotaConfig limits compute units spent by every client, requests are charged after they are
+// answered, so a client may overspend by its last request.
+type QuotaConfig struct {
+	// By keys clients the same way as RateLimitConfig.By
+	By string `json:"by"`
+	// MaxClients is the number of clients over which idle clients are forgotten with their usage
+	MaxClients int `json:"maxClients,omitempty"`
+	// DefaultCost is the cost of methods not in Costs
+	DefaultCost float64       `json:"defaultCost"`
+	Costs       []*MethodCost `json:"costs,omitempty"`
+	// CacheHitCost is the cost of requests answered from cache, 0 by default
+	CacheHitCost float64 `json:"cacheHitCost,omitempty"`
+	Quota
+	Clients []*ClientQuota `json:"clients,omitempty"`
+}
+
+func (c *QuotaConfig) SetDefaults() {
+	if c.By == "" {
+		c.By = RateLimitByIP
+	}
+	if c.MaxClients == 0 {
+		c.MaxClients = DefaultQuotaMaxClients
+	}
+	if c.DefaultCost == 0 {
+		c.DefaultCost = DefaultMethodCost
+	}
+}
+
+func (c *QuotaConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.By != RateLimitByIP && c.By != RateLimitByHeader {
+		errs.Add("quota.by", "must be ip or header")
+	}
+	if c.MaxClients < 0 {
+		errs.Add("quota.maxClients", "must not be negative")
+	}
+	if c.DefaultCost < 0 {
+		errs.Add("quota.defaultCost", "must not be negative")
+	}
+	if c.CacheHitCost < 0 {
+		errs.Add("quota.cacheHitCost", "must not be negative")
+	}
+	for i, cost := range c.Costs {
+		p := fmt.Sprintf("quota.costs[%d]", i)
+		if len(cost.Methods) == 0 {
+			errs.Add(p+".methods", "is empty")
+		}
+		if cost.Cost < 0 {
+			errs.Add(p+".cost", "must not be negative")
+		}
+	}
+	c.Quota.check("quota", &errs)
+	keys := map[string]bool{}
+	for i, client := range c.Clients {
+		p := fmt.Sprintf("quota.clients[%d]", i)
+		if client.Key == "" {
+			errs.Add(p+".key", "is empty")
+		} else if keys[client.Key] {
+			errs.Add(p+".key", "duplicated key %s", client.Key)
+		}
+		keys[client.Key] = true
+		client.Quota.check(p, &errs)
+	}
+	return errs
+}
+
+// QuotaUsage is the compute units spent by a client, Today is of the current UTC day and Total is
+// since the proxy started.
+type QuotaUsage struct {
+	Key    string  `json:"key"`
+	Today  float64 `json:"today"`
+	Total  float64 `json:"total"`
+	PerDay float64 `json:"perDay,omitempty"`
+}
+
+type clientUsage struct {
+	quota *Quota
+	// second is nil if there is no quota per second
+	second *tokenBucket
+	// day is the number of days since epoch of today
+	day   int64
+	today float64
+	total float64
+	// last is when the client was seen
+	last time.Time
+}
+
+// idle tells whether the client isn't seen for a sweep interval and its quota per second is refilled.
+func (u *clientUsage) idle(now time.Time) bool {
+	return now.Sub(u.last) >= quotaSweepInterval && (u.second == nil || u.second.full(now))
+}
+
+// quotas keeps usage of clients, usage of clients idle since yesterday is forgotten, and so is usage
+// of idle clients if there are more than MaxClients.
+type quotas struct {
+	conf    *QuotaConfig
+	clock   Clock
+	costs   map[string]float64
+	clients map[string]*Quota
+
+	mu    sync.Mutex
+	usage map[string]*clientUsage
+}
+
+func newQuotas(conf *QuotaConfig, clock Clock) *quotas {
+	q := &quotas{conf: conf, clock: clock, costs: map[string]float64{}, clients: map[string]*Quota{}, usage: map[string]*clientUsage{}}
+	for _, c := range conf.Costs {
+		for _, m := range c.Methods {
+			if _, ok := q.costs[m]; !ok {
+				q.costs[m] = c.Cost
+			}
+		}
+	}
+	for _, c := range conf.Clients {
+		// the key is an IP or an API key
+		q.clients[c.Key] = &c.Quota
+		q.clients[apiKeyID(c.Key)] = &c.Quota
+	}
+	go q.runSweeper(quotaSweepInterval)
+	return q
+}
+
+func utcDay(t time.Time) int64 {
+	return t.Unix() / int64(24*time.Hour/time.Second)
+}
+
+// usageLocked returns the usage of client reset for today, q.mu must be held.
+func (q *quotas) usageLocked(client string, now time.Time) *clientUsage {
+	u, ok := q.usage[client]
+	if !ok {
+		quota := q.clients[client]
+		if quota == nil {
+			quota = &q.conf.Quota
+		}
+		u = &clientUsage{quota: quota, day: utcDay(now)}
+		if quota.PerSecond > 0 {
+			u.second = newTokenBucket(quota.PerSecond, int(math.Ceil(quota.PerSecond)))
+			u.second.last = now
+		}
+		q.usage[client] = u
+	}
+	if day := utcDay(now); day != u.day {
+		u.day, u.today = day, 0
+	}
+	u.last = now
+	return u
+}
+
+// Allow tells whether client has compute units left, if not, it tells how long to wait and the
+// period of the quota exceeded.
+func (q *quotas) Allow(client string) (ok bool, wait time.Duration, period string) {
+	now := q.clock.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usageLocked(client, now)
+	if u.quota.PerDay > 0 && u.today >= u.quota.PerDay {
+		tomorrow := time.Unix((u.day+1)*int64(24*time.Hour/time.Second), 0)
+		return false, tomorrow.Sub(now), quotaPerDay
+	}
+	if u.second != nil {
+		if wait := u.second.wait(now); wait > 0 {
+			return false, wait, quotaPerSecond
+		}
+	}
+	return true, 0, ""
+}
+
+// Cost is the compute units of a request of method, cached tells whether it's answered from cache.
+func (q *quotas) Cost(method string, cached bool) float64 {
+	if cached {
+		return q.conf.CacheHitCost
+	}
+	if cost, ok := q.costs[method]; ok {
+		return cost
+	}
+	return q.conf.DefaultCost
+}
+
+// Charge charges client for requests of methods answered with statuses.
+func (q *quotas) Charge(client string, methods, statuses []string) {
+	var units float64
+	for i, m := range methods {
+		if i >= len(statuses) || statuses[i] == cacheStatusNone {
+			continue
+		}
+		cost := q.Cost(m, statuses[i] == CacheStatusHit)
+		ComputeUnits.WithLabelValues(m).Add(cost)
+		units += cost
+	}
+	if units == 0 {
+		return
+	}
+	now := q.clock.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usageLocked(client, now)
+	u.today += units
+	u.total += units
+	if u.second != nil {
+		u.second.charge(now, units)
+	}
+}
+
+// Usage lists usage of client, or of every client if it's empty, sorted by key.
+func (q *quotas) Usage(client string) []*QuotaUsage {
+	now := q.clock.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var usage []*QuotaUsage
+	for k, u := range q.usage {
+		if client != "" && k != client {
+			continue
+		}
+		// clients are not seen by listing them
+		today := u.today
+		if utcDay(now) != u.day {
+			today = 0
+		}
+		usage = append(usage, &QuotaUsage{Key: k, Today: today, Total: u.total, PerDay: u.quota.PerDay})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Key < usage[j].Key })
+	return usage
+}
+
+func (q *quotas) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.sweep(q.clock.Now())
+	}
+}
+
+// sweep forgets clients idle since yesterday, their usage is of no use for quotas. If there are
+// still more than MaxClients, idle clients are forgotten from the least recently seen.
+func (q *quotas) sweep(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	today := utcDay(now)
+	var idle []string
+	for k, u := range q.usage {
+		if u.second != nil && !u.second.full(now) {
+			continue
+		}
+		if u.day != today {
+			delete(q.usage, k)
+		} else if u.idle(now) {
+			idle = append(idle, k)
+		}
+	}
+	over := len(q.usage) - q.conf.MaxClients
+	if q.conf.MaxClients <= 0 || over <= 0 {
+		return
+	}
+	sort.Slice(idle, func(i, j int) bool { return q.usage[idle[i]].last.Before(q.usage[idle[j]].last) })
+	for i := 0; i < over && i < len(idle); i++ {
+		delete(q.usage, idle[i])
+	}
+}
+
+// quotaHandler rejects RPC requests of clients out of compute units with LimitExceeded and HTTP
+// 429, and charges clients for requests answered.
+func (p *Proxy) quotaHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if p.quotas == nil || !ctx.IsPost() || p.routeOf(ctx) == nil {
+			h(ctx)
+			return
+		}
+		client := clientKeyBy(ctx, p.quotas.conf.By)
+		ok, wait, period := p.quotas.Allow(client)
+		if ok {
+			h(ctx)
+			p.quotas.Charge(client, getCtxRpcMethods(ctx), getCtxCacheStatuses(ctx))
+			return
+		}
+		methods, id := peekRpcRequests(ctx.Request.Body())
+		QuotaExceeded.WithLabelValues(period).Inc()
+		ctx.SetUserValue("isRpcReq", true)
+		setCtxRpcMethods(ctx, methods)
+		writeRpcErrResp(ctx, jsonrpc.ErrWithData(jsonrpc.ErrRpcLimitExceeded, "quota per "+period+" exceeded"), id)
+		ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/fasthttp/router"
+	jsoniter "github.com/json-iterator/go"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &QuotaConfig{
+		Costs:        []*MethodCost{{Methods: []string{"GetSmartContractState"}, Cost: 10}},
+		CacheHitCost: 0.5,
+		Quota:        Quota{PerSecond: 10, PerDay: 25},
+		Clients:      []*ClientQuota{{Key: "vip", Quota: Quota{PerDay: 1000}}},
+	}
+	conf.SetDefaults()
+	assert.Empty(conf.Check())
+	// 23:59:00 UTC
+	clock := &fakeClock{now: time.Unix(1599955140, 0)}
+	q := newQuotas(conf, clock)
+	assert.EqualValues(1, q.Cost("GetBalance", false))
+	assert.EqualValues(10, q.Cost("GetSmartContractState", false))
+	assert.EqualValues(0.5, q.Cost("GetSmartContractState", true))
+
+	ok, _, _ := q.Allow("a")
+	assert.True(ok)
+	q.Charge("a", []string{"GetSmartContractState", "GetBalance", "GetBalance", "GetBalance"}, []string{CacheStatusMiss, CacheStatusHit, CacheStatusMiss, cacheStatusNone})
+	ok, wait, period := q.Allow("a")
+	assert.False(ok)
+	assert.Equal(quotaPerSecond, period)
+	assert.Equal(151*time.Millisecond, wait)
+
+	clock.Add(500 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		ok, _, _ = q.Allow("a")
+		assert.True(ok)
+		q.Charge("a", []string{"GetSmartContractState"}, []string{CacheStatusBypass})
+		clock.Add(2 * time.Second)
+	}
+	ok, wait, period = q.Allow("a")
+	assert.False(ok)
+	assert.Equal(quotaPerDay, period)
+	assert.Equal(55500*time.Millisecond, wait)
+	// unlimited per second
+	q.Charge("vip", []string{"GetSmartContractState", "GetSmartContractState"}, []string{CacheStatusMiss, CacheStatusMiss})
+	ok, _, _ = q.Allow("vip")
+	assert.True(ok)
+	assert.Equal([]*QuotaUsage{{Key: "a", Today: 31.5, Total: 31.5, PerDay: 25}, {Key: "vip", Today: 20, Total: 20, PerDay: 1000}}, q.Usage(""))
+
+	// a new day
+	clock.Add(wait)
+	ok, _, _ = q.Allow("a")
+	assert.True(ok)
+	assert.Equal([]*QuotaUsage{{Key: "a", Today: 0, Total: 31.5, PerDay: 25}}, q.Usage("a"))
+	q.sweep(clock.Now().Add(24 * time.Hour))
+	assert.Empty(q.Usage(""))
+
+	// clients seen today are forgotten over max clients if they're idle, from the least recently seen
+	conf.MaxClients = 2
+	for _, c := range []string{"b", "c", "d", "a"} {
+		q.Charge(c, []string{"GetBalance"}, []string{CacheStatusMiss})
+		clock.Add(time.Second)
+	}
+	q.sweep(clock.Now())
+	assert.Len(q.Usage(""), 4)
+	q.sweep(clock.Now().Add(time.Minute))
+	assert.Equal([]string{"a", "d"}, func() (keys []string) {
+		for _, u := range q.Usage("") {
+			keys = append(keys, u.Key)
+		}
+		return keys
+	}())
+
+	conf = &QuotaConfig{MaxClients: -1}
+	conf.SetDefaults()
+	assert.Len(conf.Check(), 1)
+}
+
+func TestQuotaHandler(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:       "127.0.0.1:8080",
+		Upstreams:    []string{newNegativeUpstream(t, &calls)},
+		Cache:        &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs: []*CacheConfig{{Methods: []string{"GetBalance"}, For: Duration{Duration: time.Minute}}},
+		Quota:        &QuotaConfig{Quota: Quota{PerDay: 3}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	r := router.New()
+	p.RegisterHandler(r)
+	NewManage(config, p).registerHandler(r)
+	h := p.quotaHandler(r.Handler)
+	do := func(method, uri, body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.SetBodyString(body)
+		h(ctx)
+		return ctx
+	}
+	req := `{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}`
+	for i := 0; i < 5; i++ {
+		assert.Equal(200, do("POST", "/", req).Response.StatusCode())
+	}
+	ctx := do("POST", "/", `[{"jsonrpc":"2.0","id":1,"method":"Echo","params":[]},{"jsonrpc":"2.0","id":2,"method":"Echo","params":[]}]`)
+	assert.Equal(200, ctx.Response.StatusCode())
+	ctx = do("POST", "/", req)
+	assert.Equal(fasthttp.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal(`{"id":1,"jsonrpc":"2.0","error":{"code":-32005,"message":"Limit exceeded","data":"quota per day exceeded"}}`, string(ctx.Response.Body()))
+	assert.NotEmpty(ctx.Response.Header.Peek("Retry-After"))
+
+	ctx = do("GET", "/manage/usage?key=0.0.0.0", "")
+	assert.Equal(200, ctx.Response.StatusCode())
+	var res manageUsage
+	assert.NoError(jsoniter.Unmarshal(ctx.Response.Body(), &res))
+	assert.Equal([]*QuotaUsage{{Key: "0.0.0.0", Today: 3, Total: 3, PerDay: 3}}, res.Usage)
+	assert.Equal(404, do("GET", "/manage/usage?key=none", "").Response.StatusCode())
+
+	// authenticated clients are keyed by IP too, or by their ids by header
+	authenticated := func() *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/")
+		ctx.Request.SetBodyString(req)
+		ctx.SetUserValue("client", &authClient{id: apiKeyID("k1")})
+		h(ctx)
+		return ctx
+	}
+	assert.Equal(fasthttp.StatusTooManyRequests, authenticated().Response.StatusCode())
+	config.Quota.By = RateLimitByHeader
+	assert.Equal(200, authenticated().Response.StatusCode())
+}
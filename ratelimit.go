@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	"github.com/valyala/fasthttp"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clients of rate limits are keyed by
+const (
+	RateLimitByIP     = "ip"
+	RateLimitByHeader = "header"
+)
+
+const (
+	DefaultApiKeyHeader    = "X-Api-Key"
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimit allows Rate requests per second with bursts of Burst requests, 0 rate is unlimited.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+func (l *RateLimit) SetDefaults() {
+	if l.Burst == 0 {
+		l.Burst = int(math.Max(1, math.Ceil(l.Rate)))
+	}
+}
+
+func (l *RateLimit) check(path string, errs *ConfigErrors) {
+	if l.Rate < 0 {
+		errs.Add(path+".rate", "must not be negative")
+	}
+	if l.Burst < 0 {
+		errs.Add(path+".burst", "must not be negative")
+	}
+}
+
+// MethodRateLimit limits requests of Methods of a client.
+type MethodRateLimit struct {
+	Methods []string `json:"methods"`
+	RateLimit
+}
+
+// ClientRateLimit overrides the limits of the client of Key, an IP or an API key.
+type ClientRateLimit struct {
+	Key string `json:"key"`
+	RateLimit
+	// Methods are looked up before the default ones
+	Methods []*MethodRateLimit `json:"methods,omitempty"`
+}
+
+// RateLimitConfig limits requests of every client by token buckets, a batch of n requests takes n
+// tokens.
+type RateLimitConfig struct {
+	// By keys clients by `ip`, or by their API key or token authenticated by auth (`header`,
+	// requires auth) falling back to IP
+	By string `json:"by"`
+	RateLimit
+	Methods []*MethodRateLimit `json:"methods,omitempty"`
+	Clients []*ClientRateLimit `json:"clients,omitempty"`
+}
+
+func (c *RateLimitConfig) SetDefaults() {
+	if c.By == "" {
+		c.By = RateLimitByIP
+	}
+	c.RateLimit.SetDefaults()
+	for _, m := range c.Methods {
+		m.SetDefaults()
+	}
+	for _, client := range c.Clients {
+		client.RateLimit.SetDefaults()
+		for _, m := range client.Methods {
+			m.SetDefaults()
+		}
+	}
+}
+
+func (c *RateLimitConfig) Check() ConfigErrors {
+	var errs ConfigErrors
+	if c.By != RateLimitByIP && c.By != RateLimitByHeader {
+		errs.Add("rateLimit.by", "must be ip or header")
+	}
+	c.RateLimit.check("rateLimit", &errs)
+	checkMethodRateLimits("rateLimit", c.Methods, &errs)
+	keys := map[string]bool{}
+	for i, client := range c.Clients {
+		p := fmt.Sprintf("rateLimit.clients[%d]", i)
+		if client.Key == "" {
+			errs.Add(p+".key", "is empty")
+		} else if keys[client.Key] {
+			errs.Add(p+".key", "duplicated key %s", client.Key)
+		}
+		keys[client.Key] = true
+		client.RateLimit.check(p, &errs)
+		checkMethodRateLimits(p, client.Methods, &errs)
+	}
+	return errs
+}
+
+func checkMethodRateLimits(path string, limits []*MethodRateLimit, errs *ConfigErrors) {
+	for i, m := range limits {
+		p := fmt.Sprintf("%s.methods[%d]", path, i)
+		if len(m.Methods) == 0 {
+			errs.Add(p+".methods", "is empty")
+		}
+		m.RateLimit.check(p, errs)
+	}
+}
+
+// tokenBucket allows rate events per second with bursts of burst events.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) Allow() bool {
+	ok, _ := b.take(time.Now(), 1)
+	return ok
+}
+
+// take takes n tokens at now, or tells how long to wait for them if there are not enough. More
+// than burst tokens can never be saved, so such n is taken from a full bucket, which goes negative
+// and makes later requests wait until all n tokens are refilled.
+func (b *tokenBucket) take(now time.Time, n float64) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if need := math.Min(n, b.burst); b.tokens < need {
+		if b.rate <= 0 {
+			return false, 0
+		}
+		return false, time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens -= n
+	return true, 0
+}
+
+// give gives back n tokens taken for a request that is rejected after all.
+func (b *tokenBucket) give(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+n)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// charge takes n tokens at now even if there are not enough, the bucket is refilled later.
+func (b *tokenBucket) charge(now time.Time, n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+}
+
+// wait tells how long it takes to have tokens at now, 0 if there are.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens > 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((-b.tokens)/b.rate*float64(time.Second)) + time.Millisecond
+}
+
+// full tells whether the bucket is refilled at now, it's then the same as a new one.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// clientLimits are the limits of a client, methods are by method name.
+type clientLimits struct {
+	limit   *RateLimit
+	methods map[string]*RateLimit
+}
+
+func methodLimits(limits []*MethodRateLimit, into map[string]*RateLimit) map[string]*RateLimit {
+	for _, m := range limits {
+		for _, method := range m.Methods {
+			if _, ok := into[method]; !ok {
+				into[method] = &m.RateLimit
+			}
+		}
+	}
+	return into
+}
+
+// rateLimiter keeps token buckets of clients and their methods, refilled buckets are forgotten.
+type rateLimiter struct {
+	conf     *RateLimitConfig
+	clock    Clock
+	defaults *clientLimits
+	clients  map[string]*clientLimits
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(conf *RateLimitConfig, clock Clock) *rateLimiter {
+	l := &rateLimiter{
+		conf:     conf,
+		clock:    clock,
+		defaults: &clientLimits{limit: &conf.RateLimit, methods: methodLimits(conf.Methods, map[string]*RateLimit{})},
+		clients:  map[string]*clientLimits{},
+		buckets:  map[string]*tokenBucket{},
+	}
+	for _, c := range conf.Clients {
+		limits := &clientLimits{
+			limit:   &c.RateLimit,
+			methods: methodLimits(conf.Methods, methodLimits(c.Methods, map[string]*RateLimit{})),
+		}
+		// the key is an IP or an API key
+		l.clients[c.Key] = limits
+		l.clients[apiKeyID(c.Key)] = limits
+	}
+	go l.runSweeper(rateLimitSweepInterval)
+	return l
+}
+
+// clientKey returns the id of the authenticated client, or the IP of the client. Headers are never
+// trusted as keys by themselves, or clients could get a fresh key per request.
+func clientKey(ctx *fasthttp.RequestCtx) string {
+	if c := getCtxClient(ctx); c != nil {
+		return c.id
+	}
+	return clientIP(ctx).String()
+}
+
+// clientKeyBy returns the key of the client by `ip` or by `header` of RateLimitConfig.By.
+func clientKeyBy(ctx *fasthttp.RequestCtx, by string) string {
+	if by == RateLimitByIP {
+		return clientIP(ctx).String()
+	}
+	return clientKey(ctx)
+}
+
+// Allow takes tokens of requests of methods by client, limits are looked up by client if nil. If
+// it's not allowed, no tokens are taken, and it tells how long to wait and the method limited, empty
+// if the client is limited.
+func (l *rateLimiter) Allow(client string, limits *clientLimits, methods []string) (ok bool, wait time.Duration, limited string) {
+	if limits == nil {
+		limits = l.clients[client]
+	}
+	if limits == nil {
+		limits = l.defaults
+	}
+	counts := map[string]int{}
+	for _, m := range methods {
+		counts[m]++
+	}
+	now := l.clock.Now()
+	// tokens taken from the method buckets allowing the request are given back if another rejects it
+	taken := map[*tokenBucket]float64{}
+	reject := func(wait time.Duration, limited string) (bool, time.Duration, string) {
+		for b, n := range taken {
+			b.give(n)
+		}
+		return false, wait, limited
+	}
+	for m, n := range counts {
+		if limit := limits.methods[m]; limit != nil && limit.Rate > 0 {
+			b := l.bucket(client+"\x00"+m, limit)
+			if ok, wait := b.take(now, float64(n)); !ok {
+				return reject(wait, m)
+			}
+			taken[b] = float64(n)
+		}
+	}
+	if limits.limit.Rate > 0 {
+		if ok, wait := l.bucket(client, limits.limit).take(now, float64(len(methods))); !ok {
+			return reject(wait, "")
+		}
+	}
+	return true, 0, ""
+}
+
+func (l *rateLimiter) bucket(key string, limit *RateLimit) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(limit.Rate, limit.Burst)
+		b.last = l.clock.Now()
+		l.buckets[key] = b
+	}
+	return b
+}
+
+func (l *rateLimiter) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.sweep(l.clock.Now())
+	}
+}
+
+// sweep forgets buckets refilled at now.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// peekRpcRequests returns methods of a request or a batch without parsing the params, and the id
+// of a single request.
+func peekRpcRequests(body []byte) (methods []string, id interface{}) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, nil
+	}
+	switch body[0] {
+	case '{':
+		req := jsoniter.Get(body)
+		return []string{req.Get("method").ToString()}, req.Get("id").GetInterface()
+	case '[':
+		reqs := jsoniter.Get(body)
+		for i := 0; i < reqs.Size(); i++ {
+			methods = append(methods, reqs.Get(i, "method").ToString())
+		}
+	}
+	return methods, nil
+}
+
+// rateLimitHandler rejects RPC requests over the rate limits with LimitExceeded and HTTP 429.
+func (p *Proxy) rateLimitHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if p.limiter == nil || !ctx.IsPost() || p.routeOf(ctx) == nil {
+			h(ctx)
+			return
+		}
+		methods, id := peekRpcRequests(ctx.Request.Body())
+		if len(methods) == 0 {
+			h(ctx)
+			return
+		}
+		limits := getCtxClient(ctx).limits()
+		ok, wait, limited := p.limiter.Allow(clientKeyBy(ctx, p.limiter.conf.By), limits, methods)
+		if ok {
+			h(ctx)
+			return
+		}
+		limit := "client"
+		if limited != "" {
+			limit = "method"
+		}
+		for _, m := range methods {
+			RateLimited.WithLabelValues(limit, m).Inc()
+		}
+		ctx.SetUserValue("isRpcReq", true)
+		setCtxRpcMethods(ctx, methods)
+		writeRpcErrResp(ctx, jsonrpc.ErrRpcLimitExceeded, id)
+		ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+}
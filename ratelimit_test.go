@@ -0,0 +1,163 @@
+package main
+
+import (
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	assert := assertion.New(t)
+	b := newTokenBucket(100, 2)
+	assert.True(b.Allow())
+	assert.True(b.Allow())
+	assert.False(b.Allow())
+	time.Sleep(20 * time.Millisecond)
+	assert.True(b.Allow())
+
+	now := time.Now()
+	b = newTokenBucket(2, 4)
+	b.last = now
+	ok, _ := b.take(now, 3)
+	assert.True(ok)
+	ok, wait := b.take(now, 2)
+	assert.False(ok)
+	assert.Equal(500*time.Millisecond, wait)
+	assert.False(b.full(now.Add(time.Second)))
+	assert.True(b.full(now.Add(2 * time.Second)))
+
+	// batches larger than the burst are taken from a full bucket, and paid for in full
+	now = now.Add(2 * time.Second)
+	ok, _ = b.take(now, 10)
+	assert.True(ok)
+	ok, wait = b.take(now.Add(time.Second), 10)
+	assert.False(ok)
+	assert.Equal(4*time.Second, wait)
+	ok, _ = b.take(now.Add(4*time.Second), 10)
+	assert.False(ok)
+	ok, _ = b.take(now.Add(5*time.Second), 10)
+	assert.True(ok)
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assertion.New(t)
+	conf := &RateLimitConfig{
+		RateLimit: RateLimit{Rate: 2},
+		Methods:   []*MethodRateLimit{{Methods: []string{"GetSmartContractState"}, RateLimit: RateLimit{Rate: 1}}},
+		Clients: []*ClientRateLimit{{Key: "10.0.0.1", RateLimit: RateLimit{Rate: 100},
+			Methods: []*MethodRateLimit{{Methods: []string{"GetSmartContractState"}, RateLimit: RateLimit{Rate: 0}}}},
+			{Key: "secret", RateLimit: RateLimit{Rate: 0}}},
+	}
+	conf.SetDefaults()
+	assert.Empty(conf.Check())
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	l := newRateLimiter(conf, clock)
+
+	ok, _, _ := l.Allow("10.0.0.2", nil, []string{"GetBalance", "GetBalance"})
+	assert.True(ok)
+	ok, wait, limited := l.Allow("10.0.0.2", nil, []string{"GetBalance"})
+	assert.False(ok)
+	assert.Equal(500*time.Millisecond, wait)
+	assert.Equal("", limited)
+	// buckets are per client
+	ok, _, _ = l.Allow("10.0.0.3", nil, []string{"GetSmartContractState"})
+	assert.True(ok)
+	ok, _, limited = l.Allow("10.0.0.3", nil, []string{"GetSmartContractState"})
+	assert.False(ok)
+	assert.Equal("GetSmartContractState", limited)
+	// overridden by client
+	for i := 0; i < 10; i++ {
+		ok, _, _ = l.Allow("10.0.0.1", nil, []string{"GetSmartContractState"})
+		assert.True(ok)
+	}
+
+	// tokens of methods are given back if the client is limited
+	ok, _, _ = l.Allow("10.0.0.4", nil, []string{"GetBalance", "GetBalance"})
+	assert.True(ok)
+	ok, _, limited = l.Allow("10.0.0.4", nil, []string{"GetSmartContractState"})
+	assert.False(ok)
+	assert.Equal("", limited)
+	assert.True(l.buckets["10.0.0.4\x00GetSmartContractState"].full(clock.Now()))
+
+	// or by the id of an API key
+	for i := 0; i < 10; i++ {
+		ok, _, _ = l.Allow(apiKeyID("secret"), nil, []string{"GetBalance"})
+		assert.True(ok)
+	}
+
+	clock.Add(time.Second)
+	ok, _, _ = l.Allow("10.0.0.2", nil, []string{"GetBalance"})
+	assert.True(ok)
+	// refilled buckets are forgotten
+	l.sweep(clock.Now())
+	assert.Len(l.buckets, 1)
+	l.sweep(clock.Now().Add(time.Minute))
+	assert.Empty(l.buckets)
+
+	conf = &RateLimitConfig{By: "user", Clients: []*ClientRateLimit{{}, {}}}
+	conf.SetDefaults()
+	assert.Len(conf.Check(), 3)
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newNegativeUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		RateLimit: &RateLimitConfig{By: RateLimitByHeader, RateLimit: RateLimit{Rate: 1, Burst: 2}},
+	}
+	config.SetDefaults()
+	assert.Len(config.Check(), 1)
+	config.Auth = &AuthConfig{Keys: []*ApiKey{{Key: "k1"}, {Key: "k2"}}}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+	h := p.authHandler(p.rateLimitHandler(p.requestHandler))
+	do := func(body string, header ...string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI(config.Path)
+		ctx.Request.SetBodyString(body)
+		for i := 0; i+1 < len(header); i += 2 {
+			ctx.Request.Header.Set(header[i], header[i+1])
+		}
+		h(ctx)
+		return ctx
+	}
+	ctx := do(`[{"jsonrpc":"2.0","id":1,"method":"Echo","params":[]},{"jsonrpc":"2.0","id":2,"method":"Echo","params":[]}]`, "X-Api-Key", "k1")
+	assert.Equal(200, ctx.Response.StatusCode())
+	ctx = do(`{"jsonrpc":"2.0","id":"a","method":"Echo","params":[]}`, "X-Api-Key", "k1")
+	assert.Equal(fasthttp.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal("1", string(ctx.Response.Header.Peek("Retry-After")))
+	assert.Equal(`{"id":"a","jsonrpc":"2.0","error":{"code":-32005,"message":"Limit exceeded"}}`, string(ctx.Response.Body()))
+	assert.EqualValues(2, atomic.LoadInt64(&calls))
+	// batches larger than the burst are allowed with a full bucket, and paid for in full
+	batch := `[` + strings.TrimSuffix(strings.Repeat(`{"jsonrpc":"2.0","id":1,"method":"Echo","params":[]},`, 3), ",") + `]`
+	ctx = do(batch, "X-Api-Key", "k2")
+	assert.Equal(200, ctx.Response.StatusCode())
+	ctx = do(batch, "X-Api-Key", "k2")
+	assert.Equal(fasthttp.StatusTooManyRequests, ctx.Response.StatusCode())
+	assert.Equal("3", string(ctx.Response.Header.Peek("Retry-After")))
+	assert.EqualValues(5, atomic.LoadInt64(&calls))
+	// keyed by ip without the header
+	ctx = do(`{"jsonrpc":"2.0","id":"a","method":"Echo","params":[]}`)
+	assert.Equal(200, ctx.Response.StatusCode())
+	assert.EqualValues(6, atomic.LoadInt64(&calls))
+	// headers which are not authenticated keys are not trusted
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set(DefaultApiKeyHeader, "k3")
+	assert.Equal("0.0.0.0", clientKey(ctx))
+
+	// authenticated clients are keyed by IP too
+	config.RateLimit.By = RateLimitByIP
+	ctx = do(`{"jsonrpc":"2.0","id":"a","method":"Echo","params":[]}`, "X-Api-Key", "k1")
+	assert.Equal(200, ctx.Response.StatusCode())
+	ctx = do(`{"jsonrpc":"2.0","id":"a","method":"Echo","params":[]}`, "X-Api-Key", "k2")
+	assert.Equal(fasthttp.StatusTooManyRequests, ctx.Response.StatusCode())
+}
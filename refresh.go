@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRefreshHits  = 10
+	DefaultRefreshAfter = 0.75
+	DefaultRefreshRate  = 10
+)
+
+// refreshSweepInterval is how often the hits of expired results are forgotten
+const refreshSweepInterval = time.Minute
+
+// keyHits counts the hits of a cached result in its lifetime.
+type keyHits struct {
+	mu         sync.Mutex
+	storedAt   int64
+	expireAt   int64
+	hits       int
+	refreshing bool
+}
+
+// refresher refreshes hot cached results before they expire. Hits are counted per key and per
+// lifetime of the result, a key is refreshed at most once in a lifetime.
+type refresher struct {
+	p       *Proxy
+	keys    sync.Map
+	limiter *tokenBucket
+}
+
+func newRefresher(p *Proxy, rate int) *refresher {
+	r := &refresher{p: p, limiter: newTokenBucket(float64(rate), rate)}
+	go r.runSweeper(refreshSweepInterval)
+	return r
+}
+
+// hit counts a hit of the cached result item of req to the upstream group, and refreshes it in
+// background if it's hot and old enough.
+func (r *refresher) hit(group string, req *jsonrpc.RpcRequest, cc *CacheConfig, item *CachedItem) {
+	if cc.RefreshAhead == nil || item.StoredAt == 0 {
+		return
+	}
+	key, err := r.p.cacheKey(group, req)
+	if err != nil {
+		return
+	}
+	v, ok := r.keys.Load(key)
+	if !ok {
+		v, _ = r.keys.LoadOrStore(key, &keyHits{})
+	}
+	h := v.(*keyHits)
+	h.mu.Lock()
+	if h.storedAt != item.StoredAt {
+		// a new lifetime
+		h.storedAt, h.expireAt, h.hits, h.refreshing = item.StoredAt, item.StoredAt+item.TTL, 0, false
+	}
+	h.hits++
+	due := !h.refreshing && h.hits >= cc.RefreshAhead.Hits && item.AgeRatio(r.p.clock.Now()) >= cc.RefreshAhead.After
+	if due {
+		if !r.limiter.Allow() {
+			h.mu.Unlock()
+			RefreshAheadRequests.WithLabelValues(req.Method, "limited").Inc()
+			return
+		}
+		h.refreshing = true
+	}
+	h.mu.Unlock()
+	if due {
+		go r.refresh(group, &jsonrpc.RpcRequest{Method: req.Method, Params: req.Params}, h)
+	}
+}
+
+func (r *refresher) refresh(group string, req *jsonrpc.RpcRequest, h *keyHits) {
+	method := req.Method
+	err := r.p.fetchAndCache(group, []*jsonrpc.RpcRequest{req})
+	if err != nil {
+		log.WithError(err).WithField("method", method).Debug("error while refreshing cache ahead")
+		// let the next hit retry
+		h.mu.Lock()
+		h.refreshing = false
+		h.mu.Unlock()
+	}
+	RefreshAheadRequests.WithLabelValues(method, warmupResult(err)).Inc()
+}
+
+func (r *refresher) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.sweep(r.p.clock.Now())
+	}
+}
+
+// sweep forgets hits of results expired before now.
+func (r *refresher) sweep(now time.Time) {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	r.keys.Range(func(k, v interface{}) bool {
+		h := v.(*keyHits)
+		h.mu.Lock()
+		expired := h.expireAt < ms
+		h.mu.Unlock()
+		if expired {
+			r.keys.Delete(k)
+		}
+		return true
+	})
+}
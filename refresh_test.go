@@ -0,0 +1,53 @@
+package main
+
+import (
+	assertion "github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshAhead(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newEchoUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs: []*CacheConfig{{
+			Methods:      []string{"GetBalance"},
+			For:          Duration{Duration: 400 * time.Millisecond},
+			RefreshAhead: &RefreshAheadConfig{Hits: 3, After: 0.5},
+		}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	assert.Equal(DefaultRefreshRate, config.RefreshRate)
+	p := NewProxy(config)
+	p.initOnce.Do(p.init)
+	req := `[{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}]`
+	expected := `[{"jsonrpc":"2.0","id":1,"result":"GetBalance"}]`
+
+	assert.Equal(expected, string(doProxyRequest(p, req).Response.Body()))
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+	// hot but young
+	for i := 0; i < 5; i++ {
+		doProxyRequest(p, req)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(1, atomic.LoadInt64(&calls))
+
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		assert.Equal(expected, string(doProxyRequest(p, req).Response.Body()))
+	}
+	time.Sleep(50 * time.Millisecond)
+	// refreshed once in the lifetime
+	assert.EqualValues(2, atomic.LoadInt64(&calls))
+	item := p.CacheManager.GetItem(`GetBalance(["a"])`, 0)
+	assert.Less(item.AgeRatio(time.Now()), 0.5)
+
+	p.refresher.sweep(time.Now().Add(time.Second))
+	_, ok := p.refresher.keys.Load(`GetBalance(["a"])`)
+	assert.False(ok)
+}
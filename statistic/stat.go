@@ -1,11 +1,11 @@
 package statistic
 
 import (
-	realip "github.com/Ferluci/fast-realip"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
+	"net"
 	"reflect"
 	"sync"
 	"time"
@@ -26,7 +26,12 @@ type Stat struct {
 
 func newStat(ctx *fasthttp.RequestCtx, req *jsonrpc.RpcRequest, start, end time.Time) *Stat {
 	s := pool.Get().(*Stat)
-	s.IP = realip.FromRequest(ctx)
+	// the client IP is resolved by the proxy from headers of trusted proxies
+	if ip, ok := ctx.UserValue("clientIP").(net.IP); ok {
+		s.IP = ip.String()
+	} else {
+		s.IP = ctx.RemoteIP().String()
+	}
 	s.UserAgent = string(ctx.UserAgent())
 	s.Method = req.Method
 	params := reflect.ValueOf(req.Params)
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fetch sends reqs to upstream in a batch and returns the responses in the order of reqs,
+// responses missing from upstream are left empty. Ids of reqs are replaced.
+func (p *Proxy) fetch(reqs []*jsonrpc.RpcRequest) ([]jsonrpc.RpcResponse, time.Duration, error) {
+	return p.fetchWithHeader(p.um, nil, reqs)
+}
+
+// fetchWithHeader is fetch from um sending the headers h of a client request, h may be nil.
+func (p *Proxy) fetchWithHeader(um *UpstreamManager, h *fasthttp.RequestHeader, reqs []*jsonrpc.RpcRequest) ([]jsonrpc.RpcResponse, time.Duration, error) {
+	for i, r := range reqs {
+		r.Jsonrpc = jsonrpc.JSONRPC2
+		r.Id = float64(i)
+	}
+	body, err := jsoniter.Marshal(reqs)
+	if err != nil {
+		return nil, 0, err
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if h != nil {
+		h.CopyTo(&req.Header)
+	}
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+	start := p.clock.Now()
+	if err := um.DoTimeout(req, resp, p.config.UpstreamRequestTimeout.Duration); err != nil {
+		return nil, 0, err
+	}
+	delta := p.clock.Now().Sub(start)
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, 0, fmt.Errorf("upstream responded %d", resp.StatusCode())
+	}
+	data, err := getResponseBody(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	var resps []jsonrpc.RpcResponse
+	if err := jsoniter.Unmarshal(data, &resps); err != nil {
+		return nil, 0, errors.Wrap(err, "invalid response from upstream")
+	}
+	ordered := make([]jsonrpc.RpcResponse, len(reqs))
+	for i := range resps {
+		id, ok := resps[i].Id.(float64)
+		if !ok || int(id) < 0 || int(id) >= len(reqs) {
+			continue
+		}
+		ordered[int(id)] = resps[i]
+	}
+	return ordered, delta, nil
+}
+
+// fetchAndCache fetches reqs from the upstream group and caches the responses by their cache rules,
+// it's how the cache is filled without client requests.
+func (p *Proxy) fetchAndCache(group string, reqs []*jsonrpc.RpcRequest) error {
+	resps, delta, err := p.fetchWithHeader(p.upstreams(group), nil, reqs)
+	if err != nil {
+		return err
+	}
+	for i := range resps {
+		if resps[i].Id != nil {
+			p.cacheResponse(group, reqs[i], &resps[i], delta)
+		}
+	}
+	return nil
+}
+
+// cacheResponse caches resp of req fetched from the upstream group in delta by the cache rule of
+// its method.
+func (p *Proxy) cacheResponse(group string, req *jsonrpc.RpcRequest, resp *jsonrpc.RpcResponse, delta time.Duration) {
+	cc := p.config.Search(req.Method)
+	if cc == nil {
+		return
+	}
+	if resp.Error != nil {
+		errFor := cc.ErrFor.Duration
+		if errFor == 0 {
+			errFor = p.config.ErrFor.Duration
+		}
+		if !resp.Error.Is(jsonrpc.ErrRpcInvalidRequest) {
+			p.SetCachedError(group, req, resp.Error, errFor)
+		}
+		return
+	}
+	p.SetCachedRpcResponse(group, req, resp, cc.For.Duration, delta)
+}
+
+// Ready tells whether the startup warmup is done.
+func (p *Proxy) Ready() bool {
+	return atomic.LoadInt32(&p.ready) == 1
+}
+
+// StartWarmup replays the warmup file, marks the proxy ready, then runs warmers until ctx is done.
+func (p *Proxy) StartWarmup(ctx context.Context) {
+	p.initOnce.Do(p.init)
+	conf := p.config.Warmup
+	if conf == nil {
+		atomic.StoreInt32(&p.ready, 1)
+		return
+	}
+	if conf.File != "" {
+		// immutable rules need the tip
+		if p.config.Tip != nil {
+			if err := p.updateTip(); err != nil {
+				log.WithError(err).Warn("error while tracking tip of the chain")
+			}
+		}
+		wctx, cancel := context.WithTimeout(ctx, conf.Timeout.Duration)
+		start := time.Now()
+		n, err := p.warmupFromFile(wctx, conf.File)
+		cancel()
+		if err != nil {
+			log.WithError(err).Warnf("cache warmup from %s is not finished", conf.File)
+		} else {
+			log.Infof("warmed up cache with %d requests from %s in %s", n, conf.File, time.Since(start))
+		}
+	}
+	atomic.StoreInt32(&p.ready, 1)
+	p.runWarmers(ctx)
+}
+
+// readWarmupFile reads the requests in a JSONL file, every line is a request or a batch of requests.
+func readWarmupFile(path string) ([]*jsonrpc.RpcRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var reqs []*jsonrpc.RpcRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		rs, rpcErr := jsonrpc.ParseRequest(line)
+		if rpcErr != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, rpcErr.Message)
+		}
+		for _, r := range rs {
+			if r.Method == "" {
+				return nil, fmt.Errorf("%s:%d: method is empty", path, n)
+			}
+		}
+		reqs = append(reqs, rs...)
+	}
+	return reqs, scanner.Err()
+}
+
+func (p *Proxy) warmupFromFile(ctx context.Context, path string) (int, error) {
+	reqs, err := readWarmupFile(path)
+	if err != nil {
+		return 0, err
+	}
+	reqs = p.prioritizeWarmup(reqs)
+	conf := p.config.Warmup
+	batches := make(chan []*jsonrpc.RpcRequest)
+	var done int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < conf.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				err := p.fetchAndCache("", batch)
+				WarmupRequests.WithLabelValues("file", warmupResult(err)).Add(float64(len(batch)))
+				if err != nil {
+					log.WithError(err).Debug("error while warming up cache")
+					continue
+				}
+				atomic.AddInt64(&done, int64(len(batch)))
+			}
+		}()
+	}
+	for len(reqs) > 0 {
+		n := conf.BatchSize
+		if n > len(reqs) {
+			n = len(reqs)
+		}
+		select {
+		case batches <- reqs[:n]:
+			reqs = reqs[n:]
+		case <-ctx.Done():
+			close(batches)
+			wg.Wait()
+			return int(done), ctx.Err()
+		}
+	}
+	close(batches)
+	wg.Wait()
+	return int(done), nil
+}
+
+// prioritizeWarmup moves requests of immutable rules first as their results are kept for long,
+// and skips those already cached as immutable, e.g. restored from disk.
+func (p *Proxy) prioritizeWarmup(reqs []*jsonrpc.RpcRequest) []*jsonrpc.RpcRequest {
+	var first, rest []*jsonrpc.RpcRequest
+	for _, r := range reqs {
+		cc := p.config.Search(r.Method)
+		if cc == nil || cc.Immutable == nil {
+			rest = append(rest, r)
+			continue
+		}
+		if key, err := p.cacheKey("", r); err == nil {
+			if item := p.CacheManager.GetItem(key, ImmutableTTL); item != nil {
+				cached := item.IsImmutable()
+				ReleaseCachedItem(item)
+				if cached {
+					continue
+				}
+			}
+		}
+		first = append(first, r)
+	}
+	return append(first, rest...)
+}
+
+// runWarmers re-issues the call of every warmer before its cached result expires.
+func (p *Proxy) runWarmers(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, w := range p.config.Warmup.Warmers {
+		cc := p.config.Search(w.Method)
+		if cc == nil || cc.For.Duration <= 0 {
+			continue
+		}
+		interval := w.interval(cc)
+		if interval <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(w *WarmerConfig, interval time.Duration) {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				err := p.fetchAndCache("", []*jsonrpc.RpcRequest{{Method: w.Method, Params: w.Params}})
+				WarmupRequests.WithLabelValues("warmer", warmupResult(err)).Inc()
+				if err != nil {
+					log.WithError(err).WithField("method", w.Method).Warn("error while refreshing cache by warmer")
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(w, interval)
+	}
+	wg.Wait()
+}
+
+func warmupResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/revolution1/jsonrpc-proxy/jsonrpc"
+	assertion "github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newEchoUpstream responds every request of a batch with its method as result.
+func newEchoUpstream(t *testing.T, calls *int64) string {
+	return newTestUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		var reqs []jsonrpc.RpcRequest
+		if err := jsoniter.Unmarshal(ctx.PostBody(), &reqs); err != nil {
+			t.Error(err)
+			return
+		}
+		atomic.AddInt64(calls, int64(len(reqs)))
+		var resps []string
+		for _, r := range reqs {
+			resps = append(resps, fmt.Sprintf(`{"jsonrpc":"2.0","id":%v,"result":"%s"}`, r.Id, r.Method))
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString("[" + strings.Join(resps, ",") + "]")
+	})
+}
+
+func TestWarmupFromFile(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	file := filepath.Join(t.TempDir(), "warmup.jsonl")
+	assert.NoError(ioutil.WriteFile(file, []byte(`# hot keys
+{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["a"]}
+
+[{"jsonrpc":"2.0","id":1,"method":"GetBalance","params":["b"]},{"jsonrpc":"2.0","id":2,"method":"GetNetworkId","params":[]}]
+{"jsonrpc":"2.0","id":1,"method":"NotCached","params":[]}
+`), 0644))
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newEchoUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs: []*CacheConfig{
+			{Methods: []string{"GetBalance", "GetNetworkId"}, For: Duration{Duration: time.Minute}},
+		},
+		Warmup: &WarmupConfig{File: file, BatchSize: 2},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	assert.False(p.Ready())
+	p.StartWarmup(context.Background())
+	assert.True(p.Ready())
+	assert.EqualValues(4, atomic.LoadInt64(&calls))
+
+	ctx := doProxyRequest(p, `{"jsonrpc":"2.0","id":3,"method":"GetBalance","params":["b"]}`)
+	assert.Equal(`{"jsonrpc":"2.0","id":3,"result":"GetBalance"}`, string(ctx.Response.Body()))
+	ctx = doProxyRequest(p, `{"jsonrpc":"2.0","id":4,"method":"GetNetworkId","params":[]}`)
+	assert.Equal(`{"jsonrpc":"2.0","id":4,"result":"GetNetworkId"}`, string(ctx.Response.Body()))
+	assert.EqualValues(4, atomic.LoadInt64(&calls))
+
+	_, err := readWarmupFile(filepath.Join(t.TempDir(), "missing.jsonl"))
+	assert.Error(err)
+	bad := filepath.Join(t.TempDir(), "bad.jsonl")
+	assert.NoError(ioutil.WriteFile(bad, []byte("{\"method\":\"GetBalance\"}\nnot json\n"), 0644))
+	_, err = readWarmupFile(bad)
+	assert.EqualError(err, bad+":2: Parse error")
+}
+
+func TestWarmers(t *testing.T) {
+	assert := assertion.New(t)
+	var calls int64
+	config := &Config{
+		Listen:    "127.0.0.1:8080",
+		Upstreams: []string{newEchoUpstream(t, &calls)},
+		Cache:     &CacheManagerConfig{Engine: CacheEngineLRU, MemoryLimitMb: 16},
+		CacheConfigs: []*CacheConfig{
+			{Methods: []string{"GetBlockchainInfo"}, For: Duration{Duration: 100 * time.Millisecond}},
+		},
+		Warmup: &WarmupConfig{Warmers: []*WarmerConfig{{Method: "GetBlockchainInfo", Params: []interface{}{}, Ahead: Duration{Duration: 50 * time.Millisecond}}}},
+	}
+	config.SetDefaults()
+	assert.Empty(config.Check())
+	p := NewProxy(config)
+	ctx, cancel := context.WithTimeout(context.Background(), 180*time.Millisecond)
+	defer cancel()
+	p.StartWarmup(ctx)
+	assert.True(p.Ready())
+	assert.GreaterOrEqual(atomic.LoadInt64(&calls), int64(3))
+	assert.NotEmpty(p.CacheManager.Get(`GetBlockchainInfo([])`, 0))
+
+	config.Warmup.Warmers[0].Ahead.Duration = time.Second
+	assert.NotEmpty(config.Check())
+
+	// the interval is based on the shortest TTL with jitter
+	config.Warmup.Warmers[0].Ahead.Duration = 50 * time.Millisecond
+	config.CacheConfigs[0].Jitter = 0.4
+	assert.Equal(10*time.Millisecond, config.Warmup.Warmers[0].interval(config.CacheConfigs[0]))
+	config.CacheConfigs[0].Jitter = 0.5
+	assert.Len(config.Check(), 1)
+	config.Warmup.Warmers[0].Ahead.Duration = 0
+	assert.Empty(config.Check())
+	assert.Equal(45*time.Millisecond, config.Warmup.Warmers[0].interval(config.CacheConfigs[0]))
+}